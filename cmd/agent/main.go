@@ -17,12 +17,18 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -33,6 +39,7 @@ import (
 	"google.golang.org/grpc/credentials"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 )
 
@@ -65,6 +72,12 @@ type GrpcProxyAgentOptions struct {
 	// Configuration for connecting to the proxy-server
 	proxyServerHost string
 	proxyServerPort int
+	// host:port of every proxy server, connected to directly instead of proxyServerHost
+	proxyServerAddresses []string
+	// connect to every address proxyServerHost resolves to instead of through a load balancer
+	proxyServerResolve bool
+	// how often the server count is read again through proxyServerHost once connected to that many servers, 0 disables it
+	serverCountRefreshInterval time.Duration
 
 	// Ports for the health and admin server
 	healthServerPort int
@@ -76,16 +89,63 @@ type GrpcProxyAgentOptions struct {
 
 	// file contains service account authorization token for enabling proxy-server token based authorization
 	serviceAccountTokenPath string
+	// how often the token is sent again to the proxy servers, 0 disables it
+	tokenRefreshInterval time.Duration
+
+	// maximum number of concurrent connections the agent serves, 0 means unlimited
+	maxConcurrentConnections int
+	// connections without data in either direction for this long are closed, 0 disables it
+	idleTimeout time.Duration
+	// connections older than this are closed, 0 disables it
+	maxConnectionLifetime time.Duration
+	// how long the dial of a destination may take, 0 means no timeout
+	dialTimeout time.Duration
+
+	// DNS servers used to resolve the destinations of dial requests instead of the host resolver
+	dnsNameservers []string
+	// file in the /etc/hosts format overriding the resolution of host names
+	dnsHostsFile string
+	// domains appended to host names that are not fully qualified
+	dnsSearchDomains []string
+	// timeout of a single DNS lookup
+	dnsTimeout time.Duration
+	// how long resolved addresses are cached, 0 disables caching
+	dnsCacheTTL time.Duration
+	// maximum number of cached DNS lookups, 0 disables caching
+	dnsCacheSize int
+
+	// URL of the HTTP CONNECT or SOCKS5 proxy through which destinations are dialed
+	egressProxyURL string
+	// file containing the username:password of the egress proxy
+	egressProxyCredentialsFile string
+	// ordered action=pattern rules selecting the destinations dialed through the egress proxy
+	egressProxyRules []string
+	// action for the destinations matching no egress proxy rule
+	egressProxyDefault string
+
+	// how long to wait on shutdown for the connections to finish before closing them
+	drainTimeout time.Duration
+
+	// YAML configuration file setting the options not given on the command line
+	configFile string
 }
 
 func (o *GrpcProxyAgentOptions) ClientSetConfig(dialOptions ...grpc.DialOption) *agent.ClientSetConfig {
 	return &agent.ClientSetConfig{
-		Address:                 fmt.Sprintf("%s:%d", o.proxyServerHost, o.proxyServerPort),
-		AgentID:                 o.agentID,
-		SyncInterval:            o.syncInterval,
-		ProbeInterval:           o.probeInterval,
-		DialOptions:             dialOptions,
-		ServiceAccountTokenPath: o.serviceAccountTokenPath,
+		Address:                    net.JoinHostPort(o.proxyServerHost, strconv.Itoa(o.proxyServerPort)),
+		Addresses:                  o.proxyServerAddresses,
+		ResolveAddress:             o.proxyServerResolve,
+		ServerCountRefreshInterval: o.serverCountRefreshInterval,
+		AgentID:                    o.agentID,
+		SyncInterval:               o.syncInterval,
+		ProbeInterval:              o.probeInterval,
+		DialOptions:                dialOptions,
+		ServiceAccountTokenPath:    o.serviceAccountTokenPath,
+		TokenRefreshInterval:       o.tokenRefreshInterval,
+		MaxConnections:             o.maxConcurrentConnections,
+		IdleTimeout:                o.idleTimeout,
+		MaxConnectionLifetime:      o.maxConnectionLifetime,
+		DialTimeout:                o.dialTimeout,
 	}
 }
 
@@ -96,12 +156,32 @@ func (o *GrpcProxyAgentOptions) Flags() *pflag.FlagSet {
 	flags.StringVar(&o.caCert, "ca-cert", o.caCert, "If non-empty the CAs we use to validate clients.")
 	flags.StringVar(&o.proxyServerHost, "proxy-server-host", o.proxyServerHost, "The hostname to use to connect to the proxy-server.")
 	flags.IntVar(&o.proxyServerPort, "proxy-server-port", o.proxyServerPort, "The port the proxy server is listening on.")
+	flags.StringSliceVar(&o.proxyServerAddresses, "proxy-server-addresses", o.proxyServerAddresses, "If non-empty, the host:port of every proxy server. The agent connects to each of them directly instead of to proxy-server-host and proxy-server-port, and connects once to the servers reachable through several addresses. The server certificates are verified against proxy-server-host.")
+	flags.BoolVar(&o.proxyServerResolve, "proxy-server-resolve", o.proxyServerResolve, "If true, proxy-server-host is resolved to all its A and AAAA records at every sync, and the agent connects to each address directly instead of through a load balancer.")
+	flags.DurationVar(&o.serverCountRefreshInterval, "server-count-refresh-interval", o.serverCountRefreshInterval, "If non-zero, how often the agent connects through proxy-server-host again to read the server count once connected to that many proxy servers, and leaves the servers beyond a lower count. Each read costs the proxy server an authenticated stream. 0 disables it: the count is read when a stream connects.")
 	flags.IntVar(&o.healthServerPort, "health-server-port", o.healthServerPort, "The port the health server is listening on.")
 	flags.IntVar(&o.adminServerPort, "admin-server-port", o.adminServerPort, "The port the admin server is listening on.")
 	flags.StringVar(&o.agentID, "agent-id", o.agentID, "The unique ID of this agent. Default to a generated uuid if not set.")
 	flags.DurationVar(&o.syncInterval, "sync-interval", o.syncInterval, "The initial interval by which the agent periodically checks if it has connections to all instances of the proxy server.")
 	flags.DurationVar(&o.probeInterval, "probe-interval", o.probeInterval, "The interval by which the agent periodically checks if its connections to the proxy server are ready.")
 	flags.StringVar(&o.serviceAccountTokenPath, "service-account-token-path", o.serviceAccountTokenPath, "If non-empty proxy agent uses this token to prove its identity to the proxy server.")
+	flags.DurationVar(&o.tokenRefreshInterval, "token-refresh-interval", o.tokenRefreshInterval, "How often the token read from service-account-token-path is sent again to the proxy servers, so that they check it is still valid. 0 disables it.")
+	flags.IntVar(&o.maxConcurrentConnections, "max-concurrent-connections", o.maxConcurrentConnections, "The maximum number of concurrent connections the agent serves. Dial requests beyond it are rejected. 0 means unlimited.")
+	flags.DurationVar(&o.idleTimeout, "idle-timeout", o.idleTimeout, "Close tunneled connections that have not sent data in either direction for this long. 0 disables it.")
+	flags.DurationVar(&o.maxConnectionLifetime, "max-connection-lifetime", o.maxConnectionLifetime, "Close tunneled connections older than this. 0 disables it.")
+	flags.DurationVar(&o.dialTimeout, "dial-timeout", o.dialTimeout, "How long the dial of a destination, including its DNS lookup and the egress proxy, may take. 0 means no timeout.")
+	flags.StringSliceVar(&o.dnsNameservers, "dns-nameservers", o.dnsNameservers, "The DNS servers, as host or host:port, used to resolve the destinations of dial requests. If empty the host resolver is used.")
+	flags.StringVar(&o.dnsHostsFile, "dns-hosts-file", o.dnsHostsFile, "If non-empty, a file in the /etc/hosts format overriding the resolution of the destinations of dial requests.")
+	flags.StringSliceVar(&o.dnsSearchDomains, "dns-search", o.dnsSearchDomains, "The domains appended to destination host names that are not fully qualified.")
+	flags.DurationVar(&o.dnsTimeout, "dns-timeout", o.dnsTimeout, "The timeout of a DNS lookup against a single nameserver.")
+	flags.DurationVar(&o.dnsCacheTTL, "dns-cache-ttl", o.dnsCacheTTL, "How long resolved destination addresses are cached. 0 disables caching.")
+	flags.IntVar(&o.dnsCacheSize, "dns-cache-size", o.dnsCacheSize, "The maximum number of destination host names whose addresses are cached. The least recently used ones are evicted first. 0 disables caching.")
+	flags.StringVar(&o.egressProxyURL, "egress-proxy-url", o.egressProxyURL, "If non-empty, the URL of the HTTP CONNECT (http://host:port) or SOCKS5 (socks5://host:port) proxy through which destinations are dialed.")
+	flags.StringVar(&o.egressProxyCredentialsFile, "egress-proxy-credentials-file", o.egressProxyCredentialsFile, "If non-empty, a file containing the username:password used to authenticate to the egress proxy.")
+	flags.StringSliceVar(&o.egressProxyRules, "egress-proxy-rules", o.egressProxyRules, "Ordered rules selecting whether a destination is dialed through the egress proxy, as action=pattern where action is proxy or direct and pattern is *, an IP, a CIDR, a host name or a .domain suffix. The first matching rule applies.")
+	flags.StringVar(&o.egressProxyDefault, "egress-proxy-default", o.egressProxyDefault, "The action, proxy or direct, for the destinations matching no egress proxy rule.")
+	flags.StringVar(&o.configFile, "config", o.configFile, "If non-empty, a YAML configuration file of kind AgentConfiguration setting the options, named as the flags. Flags given on the command line override it. On SIGHUP the file is reloaded and the changes of the log verbosity and the egress proxy rules are applied.")
+	flags.DurationVar(&o.drainTimeout, "drain-timeout", o.drainTimeout, "How long to wait on shutdown for the established connections to finish before closing them. The proxy servers stop routing new connections to the agent meanwhile.")
 	return flags
 }
 
@@ -111,12 +191,32 @@ func (o *GrpcProxyAgentOptions) Print() {
 	klog.V(1).Infof("CACert set to %q.\n", o.caCert)
 	klog.V(1).Infof("ProxyServerHost set to %q.\n", o.proxyServerHost)
 	klog.V(1).Infof("ProxyServerPort set to %d.\n", o.proxyServerPort)
+	klog.V(1).Infof("ProxyServerAddresses set to %v.\n", o.proxyServerAddresses)
+	klog.V(1).Infof("ProxyServerResolve set to %v.\n", o.proxyServerResolve)
+	klog.V(1).Infof("ServerCountRefreshInterval set to %v.\n", o.serverCountRefreshInterval)
 	klog.V(1).Infof("HealthServerPort set to %d.\n", o.healthServerPort)
 	klog.V(1).Infof("AdminServerPort set to %d.\n", o.adminServerPort)
 	klog.V(1).Infof("AgentID set to %s.\n", o.agentID)
 	klog.V(1).Infof("SyncInterval set to %v.\n", o.syncInterval)
 	klog.V(1).Infof("ProbeInterval set to %v.\n", o.probeInterval)
 	klog.V(1).Infof("ServiceAccountTokenPath set to %q.\n", o.serviceAccountTokenPath)
+	klog.V(1).Infof("TokenRefreshInterval set to %v.\n", o.tokenRefreshInterval)
+	klog.V(1).Infof("MaxConcurrentConnections set to %d.\n", o.maxConcurrentConnections)
+	klog.V(1).Infof("IdleTimeout set to %v.\n", o.idleTimeout)
+	klog.V(1).Infof("MaxConnectionLifetime set to %v.\n", o.maxConnectionLifetime)
+	klog.V(1).Infof("DialTimeout set to %v.\n", o.dialTimeout)
+	klog.V(1).Infof("DNSNameservers set to %v.\n", o.dnsNameservers)
+	klog.V(1).Infof("DNSHostsFile set to %q.\n", o.dnsHostsFile)
+	klog.V(1).Infof("DNSSearchDomains set to %v.\n", o.dnsSearchDomains)
+	klog.V(1).Infof("DNSTimeout set to %v.\n", o.dnsTimeout)
+	klog.V(1).Infof("DNSCacheTTL set to %v.\n", o.dnsCacheTTL)
+	klog.V(1).Infof("DNSCacheSize set to %d.\n", o.dnsCacheSize)
+	klog.V(1).Infof("EgressProxyURL set to %q.\n", redactURL(o.egressProxyURL))
+	klog.V(1).Infof("EgressProxyCredentialsFile set to %q.\n", o.egressProxyCredentialsFile)
+	klog.V(1).Infof("EgressProxyRules set to %v.\n", o.egressProxyRules)
+	klog.V(1).Infof("EgressProxyDefault set to %s.\n", o.egressProxyDefault)
+	klog.V(1).Infof("ConfigFile set to %q.\n", o.configFile)
+	klog.V(1).Infof("DrainTimeout set to %v.\n", o.drainTimeout)
 }
 
 func (o *GrpcProxyAgentOptions) Validate() error {
@@ -144,6 +244,17 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 	if o.proxyServerPort <= 0 {
 		return fmt.Errorf("proxy server port %d must be greater than 0", o.proxyServerPort)
 	}
+	for _, address := range o.proxyServerAddresses {
+		if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+			return fmt.Errorf("proxy server address %q must be host:port", address)
+		}
+	}
+	if len(o.proxyServerAddresses) > 0 && o.proxyServerResolve {
+		return fmt.Errorf("proxy server addresses cannot be set when the proxy server host is resolved")
+	}
+	if o.serverCountRefreshInterval < 0 {
+		return fmt.Errorf("server count refresh interval %v must not be negative", o.serverCountRefreshInterval)
+	}
 	if o.healthServerPort <= 0 {
 		return fmt.Errorf("health server port %d must be greater than 0", o.healthServerPort)
 	}
@@ -156,22 +267,186 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 			return fmt.Errorf("error checking service account token path %s, got %v", o.serviceAccountTokenPath, err)
 		}
 	}
+	if o.tokenRefreshInterval < 0 {
+		return fmt.Errorf("token refresh interval %v must not be negative", o.tokenRefreshInterval)
+	}
+	if o.maxConcurrentConnections < 0 {
+		return fmt.Errorf("max concurrent connections %d must not be negative", o.maxConcurrentConnections)
+	}
+	if o.dialTimeout < 0 {
+		return fmt.Errorf("dial timeout %v must not be negative", o.dialTimeout)
+	}
+	if o.idleTimeout < 0 {
+		return fmt.Errorf("idle timeout %v must not be negative", o.idleTimeout)
+	}
+	if o.maxConnectionLifetime < 0 {
+		return fmt.Errorf("max connection lifetime %v must not be negative", o.maxConnectionLifetime)
+	}
+	for _, ns := range o.dnsNameservers {
+		if _, _, err := net.SplitHostPort(nameserverAddress(ns)); err != nil {
+			return fmt.Errorf("invalid DNS nameserver %q: %v", ns, err)
+		}
+	}
+	if o.dnsHostsFile != "" {
+		if _, err := os.Stat(o.dnsHostsFile); os.IsNotExist(err) {
+			return fmt.Errorf("error checking DNS hosts file %s, got %v", o.dnsHostsFile, err)
+		}
+	}
+	if o.dnsTimeout < 0 {
+		return fmt.Errorf("DNS timeout %v must not be negative", o.dnsTimeout)
+	}
+	if o.dnsCacheTTL < 0 {
+		return fmt.Errorf("DNS cache TTL %v must not be negative", o.dnsCacheTTL)
+	}
+	if o.dnsCacheSize < 0 {
+		return fmt.Errorf("DNS cache size %d must not be negative", o.dnsCacheSize)
+	}
+	if o.egressProxyURL != "" {
+		ec, err := o.EgressProxyConfig()
+		if err != nil {
+			return err
+		}
+		if _, err := agent.NewEgressDialer(ec, nil); err != nil {
+			return err
+		}
+	}
+	if o.egressProxyCredentialsFile != "" {
+		if _, err := os.Stat(o.egressProxyCredentialsFile); os.IsNotExist(err) {
+			return fmt.Errorf("error checking egress proxy credentials file %s, got %v", o.egressProxyCredentialsFile, err)
+		}
+	}
+	if o.drainTimeout < 0 {
+		return fmt.Errorf("drain timeout %v must not be negative", o.drainTimeout)
+	}
 	return nil
 }
 
+// redactURL hides the password of a URL before it is logged.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// EgressProxyConfig returns the configuration of the egress proxy, or nil if
+// destinations are dialed directly.
+func (o *GrpcProxyAgentOptions) EgressProxyConfig() (*agent.EgressProxyConfig, error) {
+	if o.egressProxyURL == "" {
+		return nil, nil
+	}
+	ec := &agent.EgressProxyConfig{
+		URL:             o.egressProxyURL,
+		CredentialsFile: o.egressProxyCredentialsFile,
+		DefaultAction:   agent.EgressAction(o.egressProxyDefault),
+	}
+	if ec.DefaultAction != agent.EgressProxy && ec.DefaultAction != agent.EgressDirect {
+		return nil, fmt.Errorf("egress proxy default %q must be %q or %q", o.egressProxyDefault, agent.EgressProxy, agent.EgressDirect)
+	}
+	for _, r := range o.egressProxyRules {
+		rule, err := agent.ParseEgressRule(r)
+		if err != nil {
+			return nil, err
+		}
+		ec.Rules = append(ec.Rules, rule)
+	}
+	return ec, nil
+}
+
+// Dialer returns the dialer of the destinations of dial requests, or nil if
+// net.Dial is used.
+func (o *GrpcProxyAgentOptions) Dialer() (agent.Dialer, error) {
+	var dialer agent.Dialer
+	rc, err := o.ResolverConfig()
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil {
+		dialer = agent.NewResolver(rc)
+	}
+	ec, err := o.EgressProxyConfig()
+	if err != nil {
+		return nil, err
+	}
+	if ec != nil {
+		if dialer, err = agent.NewEgressDialer(ec, dialer); err != nil {
+			return nil, err
+		}
+	}
+	return dialer, nil
+}
+
+// nameserverAddress adds the default DNS port to nameservers given without
+// one.
+func nameserverAddress(ns string) string {
+	if _, _, err := net.SplitHostPort(ns); err == nil {
+		return ns
+	}
+	return net.JoinHostPort(strings.Trim(ns, "[]"), "53")
+}
+
+// ResolverConfig returns the configuration of the resolver of dial requests,
+// or nil if the host resolver is used.
+func (o *GrpcProxyAgentOptions) ResolverConfig() (*agent.ResolverConfig, error) {
+	if len(o.dnsNameservers) == 0 && o.dnsHostsFile == "" && len(o.dnsSearchDomains) == 0 {
+		return nil, nil
+	}
+	rc := &agent.ResolverConfig{
+		SearchDomains: o.dnsSearchDomains,
+		Timeout:       o.dnsTimeout,
+		CacheTTL:      o.dnsCacheTTL,
+		CacheSize:     o.dnsCacheSize,
+	}
+	for _, ns := range o.dnsNameservers {
+		rc.Nameservers = append(rc.Nameservers, nameserverAddress(ns))
+	}
+	if o.dnsHostsFile != "" {
+		hosts, err := agent.ParseHostsFile(o.dnsHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		rc.Hosts = hosts
+	}
+	return rc, nil
+}
+
 func newGrpcProxyAgentOptions() *GrpcProxyAgentOptions {
 	o := GrpcProxyAgentOptions{
-		agentCert:               "",
-		agentKey:                "",
-		caCert:                  "",
-		proxyServerHost:         "127.0.0.1",
-		proxyServerPort:         8091,
-		healthServerPort:        8093,
-		adminServerPort:         8094,
-		agentID:                 uuid.New().String(),
-		syncInterval:            1 * time.Second,
-		probeInterval:           1 * time.Second,
-		serviceAccountTokenPath: "",
+		agentCert:                  "",
+		agentKey:                   "",
+		caCert:                     "",
+		proxyServerHost:            "127.0.0.1",
+		proxyServerPort:            8091,
+		proxyServerAddresses:       nil,
+		proxyServerResolve:         false,
+		serverCountRefreshInterval: 0,
+		healthServerPort:           8093,
+		adminServerPort:            8094,
+		agentID:                    uuid.New().String(),
+		syncInterval:               1 * time.Second,
+		probeInterval:              1 * time.Second,
+		serviceAccountTokenPath:    "",
+		tokenRefreshInterval:       5 * time.Minute,
+		maxConcurrentConnections:   0,
+		idleTimeout:                0,
+		maxConnectionLifetime:      0,
+		dialTimeout:                30 * time.Second,
+		dnsNameservers:             nil,
+		dnsHostsFile:               "",
+		dnsSearchDomains:           nil,
+		dnsTimeout:                 5 * time.Second,
+		dnsCacheTTL:                30 * time.Second,
+		dnsCacheSize:               1000,
+		egressProxyURL:             "",
+		egressProxyCredentialsFile: "",
+		egressProxyRules:           nil,
+		egressProxyDefault:         string(agent.EgressProxy),
+		drainTimeout:               30 * time.Second,
+		configFile:                 "",
 	}
 	return &o
 }
@@ -181,6 +456,12 @@ func newAgentCommand(a *Agent, o *GrpcProxyAgentOptions) *cobra.Command {
 		Use:  "agent",
 		Long: `A gRPC agent, Connects to the proxy and then allows traffic to be forwarded to it.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.configFile != "" {
+				a.config = util.NewConfigFile(o.configFile, agentConfigKind, cmd.Flags())
+				if err := a.config.Load(); err != nil {
+					return err
+				}
+			}
 			return a.run(o)
 		},
 	}
@@ -188,7 +469,15 @@ func newAgentCommand(a *Agent, o *GrpcProxyAgentOptions) *cobra.Command {
 	return cmd
 }
 
+// agentConfigKind is the kind of the configuration file of the agent.
+const agentConfigKind = "AgentConfiguration"
+
 type Agent struct {
+	// config is the configuration file, nil if none is used.
+	config *util.ConfigFile
+	// egressDialer dials the destinations through the egress proxy, nil if
+	// none is configured.
+	egressDialer *agent.EgressDialer
 }
 
 func (a *Agent) run(o *GrpcProxyAgentOptions) error {
@@ -198,11 +487,12 @@ func (a *Agent) run(o *GrpcProxyAgentOptions) error {
 	}
 
 	stopCh := make(chan struct{})
-	if err := a.runProxyConnection(o, stopCh); err != nil {
+	cs, err := a.runProxyConnection(o, stopCh)
+	if err != nil {
 		return fmt.Errorf("failed to run proxy connection with %v", err)
 	}
 
-	if err := a.runHealthServer(o); err != nil {
+	if err := a.runHealthServer(o, cs); err != nil {
 		return fmt.Errorf("failed to run health server with %v", err)
 	}
 
@@ -210,30 +500,104 @@ func (a *Agent) run(o *GrpcProxyAgentOptions) error {
 		return fmt.Errorf("failed to run admin server with %v", err)
 	}
 
-	<-stopCh
+	if a.config != nil {
+		go a.reloadOnSignal(o)
+	}
+
+	<-setupSignalHandler()
+	klog.V(1).Infoln("Shutting down agent.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.drainTimeout)
+	defer cancel()
+	if err := cs.Drain(ctx); err != nil {
+		klog.ErrorS(err, "Connections were closed before they finished")
+	}
+	close(stopCh)
 
 	return nil
 }
 
-func (a *Agent) runProxyConnection(o *GrpcProxyAgentOptions, stopCh <-chan struct{}) error {
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// setupSignalHandler returns a channel closed on the first shutdown signal.
+// The agent exits directly on the second one.
+func setupSignalHandler() <-chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, shutdownSignals...)
+	go func() {
+		<-c
+		close(stop)
+		<-c
+		os.Exit(1) // second signal. Exit directly.
+	}()
+
+	return stop
+}
+
+// reloadableOptions returns the options of the config file applied on
+// reload.
+func (a *Agent) reloadableOptions() map[string]bool {
+	options := map[string]bool{"v": true}
+	// The egress proxy cannot be turned on without a restart.
+	if a.egressDialer != nil {
+		options["egress-proxy-rules"] = true
+		options["egress-proxy-default"] = true
+	}
+	return options
+}
+
+// reloadOnSignal reloads the config file on SIGHUP.
+func (a *Agent) reloadOnSignal(o *GrpcProxyAgentOptions) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		changed, err := a.config.Reload(a.reloadableOptions(), o.Validate)
+		if err != nil {
+			klog.ErrorS(err, "Failed to reload config file", "path", o.configFile)
+			continue
+		}
+		klog.V(1).InfoS("Reloaded config file", "path", o.configFile, "changed", changed)
+		if a.egressDialer != nil {
+			ec, err := o.EgressProxyConfig()
+			if err != nil {
+				klog.ErrorS(err, "Failed to reload egress proxy rules")
+				continue
+			}
+			a.egressDialer.SetRules(ec.Rules, ec.DefaultAction)
+		}
+	}
+}
+
+func (a *Agent) runProxyConnection(o *GrpcProxyAgentOptions, stopCh <-chan struct{}) (*agent.ClientSet, error) {
 	var tlsConfig *tls.Config
 	var err error
-	if tlsConfig, err = util.GetClientTLSConfig(o.caCert, o.agentCert, o.agentKey, o.proxyServerHost); err != nil {
-		return err
+	if tlsConfig, err = util.GetClientTLSConfig(o.caCert, o.agentCert, o.agentKey, o.proxyServerHost, metrics.Metrics.SetCertificateExpiry); err != nil {
+		return nil, err
 	}
 	dialOption := grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
 	cc := o.ClientSetConfig(dialOption)
+	if cc.Dialer, err = o.Dialer(); err != nil {
+		return nil, err
+	}
+	a.egressDialer, _ = cc.Dialer.(*agent.EgressDialer)
 	cs := cc.NewAgentClientSet(stopCh)
 	cs.Serve()
 
-	return nil
+	return cs, nil
 }
 
-func (a *Agent) runHealthServer(o *GrpcProxyAgentOptions) error {
+func (a *Agent) runHealthServer(o *GrpcProxyAgentOptions, cs *agent.ClientSet) error {
 	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
 	})
 	readinessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, msg := cs.Ready()
+		if !ready {
+			w.WriteHeader(500)
+			fmt.Fprint(w, msg)
+			return
+		}
 		fmt.Fprintf(w, "ok")
 	})
 
@@ -19,16 +19,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -37,14 +37,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
 	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
@@ -81,12 +84,15 @@ type ProxyRunOptions struct {
 	clusterCert   string
 	clusterKey    string
 	clusterCaCert string
-	// Flag to switch between gRPC and HTTP Connect
+	// Flag to switch between gRPC, HTTP Connect and SOCKS5
 	mode string
 	// Location for use by the "unix" network. Setting enables UDS for server connections.
 	udsName string
 	// If file udsName already exists, delete the file before listen on that UDS file.
 	deleteUDSFile bool
+	// Users and primary groups of the processes allowed to connect to the UDS.
+	udsAllowedUIDs []uint
+	udsAllowedGIDs []uint
 	// Port we listen for server connections on.
 	serverPort uint
 	// Port we listen for agent connections on.
@@ -108,14 +114,86 @@ type ProxyRunOptions struct {
 	serverID string
 	// Number of proxy server instances, should be 1 unless it is a HA proxy server.
 	serverCount uint
+	// Namespace of the Leases counting the live proxy servers, empty to use serverCount
+	serverLeaseNamespace string
+	// How long the Lease of a proxy server lives without being renewed
+	serverLeaseDuration time.Duration
 	// Agent pod's namespace for token-based agent authentication
 	agentNamespace string
 	// Agent pod's service account for token-based agent authentication
 	agentServiceAccount string
+	// Further namespace:name service accounts allowed for agent authentication
+	agentServiceAccounts []string
+	// Path to the token,user file of the static agent tokens
+	agentTokenFile string
+	// Patterns of the client certificate common names allowed for agents
+	agentCertCommonNames []string
 	// Token's audience for token-based agent authentication
 	authenticationAudience string
+	// How long an agent may go without sending a new token, 0 disables it
+	agentTokenRefreshDeadline time.Duration
+	// How long an agent must wait between two token refreshes
+	minTokenRefreshInterval time.Duration
+	// Credential of the agents their agent ID must match, empty for none
+	agentIDSource string
 	// Path to kubeconfig (used by kubernetes client)
 	kubeconfigPath string
+	// Maximum number of cached TokenReview results, 0 disables the cache
+	tokenReviewCacheSize int
+	// How long the TokenReview results of valid and invalid tokens are cached
+	tokenReviewCacheTTL    time.Duration
+	tokenReviewNegativeTTL time.Duration
+
+	// Path of the connection audit log. Empty disables auditing, "-" means stdout.
+	auditLogPath string
+	// Maximum size in megabytes of the audit log before it gets rotated.
+	auditLogMaxSize uint
+	// Maximum number of rotated audit log files to retain.
+	auditLogMaxBackup uint
+	// Number of audit events buffered while the audit log is written. 0 writes them synchronously.
+	auditLogBufferSize int
+
+	// Dial requests per second allowed for each frontend identity. 0 disables the limit.
+	frontendDialQPS float32
+	// Burst of dial requests allowed for each frontend identity.
+	frontendDialBurst int
+	// Dial requests per second allowed for each agent. 0 disables the limit.
+	agentDialQPS float32
+	// Burst of dial requests allowed for each agent.
+	agentDialBurst int
+	// Maximum number of dials waiting for a response from an agent. 0 disables the limit.
+	maxPendingDials int
+
+	// Connections without data in either direction for this long are closed. 0 disables it.
+	idleTimeout time.Duration
+	// Connections older than this are closed. 0 disables it.
+	maxConnectionLifetime time.Duration
+
+	// File of username:password lines allowed to connect in socks5 mode. Empty disables authentication.
+	socks5CredentialsFile string
+	// How long socks5 clients may take to send their CONNECT request. 0 means no timeout.
+	socks5HandshakeTimeout time.Duration
+
+	// How long http-connect and socks5 frontends wait for the agent to dial. 0 means no timeout.
+	dialTimeout time.Duration
+
+	// Static token file ("token,user" lines) authenticating http-connect and grpc clients with a bearer token.
+	proxyAuthTokenFile string
+	// htpasswd file authenticating http-connect and grpc clients with basic credentials.
+	proxyAuthHtpasswdFile string
+	// Authenticate http-connect and grpc clients bearer tokens with the TokenReview API.
+	proxyAuthTokenReview bool
+	// Audiences of the bearer tokens reviewed with the TokenReview API.
+	proxyAuthAudiences []string
+
+	// Forward plain HTTP requests with an absolute URI in http-connect mode.
+	httpForwardProxy bool
+
+	// How long to wait on shutdown for the connections to finish before closing them.
+	drainTimeout time.Duration
+
+	// YAML configuration file setting the options not given on the command line.
+	configFile string
 }
 
 func (o *ProxyRunOptions) Flags() *pflag.FlagSet {
@@ -126,9 +204,11 @@ func (o *ProxyRunOptions) Flags() *pflag.FlagSet {
 	flags.StringVar(&o.clusterCert, "cluster-cert", o.clusterCert, "If non-empty secure communication with this cert.")
 	flags.StringVar(&o.clusterKey, "cluster-key", o.clusterKey, "If non-empty secure communication with this key.")
 	flags.StringVar(&o.clusterCaCert, "cluster-ca-cert", o.clusterCaCert, "If non-empty the CA we use to validate Agent clients.")
-	flags.StringVar(&o.mode, "mode", o.mode, "Mode can be either 'grpc' or 'http-connect'.")
+	flags.StringVar(&o.mode, "mode", o.mode, "Mode can be either 'grpc', 'http-connect' or 'socks5'.")
 	flags.StringVar(&o.udsName, "uds-name", o.udsName, "uds-name should be empty for TCP traffic. For UDS set to its name.")
 	flags.BoolVar(&o.deleteUDSFile, "delete-existing-uds-file", o.deleteUDSFile, "If true and if file udsName already exists, delete the file before listen on that UDS file")
+	flags.UintSliceVar(&o.udsAllowedUIDs, "uds-allowed-uids", o.udsAllowedUIDs, "If non-empty, the UIDs of the processes allowed to connect to the UDS, checked with SO_PEERCRED. Linux only.")
+	flags.UintSliceVar(&o.udsAllowedGIDs, "uds-allowed-gids", o.udsAllowedGIDs, "If non-empty, the primary GIDs of the processes allowed to connect to the UDS, checked with SO_PEERCRED. Linux only.")
 	flags.UintVar(&o.serverPort, "server-port", o.serverPort, "Port we listen for server connections on. Set to 0 for UDS.")
 	flags.UintVar(&o.agentPort, "agent-port", o.agentPort, "Port we listen for agent connections on.")
 	flags.UintVar(&o.adminPort, "admin-port", o.adminPort, "Port we listen for admin connections on.")
@@ -138,10 +218,42 @@ func (o *ProxyRunOptions) Flags() *pflag.FlagSet {
 	flags.BoolVar(&o.enableContentionProfiling, "enable-contention-profiling", o.enableContentionProfiling, "enable contention profiling at host:admin-port/debug/pprof/block. \"--enable-profiling\" must also be set.")
 	flags.StringVar(&o.serverID, "server-id", o.serverID, "The unique ID of this server.")
 	flags.UintVar(&o.serverCount, "server-count", o.serverCount, "The number of proxy server instances, should be 1 unless it is an HA server.")
+	flags.StringVar(&o.serverLeaseNamespace, "server-lease-namespace", o.serverLeaseNamespace, "If non-empty, the server registers itself with a Lease in this namespace, and advertises to the agents the number of servers with a live Lease instead of server-count (used with kubeconfig). server-count is advertised until the first Leases are listed.")
+	flags.DurationVar(&o.serverLeaseDuration, "server-lease-duration", o.serverLeaseDuration, "How long the Lease of a server counts without being renewed. It is renewed every third of this duration. Only used with server-lease-namespace.")
 	flags.StringVar(&o.agentNamespace, "agent-namespace", o.agentNamespace, "Expected agent's namespace during agent authentication (used with agent-service-account, authentication-audience, kubeconfig).")
 	flags.StringVar(&o.agentServiceAccount, "agent-service-account", o.agentServiceAccount, "Expected agent's service account during agent authentication (used with agent-namespace, authentication-audience, kubeconfig).")
 	flags.StringVar(&o.kubeconfigPath, "kubeconfig", o.kubeconfigPath, "absolute path to the kubeconfig file (used with agent-namespace, agent-service-account, authentication-audience).")
+	flags.IntVar(&o.tokenReviewCacheSize, "token-review-cache-size", o.tokenReviewCacheSize, "The maximum number of TokenReview results cached, for the agent and the proxy authentication. 0 disables the cache.")
+	flags.DurationVar(&o.tokenReviewCacheTTL, "token-review-cache-ttl", o.tokenReviewCacheTTL, "How long the TokenReview result of a valid token is cached.")
+	flags.DurationVar(&o.tokenReviewNegativeTTL, "token-review-cache-negative-ttl", o.tokenReviewNegativeTTL, "How long the TokenReview result of an invalid token is cached.")
 	flags.StringVar(&o.authenticationAudience, "authentication-audience", o.authenticationAudience, "Expected agent's token authentication audience (used with agent-namespace, agent-service-account, kubeconfig).")
+	flags.DurationVar(&o.agentTokenRefreshDeadline, "agent-token-refresh-deadline", o.agentTokenRefreshDeadline, "If non-zero, agents authenticated with a service account token must send a new token at least this often (see the agent's token-refresh-interval). Agents whose new token is not valid, or that miss the deadline, are disconnected.")
+	flags.DurationVar(&o.minTokenRefreshInterval, "agent-token-min-refresh-interval", o.minTokenRefreshInterval, "The new tokens an agent sends sooner than this after the previous one are dropped, without validating them.")
+	flags.StringSliceVar(&o.agentServiceAccounts, "agent-service-accounts", o.agentServiceAccounts, "Further service accounts, as namespace:name, the agents may authenticate as (used with authentication-audience, kubeconfig).")
+	flags.StringVar(&o.agentTokenFile, "agent-token-file", o.agentTokenFile, "If non-empty, a file of token,user lines; agents may authenticate with one of the tokens instead of a service account token.")
+	flags.StringSliceVar(&o.agentCertCommonNames, "agent-cert-common-names", o.agentCertCommonNames, "If non-empty, agents may authenticate with a client certificate signed by cluster-ca-cert whose common name matches one of these patterns (as of Go's path.Match), instead of a token.")
+	flags.StringVar(&o.agentIDSource, "agent-id-source", o.agentIDSource, "If non-empty, the credential of the agents their agent ID must match: the common name (cert-cn) or a subject alternative name (cert-san) of the agent client certificate, or the pod (pod-name) or node (node-name) the agent service account token is bound to. Agents claiming another ID are rejected.")
+	flags.StringVar(&o.auditLogPath, "audit-log-path", o.auditLogPath, "If non-empty, write a JSON line for every connection lifecycle event and admin action to this file. '-' means standard out.")
+	flags.UintVar(&o.auditLogMaxSize, "audit-log-maxsize", o.auditLogMaxSize, "The maximum size in megabytes of the audit log file before it gets rotated. 0 disables rotation.")
+	flags.UintVar(&o.auditLogMaxBackup, "audit-log-maxbackup", o.auditLogMaxBackup, "The maximum number of rotated audit log files to retain.")
+	flags.IntVar(&o.auditLogBufferSize, "audit-log-buffer-size", o.auditLogBufferSize, "The number of audit events buffered while the audit log is written in the background. Events are dropped while the buffer is full. 0 writes the events synchronously, holding the connections meanwhile.")
+	flags.Float32Var(&o.frontendDialQPS, "frontend-dial-qps", o.frontendDialQPS, "The number of dial requests per second allowed for each frontend identity. 0 disables the limit.")
+	flags.IntVar(&o.frontendDialBurst, "frontend-dial-burst", o.frontendDialBurst, "The burst of dial requests allowed for each frontend identity (used with frontend-dial-qps).")
+	flags.Float32Var(&o.agentDialQPS, "agent-dial-qps", o.agentDialQPS, "The number of dial requests per second forwarded to each agent. 0 disables the limit.")
+	flags.IntVar(&o.agentDialBurst, "agent-dial-burst", o.agentDialBurst, "The burst of dial requests forwarded to each agent (used with agent-dial-qps).")
+	flags.IntVar(&o.maxPendingDials, "max-pending-dials", o.maxPendingDials, "The maximum number of dial requests waiting for a response from an agent. 0 disables the limit.")
+	flags.DurationVar(&o.idleTimeout, "idle-timeout", o.idleTimeout, "Close tunneled connections that have not sent data in either direction for this long. 0 disables it.")
+	flags.DurationVar(&o.maxConnectionLifetime, "max-connection-lifetime", o.maxConnectionLifetime, "Close tunneled connections older than this. 0 disables it.")
+	flags.DurationVar(&o.dialTimeout, "dial-timeout", o.dialTimeout, "How long http-connect and socks5 frontends wait for the agent to dial the destination before failing the request. 0 means no timeout.")
+	flags.DurationVar(&o.drainTimeout, "drain-timeout", o.drainTimeout, "How long to wait on shutdown for the established connections to finish before closing them. New dials are rejected and agents are asked to connect to another proxy server meanwhile.")
+	flags.StringVar(&o.socks5CredentialsFile, "socks5-credentials-file", o.socks5CredentialsFile, "If non-empty, a file of username:password lines; SOCKS5 clients must authenticate with one of them, and the username identifies the frontend. Only used in socks5 mode.")
+	flags.DurationVar(&o.socks5HandshakeTimeout, "socks5-handshake-timeout", o.socks5HandshakeTimeout, "How long SOCKS5 clients may take to negotiate, authenticate and send their CONNECT request before they are disconnected. 0 means no timeout. Only used in socks5 mode.")
+	flags.StringVar(&o.proxyAuthTokenFile, "proxy-auth-token-file", o.proxyAuthTokenFile, "If non-empty, a file of token,user lines; http-connect and grpc clients may authenticate with one of the tokens as a Proxy-Authorization, respectively authorization metadata, bearer token. Only used in http-connect and grpc modes.")
+	flags.StringVar(&o.proxyAuthHtpasswdFile, "proxy-auth-htpasswd-file", o.proxyAuthHtpasswdFile, "If non-empty, an htpasswd file of bcrypt or SHA1 hashed passwords; http-connect and grpc clients may authenticate with Proxy-Authorization, respectively authorization metadata, basic credentials. Only used in http-connect and grpc modes.")
+	flags.BoolVar(&o.proxyAuthTokenReview, "proxy-auth-token-review", o.proxyAuthTokenReview, "If true, http-connect and grpc clients may authenticate with a Proxy-Authorization, respectively authorization metadata, bearer token validated with the Kubernetes TokenReview API (used with kubeconfig). Only used in http-connect and grpc modes.")
+	flags.StringSliceVar(&o.proxyAuthAudiences, "proxy-auth-audiences", o.proxyAuthAudiences, "Audiences of the bearer tokens validated with the TokenReview API (used with proxy-auth-token-review).")
+	flags.BoolVar(&o.httpForwardProxy, "http-forward-proxy", o.httpForwardProxy, "If true, plain HTTP requests with an absolute URI (e.g. GET http://host:port/path) are forwarded to their destination through an agent, in addition to CONNECT. Only used in http-connect mode.")
+	flags.StringVar(&o.configFile, "config", o.configFile, "If non-empty, a YAML configuration file of kind ProxyServerConfiguration setting the options, named as the flags. Flags given on the command line override it. On SIGHUP the file is reloaded and the changes of the log verbosity, the dial rate limits and the proxy authentication files are applied.")
 	return flags
 }
 
@@ -155,6 +267,8 @@ func (o *ProxyRunOptions) Print() {
 	klog.V(1).Infof("Mode set to %q.\n", o.mode)
 	klog.V(1).Infof("UDSName set to %q.\n", o.udsName)
 	klog.V(1).Infof("DeleteUDSFile set to %v.\n", o.deleteUDSFile)
+	klog.V(1).Infof("UDSAllowedUIDs set to %v.\n", o.udsAllowedUIDs)
+	klog.V(1).Infof("UDSAllowedGIDs set to %v.\n", o.udsAllowedGIDs)
 	klog.V(1).Infof("Server port set to %d.\n", o.serverPort)
 	klog.V(1).Infof("Agent port set to %d.\n", o.agentPort)
 	klog.V(1).Infof("Admin port set to %d.\n", o.adminPort)
@@ -164,10 +278,42 @@ func (o *ProxyRunOptions) Print() {
 	klog.V(1).Infof("EnableContentionProfiling set to %v.\n", o.enableContentionProfiling)
 	klog.V(1).Infof("ServerID set to %s.\n", o.serverID)
 	klog.V(1).Infof("ServerCount set to %d.\n", o.serverCount)
+	klog.V(1).Infof("ServerLeaseNamespace set to %q.\n", o.serverLeaseNamespace)
+	klog.V(1).Infof("ServerLeaseDuration set to %v.\n", o.serverLeaseDuration)
 	klog.V(1).Infof("AgentNamespace set to %q.\n", o.agentNamespace)
 	klog.V(1).Infof("AgentServiceAccount set to %q.\n", o.agentServiceAccount)
+	klog.V(1).Infof("AgentServiceAccounts set to %q.\n", o.agentServiceAccounts)
+	klog.V(1).Infof("AgentTokenFile set to %q.\n", o.agentTokenFile)
+	klog.V(1).Infof("AgentCertCommonNames set to %q.\n", o.agentCertCommonNames)
 	klog.V(1).Infof("AuthenticationAudience set to %q.\n", o.authenticationAudience)
+	klog.V(1).Infof("AgentTokenRefreshDeadline set to %v.\n", o.agentTokenRefreshDeadline)
+	klog.V(1).Infof("MinTokenRefreshInterval set to %v.\n", o.minTokenRefreshInterval)
+	klog.V(1).Infof("AgentIDSource set to %q.\n", o.agentIDSource)
 	klog.V(1).Infof("KubeconfigPath set to %q.\n", o.kubeconfigPath)
+	klog.V(1).Infof("TokenReviewCacheSize set to %d.\n", o.tokenReviewCacheSize)
+	klog.V(1).Infof("TokenReviewCacheTTL set to %v.\n", o.tokenReviewCacheTTL)
+	klog.V(1).Infof("TokenReviewNegativeTTL set to %v.\n", o.tokenReviewNegativeTTL)
+	klog.V(1).Infof("AuditLogPath set to %q.\n", o.auditLogPath)
+	klog.V(1).Infof("AuditLogMaxSize set to %d.\n", o.auditLogMaxSize)
+	klog.V(1).Infof("AuditLogMaxBackup set to %d.\n", o.auditLogMaxBackup)
+	klog.V(1).Infof("AuditLogBufferSize set to %d.\n", o.auditLogBufferSize)
+	klog.V(1).Infof("FrontendDialQPS set to %v.\n", o.frontendDialQPS)
+	klog.V(1).Infof("FrontendDialBurst set to %d.\n", o.frontendDialBurst)
+	klog.V(1).Infof("AgentDialQPS set to %v.\n", o.agentDialQPS)
+	klog.V(1).Infof("AgentDialBurst set to %d.\n", o.agentDialBurst)
+	klog.V(1).Infof("MaxPendingDials set to %d.\n", o.maxPendingDials)
+	klog.V(1).Infof("IdleTimeout set to %v.\n", o.idleTimeout)
+	klog.V(1).Infof("MaxConnectionLifetime set to %v.\n", o.maxConnectionLifetime)
+	klog.V(1).Infof("SOCKS5CredentialsFile set to %q.\n", o.socks5CredentialsFile)
+	klog.V(1).Infof("SOCKS5HandshakeTimeout set to %v.\n", o.socks5HandshakeTimeout)
+	klog.V(1).Infof("DialTimeout set to %v.\n", o.dialTimeout)
+	klog.V(1).Infof("ProxyAuthTokenFile set to %q.\n", o.proxyAuthTokenFile)
+	klog.V(1).Infof("ProxyAuthHtpasswdFile set to %q.\n", o.proxyAuthHtpasswdFile)
+	klog.V(1).Infof("ProxyAuthTokenReview set to %v.\n", o.proxyAuthTokenReview)
+	klog.V(1).Infof("ProxyAuthAudiences set to %q.\n", o.proxyAuthAudiences)
+	klog.V(1).Infof("HTTPForwardProxy set to %v.\n", o.httpForwardProxy)
+	klog.V(1).Infof("DrainTimeout set to %v.\n", o.drainTimeout)
+	klog.V(1).Infof("ConfigFile set to %q.\n", o.configFile)
 }
 
 func (o *ProxyRunOptions) Validate() error {
@@ -213,8 +359,41 @@ func (o *ProxyRunOptions) Validate() error {
 			return fmt.Errorf("error checking cluster CA cert %s, got %v", o.clusterCaCert, err)
 		}
 	}
-	if o.mode != "grpc" && o.mode != "http-connect" {
-		return fmt.Errorf("mode must be set to either 'grpc' or 'http-connect' not %q", o.mode)
+	if o.mode != "grpc" && o.mode != "http-connect" && o.mode != "socks5" {
+		return fmt.Errorf("mode must be set to either 'grpc', 'http-connect' or 'socks5' not %q", o.mode)
+	}
+	if o.serverLeaseNamespace != "" {
+		if errs := validation.IsDNS1123Subdomain(server.ServerLeaseName(o.serverID)); len(errs) > 0 {
+			return fmt.Errorf("server ID %q cannot name a server lease: %s", o.serverID, strings.Join(errs, ", "))
+		}
+		if o.serverLeaseDuration < time.Second {
+			return fmt.Errorf("server lease duration %v must be at least 1s", o.serverLeaseDuration)
+		}
+	}
+	if o.socks5CredentialsFile != "" {
+		if o.mode != "socks5" {
+			return fmt.Errorf("socks5 credentials file should only be set in socks5 mode")
+		}
+		if _, err := server.LoadSOCKS5Credentials(o.socks5CredentialsFile); err != nil {
+			return fmt.Errorf("error loading socks5 credentials file %s, got %v", o.socks5CredentialsFile, err)
+		}
+	}
+	if o.socks5HandshakeTimeout < 0 {
+		return fmt.Errorf("socks5 handshake timeout %v must not be negative", o.socks5HandshakeTimeout)
+	}
+	if o.proxyAuthTokenFile != "" || o.proxyAuthHtpasswdFile != "" || o.proxyAuthTokenReview {
+		if o.mode != "http-connect" && o.mode != "grpc" {
+			return fmt.Errorf("proxy authentication should only be set in http-connect or grpc mode")
+		}
+		if _, err := newProxyAuthenticator(o, nil, nil); err != nil {
+			return err
+		}
+	}
+	if o.httpForwardProxy && o.mode != "http-connect" {
+		return fmt.Errorf("http forward proxy should only be set in http-connect mode")
+	}
+	if len(o.proxyAuthAudiences) > 0 && !o.proxyAuthTokenReview {
+		return fmt.Errorf("proxy auth audiences should only be set with proxy-auth-token-review")
 	}
 	if o.udsName != "" {
 		if o.serverPort != 0 {
@@ -230,6 +409,14 @@ func (o *ProxyRunOptions) Validate() error {
 			return fmt.Errorf("server ca cert should not be set for UDS")
 		}
 	}
+	if len(o.udsAllowedUIDs) > 0 || len(o.udsAllowedGIDs) > 0 {
+		if o.udsName == "" {
+			return fmt.Errorf("UDS allowed UIDs and GIDs should only be set for UDS")
+		}
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("UDS allowed UIDs and GIDs are only supported on linux")
+		}
+	}
 	if o.serverPort > 49151 {
 		return fmt.Errorf("please do not try to use ephemeral port %d for the server port", o.serverPort)
 	}
@@ -260,18 +447,51 @@ func (o *ProxyRunOptions) Validate() error {
 	if o.enableContentionProfiling && !o.enableProfiling {
 		return fmt.Errorf("if --enable-contention-profiling is set, --enable-profiling must also be set")
 	}
+	if o.frontendDialQPS < 0 {
+		return fmt.Errorf("frontend dial qps %v must not be negative", o.frontendDialQPS)
+	}
+	if o.frontendDialQPS > 0 && o.frontendDialBurst <= 0 {
+		return fmt.Errorf("frontend dial burst %d must be greater than 0 when frontend dial qps is set", o.frontendDialBurst)
+	}
+	if o.agentDialQPS < 0 {
+		return fmt.Errorf("agent dial qps %v must not be negative", o.agentDialQPS)
+	}
+	if o.agentDialQPS > 0 && o.agentDialBurst <= 0 {
+		return fmt.Errorf("agent dial burst %d must be greater than 0 when agent dial qps is set", o.agentDialBurst)
+	}
+	if o.maxPendingDials < 0 {
+		return fmt.Errorf("max pending dials %d must not be negative", o.maxPendingDials)
+	}
+	if o.idleTimeout < 0 {
+		return fmt.Errorf("idle timeout %v must not be negative", o.idleTimeout)
+	}
+	if o.maxConnectionLifetime < 0 {
+		return fmt.Errorf("max connection lifetime %v must not be negative", o.maxConnectionLifetime)
+	}
+	if o.dialTimeout < 0 {
+		return fmt.Errorf("dial timeout %v must not be negative", o.dialTimeout)
+	}
+	if o.drainTimeout < 0 {
+		return fmt.Errorf("drain timeout %v must not be negative", o.drainTimeout)
+	}
 
 	// validate agent authentication params
-	// all 4 parametes must be empty or must have value (except kubeconfigPath that might be empty)
-	if o.agentNamespace != "" || o.agentServiceAccount != "" || o.authenticationAudience != "" || o.kubeconfigPath != "" {
-		if o.clusterCaCert != "" {
-			return fmt.Errorf("clusterCaCert can not be used when service account authentication is enabled")
-		}
-		if o.agentNamespace == "" {
-			return fmt.Errorf("agentNamespace cannot be empty when agent authentication is enabled")
+	// all 4 parametes must be empty or must have value (except kubeconfigPath that might be empty),
+	// agentServiceAccounts may replace agentNamespace and agentServiceAccount
+	// kubeconfigPath alone is also allowed for the TokenReview proxy authentication
+	if o.agentTokenReviewEnabled() || o.agentServiceAccount != "" || o.authenticationAudience != "" || (o.kubeconfigPath != "" && !o.proxyAuthTokenReview && o.serverLeaseNamespace == "") {
+		if o.agentNamespace != "" || o.agentServiceAccount != "" || len(o.agentServiceAccounts) == 0 {
+			if o.agentNamespace == "" {
+				return fmt.Errorf("agentNamespace cannot be empty when agent authentication is enabled")
+			}
+			if o.agentServiceAccount == "" {
+				return fmt.Errorf("agentServiceAccount cannot be empty when agent authentication is enabled")
+			}
 		}
-		if o.agentServiceAccount == "" {
-			return fmt.Errorf("agentServiceAccount cannot be empty when agent authentication is enabled")
+		for _, sa := range o.agentServiceAccounts {
+			if _, err := server.ParseServiceAccount(sa); err != nil {
+				return err
+			}
 		}
 		if o.authenticationAudience == "" {
 			return fmt.Errorf("authenticationAudience cannot be empty when agent authentication is enabled")
@@ -282,10 +502,62 @@ func (o *ProxyRunOptions) Validate() error {
 			}
 		}
 	}
+	if o.auditLogBufferSize < 0 {
+		return fmt.Errorf("audit log buffer size %d must be non-negative", o.auditLogBufferSize)
+	}
+	if o.tokenReviewCacheSize < 0 {
+		return fmt.Errorf("token review cache size %d must be non-negative", o.tokenReviewCacheSize)
+	}
+	if o.tokenReviewCacheTTL < 0 || o.tokenReviewNegativeTTL < 0 {
+		return fmt.Errorf("token review cache TTLs must be non-negative")
+	}
+	if o.agentTokenRefreshDeadline < 0 {
+		return fmt.Errorf("agent token refresh deadline %v must be non-negative", o.agentTokenRefreshDeadline)
+	}
+	if o.minTokenRefreshInterval < 0 {
+		return fmt.Errorf("agent token min refresh interval %v must be non-negative", o.minTokenRefreshInterval)
+	}
+	if o.agentTokenRefreshDeadline > 0 && !o.agentTokenReviewEnabled() && o.agentTokenFile == "" {
+		return fmt.Errorf("agent token refresh deadline requires agent token authentication to be enabled")
+	}
+	if o.agentTokenFile != "" {
+		if _, err := server.NewTokenFileAgentAuthenticator(o.agentTokenFile); err != nil {
+			return fmt.Errorf("error loading agent token file %s, got %v", o.agentTokenFile, err)
+		}
+	}
+	if len(o.agentCertCommonNames) > 0 {
+		if o.clusterCaCert == "" {
+			return fmt.Errorf("agent certificate common names require clusterCaCert to be set")
+		}
+		for _, pattern := range o.agentCertCommonNames {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid agent certificate common name pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	switch server.AgentIDSource(o.agentIDSource) {
+	case server.AgentIDFromAny:
+	case server.AgentIDFromCertCN, server.AgentIDFromCertSAN:
+		if o.clusterCaCert == "" {
+			return fmt.Errorf("agent ID source %q requires clusterCaCert to be set", o.agentIDSource)
+		}
+	case server.AgentIDFromPodName, server.AgentIDFromNodeName:
+		if !o.agentTokenReviewEnabled() {
+			return fmt.Errorf("agent ID source %q requires service account authentication to be enabled", o.agentIDSource)
+		}
+	default:
+		return fmt.Errorf("unknown agent ID source %q, must be one of cert-cn, cert-san, pod-name or node-name", o.agentIDSource)
+	}
 
 	return nil
 }
 
+// agentTokenReviewEnabled reports if agents authenticate with service
+// account tokens.
+func (o *ProxyRunOptions) agentTokenReviewEnabled() bool {
+	return o.agentNamespace != "" || len(o.agentServiceAccounts) > 0
+}
+
 func newProxyRunOptions() *ProxyRunOptions {
 	o := ProxyRunOptions{
 		serverCert:                "",
@@ -297,6 +569,8 @@ func newProxyRunOptions() *ProxyRunOptions {
 		mode:                      "grpc",
 		udsName:                   "",
 		deleteUDSFile:             false,
+		udsAllowedUIDs:            nil,
+		udsAllowedGIDs:            nil,
 		serverPort:                8090,
 		agentPort:                 8091,
 		healthPort:                8092,
@@ -306,10 +580,42 @@ func newProxyRunOptions() *ProxyRunOptions {
 		enableContentionProfiling: false,
 		serverID:                  uuid.New().String(),
 		serverCount:               1,
+		serverLeaseNamespace:      "",
+		serverLeaseDuration:       30 * time.Second,
 		agentNamespace:            "",
 		agentServiceAccount:       "",
+		agentServiceAccounts:      nil,
+		agentTokenFile:            "",
+		agentCertCommonNames:      nil,
 		kubeconfigPath:            "",
+		tokenReviewCacheSize:      10000,
+		tokenReviewCacheTTL:       time.Minute,
+		tokenReviewNegativeTTL:    10 * time.Second,
 		authenticationAudience:    "",
+		agentTokenRefreshDeadline: 0,
+		minTokenRefreshInterval:   10 * time.Second,
+		agentIDSource:             "",
+		auditLogPath:              "",
+		auditLogMaxSize:           100,
+		auditLogMaxBackup:         5,
+		auditLogBufferSize:        10000,
+		frontendDialQPS:           0,
+		frontendDialBurst:         10,
+		agentDialQPS:              0,
+		agentDialBurst:            10,
+		maxPendingDials:           0,
+		idleTimeout:               0,
+		maxConnectionLifetime:     0,
+		socks5CredentialsFile:     "",
+		socks5HandshakeTimeout:    10 * time.Second,
+		dialTimeout:               30 * time.Second,
+		proxyAuthTokenFile:        "",
+		proxyAuthHtpasswdFile:     "",
+		proxyAuthTokenReview:      false,
+		proxyAuthAudiences:        nil,
+		httpForwardProxy:          false,
+		drainTimeout:              30 * time.Second,
+		configFile:                "",
 	}
 	return &o
 }
@@ -319,6 +625,12 @@ func newProxyCommand(p *Proxy, o *ProxyRunOptions) *cobra.Command {
 		Use:  "proxy",
 		Long: `A gRPC proxy server, receives requests from the API server and forwards to the agent.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if o.configFile != "" {
+				p.config = util.NewConfigFile(o.configFile, serverConfigKind, cmd.Flags())
+				if err := p.config.Load(); err != nil {
+					return err
+				}
+			}
 			return p.run(o)
 		},
 	}
@@ -326,7 +638,26 @@ func newProxyCommand(p *Proxy, o *ProxyRunOptions) *cobra.Command {
 	return cmd
 }
 
+// serverConfigKind is the kind of the configuration file of the proxy server.
+const serverConfigKind = "ProxyServerConfiguration"
+
 type Proxy struct {
+	// tunnelAuthenticator authenticates the http-connect clients, nil when
+	// proxy authentication is disabled.
+	tunnelAuthenticator *server.ReloadableProxyAuthenticator
+	// config is the configuration file, nil if none is used.
+	config *util.ConfigFile
+	// tokenReviewCache caches the TokenReviews of the agent and proxy
+	// authentication, nil if disabled.
+	tokenReviewCache *server.TokenReviewCache
+}
+
+// proxyAuthenticator returns the authenticator of the http-connect clients.
+func (p *Proxy) proxyAuthenticator() server.ProxyAuthenticator {
+	if p.tunnelAuthenticator == nil {
+		return nil
+	}
+	return p.tunnelAuthenticator
 }
 
 type StopFunc func()
@@ -340,7 +671,7 @@ func (p *Proxy) run(o *ProxyRunOptions) error {
 	defer cancel()
 
 	var k8sClient *kubernetes.Clientset
-	if o.agentNamespace != "" {
+	if o.agentTokenReviewEnabled() || o.proxyAuthTokenReview || o.serverLeaseNamespace != "" {
 		config, err := clientcmd.BuildConfigFromFlags("", o.kubeconfigPath)
 		if err != nil {
 			return fmt.Errorf("failed to load kubernetes client config: %v", err)
@@ -350,6 +681,23 @@ func (p *Proxy) run(o *ProxyRunOptions) error {
 		if err != nil {
 			return fmt.Errorf("failed to create kubernetes clientset: %v", err)
 		}
+		if o.tokenReviewCacheSize > 0 {
+			p.tokenReviewCache = server.NewTokenReviewCache(k8sClient, server.TokenReviewCacheOptions{
+				MaxSize:     o.tokenReviewCacheSize,
+				TTL:         o.tokenReviewCacheTTL,
+				NegativeTTL: o.tokenReviewNegativeTTL,
+			})
+		}
+	}
+
+	if o.mode == "http-connect" || o.mode == "grpc" {
+		authenticator, err := newProxyAuthenticator(o, k8sClient, p.tokenReviewCache)
+		if err != nil {
+			return err
+		}
+		if authenticator != nil {
+			p.tunnelAuthenticator = server.NewReloadableProxyAuthenticator(authenticator)
+		}
 	}
 
 	authOpt := &server.AgentTokenAuthenticationOptions{
@@ -358,8 +706,46 @@ func (p *Proxy) run(o *ProxyRunOptions) error {
 		AgentServiceAccount:    o.agentServiceAccount,
 		KubernetesClient:       k8sClient,
 		AuthenticationAudience: o.authenticationAudience,
+		RefreshDeadline:        o.agentTokenRefreshDeadline,
+		MinRefreshInterval:     o.minTokenRefreshInterval,
+		TokenReviewCache:       p.tokenReviewCache,
+	}
+	agentAuthenticator, err := newAgentAuthenticator(o, k8sClient, p.tokenReviewCache)
+	if err != nil {
+		return err
+	}
+	agentIDSource := server.AgentIDSource(o.agentIDSource)
+	var serverLease *server.ServerLease
+	leaseStop, leaseDone := make(chan struct{}), make(chan struct{})
+	if o.serverLeaseNamespace != "" {
+		serverLease = server.NewServerLease(k8sClient, o.serverLeaseNamespace, o.serverID, o.serverLeaseDuration)
+		go func() {
+			serverLease.Run(leaseStop)
+			close(leaseDone)
+		}()
 	}
 	server := server.NewProxyServer(o.serverID, int(o.serverCount), authOpt)
+	if o.auditLogPath != "" {
+		sink, err := newAuditSink(o)
+		if err != nil {
+			return fmt.Errorf("failed to create the audit log: %v", err)
+		}
+		defer sink.Close()
+		server.AuditSink = sink
+	}
+	// The limits can be enabled by reloading the config file.
+	if o.frontendDialQPS > 0 || o.agentDialQPS > 0 || o.maxPendingDials > 0 || p.config != nil {
+		server.DialLimiter = newDialLimiter(o)
+	}
+	server.IdleTimeout = o.idleTimeout
+	server.MaxConnectionLifetime = o.maxConnectionLifetime
+	server.DialTimeout = o.dialTimeout
+	server.AgentAuthenticator = agentAuthenticator
+	server.AgentIDSource = agentIDSource
+	if serverLease != nil {
+		server.ServerCounter = serverLease
+	}
+	go server.RunConnectionReaper(ctx.Done())
 	klog.V(1).Infoln("Starting master server for client connections.")
 	masterStop, err := p.runMasterServer(ctx, o, server)
 	if err != nil {
@@ -367,7 +753,7 @@ func (p *Proxy) run(o *ProxyRunOptions) error {
 	}
 
 	klog.V(1).Infoln("Starting agent server for tunnel connections.")
-	err = p.runAgentServer(o, server)
+	agentStop, err := p.runAgentServer(o, server)
 	if err != nil {
 		return fmt.Errorf("failed to run the agent server: %v", err)
 	}
@@ -382,10 +768,31 @@ func (p *Proxy) run(o *ProxyRunOptions) error {
 		return fmt.Errorf("failed to run the health server: %v", err)
 	}
 
+	if p.config != nil {
+		go p.reloadOnSignal(o, server, k8sClient)
+	}
+
 	stopCh := SetupSignalHandler()
 	<-stopCh
 	klog.V(1).Infoln("Shutting down server.")
+	// Report as not ready before releasing the lease, so that no traffic
+	// is routed here while the lease is released.
+	server.StartDrain()
+	if serverLease != nil {
+		// Stop renewing first, so that the lease is not created again.
+		close(leaseStop)
+		<-leaseDone
+		if err := serverLease.Release(); err != nil {
+			klog.ErrorS(err, "Failed to release the server lease")
+		}
+	}
 
+	drainCtx, drainCancel := context.WithTimeout(ctx, o.drainTimeout)
+	if err := server.Drain(drainCtx); err != nil {
+		klog.ErrorS(err, "Connections were closed before they finished")
+	}
+	drainCancel()
+	agentStop()
 	if masterStop != nil {
 		masterStop()
 	}
@@ -393,6 +800,79 @@ func (p *Proxy) run(o *ProxyRunOptions) error {
 	return nil
 }
 
+func newAuditSink(o *ProxyRunOptions) (server.AuditSink, error) {
+	sink, err := server.NewFileAuditSink(o.auditLogPath, int64(o.auditLogMaxSize)<<20, int(o.auditLogMaxBackup))
+	if err != nil {
+		return nil, err
+	}
+	if o.auditLogBufferSize == 0 {
+		return sink, nil
+	}
+	return server.NewAsyncAuditSink(sink, o.auditLogBufferSize), nil
+}
+
+func newDialLimiter(o *ProxyRunOptions) *server.DialLimiter {
+	return server.NewDialLimiter(dialLimiterOptions(o))
+}
+
+func dialLimiterOptions(o *ProxyRunOptions) server.DialLimiterOptions {
+	return server.DialLimiterOptions{
+		FrontendQPS:     o.frontendDialQPS,
+		FrontendBurst:   o.frontendDialBurst,
+		AgentQPS:        o.agentDialQPS,
+		AgentBurst:      o.agentDialBurst,
+		MaxPendingDials: o.maxPendingDials,
+	}
+}
+
+// reloadableOptions returns the options of the config file applied on
+// reload.
+func (p *Proxy) reloadableOptions() map[string]bool {
+	options := map[string]bool{
+		"v":                   true,
+		"frontend-dial-qps":   true,
+		"frontend-dial-burst": true,
+		"agent-dial-qps":      true,
+		"agent-dial-burst":    true,
+		"max-pending-dials":   true,
+	}
+	// Proxy authentication cannot be turned on without a restart.
+	if p.tunnelAuthenticator != nil {
+		options["proxy-auth-token-file"] = true
+		options["proxy-auth-htpasswd-file"] = true
+	}
+	return options
+}
+
+// reloadOnSignal reloads the config file on SIGHUP. The credential files of
+// the proxy authentication are read again even if the config file did not
+// change.
+func (p *Proxy) reloadOnSignal(o *ProxyRunOptions, s *server.ProxyServer, k8sClient kubernetes.Interface) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		changed, err := p.config.Reload(p.reloadableOptions(), o.Validate)
+		if err != nil {
+			klog.ErrorS(err, "Failed to reload config file", "path", o.configFile)
+			continue
+		}
+		klog.V(1).InfoS("Reloaded config file", "path", o.configFile, "changed", changed)
+		s.DialLimiter.SetOptions(dialLimiterOptions(o))
+		if p.tunnelAuthenticator != nil {
+			authenticator, err := newProxyAuthenticator(o, k8sClient, p.tokenReviewCache)
+			if err != nil {
+				klog.ErrorS(err, "Failed to reload proxy authentication")
+				continue
+			}
+			if authenticator == nil {
+				klog.InfoS("Proxy authentication cannot be turned off without a restart")
+				continue
+			}
+			p.tunnelAuthenticator.Set(authenticator)
+		}
+	}
+}
+
 var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
 
 func SetupSignalHandler() (stopCh <-chan struct{}) {
@@ -422,6 +902,26 @@ func getUDSListener(ctx context.Context, udsName string) (net.Listener, error) {
 	return lis, nil
 }
 
+// getFrontendUDSListener returns the UDS listener of the frontends,
+// restricted to the allowed UIDs and GIDs.
+func getFrontendUDSListener(ctx context.Context, o *ProxyRunOptions) (net.Listener, error) {
+	lis, err := getUDSListener(ctx, o.udsName)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.udsAllowedUIDs) == 0 && len(o.udsAllowedGIDs) == 0 {
+		return lis, nil
+	}
+	peerCredListener := &server.PeerCredListener{Listener: lis}
+	for _, uid := range o.udsAllowedUIDs {
+		peerCredListener.AllowedUIDs = append(peerCredListener.AllowedUIDs, uint32(uid))
+	}
+	for _, gid := range o.udsAllowedGIDs {
+		peerCredListener.AllowedGIDs = append(peerCredListener.AllowedGIDs, uint32(gid))
+	}
+	return peerCredListener, nil
+}
+
 func (p *Proxy) runMasterServer(ctx context.Context, o *ProxyRunOptions, server *server.ProxyServer) (StopFunc, error) {
 	if o.udsName != "" {
 		return p.runUDSMasterServer(ctx, o, server)
@@ -437,24 +937,37 @@ func (p *Proxy) runUDSMasterServer(ctx context.Context, o *ProxyRunOptions, s *s
 	}
 	var stop StopFunc
 	if o.mode == "grpc" {
-		grpcServer := grpc.NewServer()
+		grpcServer := grpc.NewServer(grpc.StreamInterceptor(server.FrontendAuthInterceptor(p.proxyAuthenticator())))
 		client.RegisterProxyServiceServer(grpcServer, s)
-		lis, err := getUDSListener(ctx, o.udsName)
+		lis, err := getFrontendUDSListener(ctx, o)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get uds listener: %v", err)
 		}
 		go grpcServer.Serve(lis)
 		stop = grpcServer.GracefulStop
+	} else if o.mode == "socks5" {
+		socks, err := newSOCKS5(o, s)
+		if err != nil {
+			return nil, err
+		}
+		lis, err := getFrontendUDSListener(ctx, o)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get uds listener: %v", err)
+		}
+		go socks.Serve(lis)
+		stop = func() { lis.Close() }
 	} else {
 		// http-connect
 		server := &http.Server{
 			Handler: &server.Tunnel{
-				Server: s,
+				Server:        s,
+				Authenticator: p.proxyAuthenticator(),
+				ForwardProxy:  o.httpForwardProxy,
 			},
 		}
 		stop = func() { server.Shutdown(ctx) }
 		go func() {
-			udsListener, err := getUDSListener(ctx, o.udsName)
+			udsListener, err := getFrontendUDSListener(ctx, o)
 			if err != nil {
 				klog.ErrorS(err, "failed to get uds listener")
 			}
@@ -471,32 +984,96 @@ func (p *Proxy) runUDSMasterServer(ctx context.Context, o *ProxyRunOptions, s *s
 	return stop, nil
 }
 
-func (p *Proxy) getTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load X509 key pair %s and %s: %v", certFile, keyFile, err)
+// newProxyAuthenticator creates the authenticator of the http-connect clients
+// from the proxy auth options. It returns nil if proxy authentication is
+// disabled.
+func newProxyAuthenticator(o *ProxyRunOptions, k8sClient kubernetes.Interface, cache *server.TokenReviewCache) (server.ProxyAuthenticator, error) {
+	var authenticators server.UnionProxyAuthenticator
+	if o.proxyAuthTokenFile != "" {
+		a, err := server.NewTokenFileProxyAuthenticator(o.proxyAuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading proxy auth token file %s, got %v", o.proxyAuthTokenFile, err)
+		}
+		authenticators = append(authenticators, a)
 	}
-
-	if caFile == "" {
-		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	if o.proxyAuthHtpasswdFile != "" {
+		a, err := server.NewHtpasswdProxyAuthenticator(o.proxyAuthHtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading proxy auth htpasswd file %s, got %v", o.proxyAuthHtpasswdFile, err)
+		}
+		authenticators = append(authenticators, a)
 	}
+	if o.proxyAuthTokenReview {
+		authenticators = append(authenticators, &server.TokenReviewProxyAuthenticator{
+			KubernetesClient: k8sClient,
+			Audiences:        o.proxyAuthAudiences,
+			Cache:            cache,
+		})
+	}
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	return authenticators, nil
+}
 
-	certPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile(caFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read cluster CA cert %s: %v", caFile, err)
+// newAgentAuthenticator returns the authenticator of the agents, nil if the
+// agents are not authenticated beyond the TLS client certificate.
+func newAgentAuthenticator(o *ProxyRunOptions, k8sClient kubernetes.Interface, cache *server.TokenReviewCache) (server.AgentAuthenticator, error) {
+	var authenticators server.UnionAgentAuthenticator
+	if o.agentTokenReviewEnabled() {
+		var serviceAccounts []server.ServiceAccount
+		if o.agentNamespace != "" {
+			serviceAccounts = append(serviceAccounts, server.ServiceAccount{Namespace: o.agentNamespace, Name: o.agentServiceAccount})
+		}
+		for _, s := range o.agentServiceAccounts {
+			sa, err := server.ParseServiceAccount(s)
+			if err != nil {
+				return nil, err
+			}
+			serviceAccounts = append(serviceAccounts, sa)
+		}
+		authenticators = append(authenticators, &server.TokenReviewAgentAuthenticator{
+			KubernetesClient: k8sClient,
+			Audiences:        []string{o.authenticationAudience},
+			ServiceAccounts:  serviceAccounts,
+			Cache:            cache,
+		})
+	}
+	if o.agentTokenFile != "" {
+		a, err := server.NewTokenFileAgentAuthenticator(o.agentTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading agent token file %s, got %v", o.agentTokenFile, err)
+		}
+		authenticators = append(authenticators, a)
+	}
+	if len(o.agentCertCommonNames) > 0 {
+		authenticators = append(authenticators, &server.CertificateAgentAuthenticator{CommonNames: o.agentCertCommonNames})
 	}
-	ok := certPool.AppendCertsFromPEM(caCert)
-	if !ok {
-		return nil, fmt.Errorf("failed to append cluster CA cert to the cert pool")
+	if len(authenticators) == 0 {
+		return nil, nil
 	}
-	tlsConfig := &tls.Config{
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		Certificates: []tls.Certificate{cert},
-		ClientCAs:    certPool,
+	return authenticators, nil
+}
+
+// newSOCKS5 creates the SOCKS5 frontend server.
+func newSOCKS5(o *ProxyRunOptions, s *server.ProxyServer) (*server.SOCKS5, error) {
+	socks := &server.SOCKS5{Server: s, HandshakeTimeout: o.socks5HandshakeTimeout}
+	if o.socks5CredentialsFile != "" {
+		credentials, err := server.LoadSOCKS5Credentials(o.socks5CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load socks5 credentials: %v", err)
+		}
+		socks.Credentials = credentials
 	}
+	return socks, nil
+}
 
-	return tlsConfig, nil
+// getTLSConfig returns the TLS config of a server presenting the key pair
+// and, if caFile is non-empty, requiring client certs signed by its CAs. The
+// files are reloaded when they change, without affecting the established
+// connections.
+func (p *Proxy) getTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	return util.GetServerTLSConfig(caFile, certFile, keyFile, metrics.Metrics.SetCertificateExpiry)
 }
 
 func (p *Proxy) runMTLSMasterServer(ctx context.Context, o *ProxyRunOptions, s *server.ProxyServer) (StopFunc, error) {
@@ -511,8 +1088,11 @@ func (p *Proxy) runMTLSMasterServer(ctx context.Context, o *ProxyRunOptions, s *
 	addr := fmt.Sprintf(":%d", o.serverPort)
 
 	if o.mode == "grpc" {
-		serverOption := grpc.Creds(credentials.NewTLS(tlsConfig))
-		grpcServer := grpc.NewServer(serverOption)
+		serverOptions := []grpc.ServerOption{
+			grpc.Creds(credentials.NewTLS(tlsConfig)),
+			grpc.StreamInterceptor(server.FrontendAuthInterceptor(p.proxyAuthenticator())),
+		}
+		grpcServer := grpc.NewServer(serverOptions...)
 		client.RegisterProxyServiceServer(grpcServer, s)
 		lis, err := net.Listen("tcp", addr)
 		if err != nil {
@@ -520,15 +1100,32 @@ func (p *Proxy) runMTLSMasterServer(ctx context.Context, o *ProxyRunOptions, s *
 		}
 		go grpcServer.Serve(lis)
 		stop = grpcServer.GracefulStop
+	} else if o.mode == "socks5" {
+		socks, err := newSOCKS5(o, s)
+		if err != nil {
+			return nil, err
+		}
+		lis, err := tls.Listen("tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+		}
+		go socks.Serve(lis)
+		stop = func() { lis.Close() }
 	} else {
 		// http-connect
 		server := &http.Server{
 			Addr:      addr,
 			TLSConfig: tlsConfig,
 			Handler: &server.Tunnel{
-				Server: s,
+				Server:        s,
+				Authenticator: p.proxyAuthenticator(),
+				ForwardProxy:  o.httpForwardProxy,
 			},
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		}
+		// HTTP/2 clients multiplex their CONNECT streams over a single
+		// TLS connection.
+		if err := http2.ConfigureServer(server, nil); err != nil {
+			return nil, fmt.Errorf("failed to configure HTTP/2 on %s: %v", addr, err)
 		}
 		stop = func() { server.Shutdown(ctx) }
 		go func() {
@@ -542,11 +1139,11 @@ func (p *Proxy) runMTLSMasterServer(ctx context.Context, o *ProxyRunOptions, s *
 	return stop, nil
 }
 
-func (p *Proxy) runAgentServer(o *ProxyRunOptions, server *server.ProxyServer) error {
+func (p *Proxy) runAgentServer(o *ProxyRunOptions, server *server.ProxyServer) (StopFunc, error) {
 	var tlsConfig *tls.Config
 	var err error
 	if tlsConfig, err = p.getTLSConfig(o.clusterCaCert, o.clusterCert, o.clusterKey); err != nil {
-		return err
+		return nil, err
 	}
 
 	addr := fmt.Sprintf(":%d", o.agentPort)
@@ -558,11 +1155,13 @@ func (p *Proxy) runAgentServer(o *ProxyRunOptions, server *server.ProxyServer) e
 	agent.RegisterAgentServiceServer(grpcServer, server)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
 	}
 	go grpcServer.Serve(lis)
 
-	return nil
+	// The agent streams never end on their own, they are closed once the
+	// proxy server is drained.
+	return grpcServer.Stop, nil
 }
 
 // redirectTo redirects request to a certain destination.
@@ -572,9 +1171,10 @@ func redirectTo(to string) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (p *Proxy) runAdminServer(o *ProxyRunOptions, server *server.ProxyServer) error {
+func (p *Proxy) runAdminServer(o *ProxyRunOptions, s *server.ProxyServer) error {
 	muxHandler := http.NewServeMux()
 	muxHandler.Handle("/metrics", promhttp.Handler())
+	muxHandler.Handle("/api/", server.NewAdminHandler(s))
 	if o.enableProfiling {
 		muxHandler.HandleFunc("/debug/pprof", redirectTo("/debug/pprof/"))
 		muxHandler.HandleFunc("/debug/pprof/", pprof.Index)
@@ -604,14 +1204,14 @@ func (p *Proxy) runHealthServer(o *ProxyRunOptions, server *server.ProxyServer)
 		fmt.Fprintf(w, "ok")
 	})
 	readinessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ready, msg := server.Readiness.Ready()
+		ready, msg := server.Ready()
 		if ready {
 			w.WriteHeader(200)
 			fmt.Fprintf(w, "ok")
 			return
 		}
 		w.WriteHeader(500)
-		fmt.Fprintf(w, msg)
+		fmt.Fprint(w, msg)
 	})
 
 	muxHandler := http.NewServeMux()
@@ -47,6 +47,12 @@ const (
 	PacketType_CLOSE_REQ PacketType = 2
 	PacketType_CLOSE_RSP PacketType = 3
 	PacketType_DATA      PacketType = 4
+	// GOAWAY tells the peer that the sender is going away: no new
+	// connections should be routed over the stream.
+	PacketType_GOAWAY PacketType = 5
+	// AUTH_REFRESH carries a rotated authentication token of the agent,
+	// validated again by the proxy server.
+	PacketType_AUTH_REFRESH PacketType = 6
 )
 
 var PacketType_name = map[int32]string{
@@ -55,14 +61,18 @@ var PacketType_name = map[int32]string{
 	2: "CLOSE_REQ",
 	3: "CLOSE_RSP",
 	4: "DATA",
+	5: "GOAWAY",
+	6: "AUTH_REFRESH",
 }
 
 var PacketType_value = map[string]int32{
-	"DIAL_REQ":  0,
-	"DIAL_RSP":  1,
-	"CLOSE_REQ": 2,
-	"CLOSE_RSP": 3,
-	"DATA":      4,
+	"DIAL_REQ":     0,
+	"DIAL_RSP":     1,
+	"CLOSE_REQ":    2,
+	"CLOSE_RSP":    3,
+	"DATA":         4,
+	"GOAWAY":       5,
+	"AUTH_REFRESH": 6,
 }
 
 func (x PacketType) String() string {
@@ -103,6 +113,8 @@ type Packet struct {
 	//	*Packet_Data
 	//	*Packet_CloseRequest
 	//	*Packet_CloseResponse
+	//	*Packet_GoAway
+	//	*Packet_AuthRefresh
 	Payload              isPacket_Payload `protobuf_oneof:"payload"`
 	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
 	XXX_unrecognized     []byte           `json:"-"`
@@ -165,6 +177,14 @@ type Packet_CloseResponse struct {
 	CloseResponse *CloseResponse `protobuf:"bytes,6,opt,name=closeResponse,proto3,oneof"`
 }
 
+type Packet_GoAway struct {
+	GoAway *GoAway `protobuf:"bytes,7,opt,name=goAway,proto3,oneof"`
+}
+
+type Packet_AuthRefresh struct {
+	AuthRefresh *AuthRefresh `protobuf:"bytes,8,opt,name=authRefresh,proto3,oneof"`
+}
+
 func (*Packet_DialRequest) isPacket_Payload() {}
 
 func (*Packet_DialResponse) isPacket_Payload() {}
@@ -175,6 +195,10 @@ func (*Packet_CloseRequest) isPacket_Payload() {}
 
 func (*Packet_CloseResponse) isPacket_Payload() {}
 
+func (*Packet_GoAway) isPacket_Payload() {}
+
+func (*Packet_AuthRefresh) isPacket_Payload() {}
+
 func (m *Packet) GetPayload() isPacket_Payload {
 	if m != nil {
 		return m.Payload
@@ -217,6 +241,20 @@ func (m *Packet) GetCloseResponse() *CloseResponse {
 	return nil
 }
 
+func (m *Packet) GetGoAway() *GoAway {
+	if x, ok := m.GetPayload().(*Packet_GoAway); ok {
+		return x.GoAway
+	}
+	return nil
+}
+
+func (m *Packet) GetAuthRefresh() *AuthRefresh {
+	if x, ok := m.GetPayload().(*Packet_AuthRefresh); ok {
+		return x.AuthRefresh
+	}
+	return nil
+}
+
 // XXX_OneofWrappers is for the internal use of the proto package.
 func (*Packet) XXX_OneofWrappers() []interface{} {
 	return []interface{}{
@@ -225,6 +263,8 @@ func (*Packet) XXX_OneofWrappers() []interface{} {
 		(*Packet_Data)(nil),
 		(*Packet_CloseRequest)(nil),
 		(*Packet_CloseResponse)(nil),
+		(*Packet_GoAway)(nil),
+		(*Packet_AuthRefresh)(nil),
 	}
 }
 
@@ -491,6 +531,86 @@ func (m *Data) GetData() []byte {
 	return nil
 }
 
+type GoAway struct {
+	// reason the sender is going away, e.g. shutting down
+	Reason               string   `protobuf:"bytes,1,opt,name=reason,proto3" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GoAway) Reset()         { *m = GoAway{} }
+func (m *GoAway) String() string { return proto.CompactTextString(m) }
+func (*GoAway) ProtoMessage()    {}
+func (*GoAway) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{6}
+}
+
+func (m *GoAway) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GoAway.Unmarshal(m, b)
+}
+func (m *GoAway) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GoAway.Marshal(b, m, deterministic)
+}
+func (m *GoAway) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GoAway.Merge(m, src)
+}
+func (m *GoAway) XXX_Size() int {
+	return xxx_messageInfo_GoAway.Size(m)
+}
+func (m *GoAway) XXX_DiscardUnknown() {
+	xxx_messageInfo_GoAway.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GoAway proto.InternalMessageInfo
+
+func (m *GoAway) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type AuthRefresh struct {
+	// token is the current authentication token of the agent
+	Token                string   `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AuthRefresh) Reset()         { *m = AuthRefresh{} }
+func (m *AuthRefresh) String() string { return proto.CompactTextString(m) }
+func (*AuthRefresh) ProtoMessage()    {}
+func (*AuthRefresh) Descriptor() ([]byte, []int) {
+	return fileDescriptor_fec4258d9ecd175d, []int{7}
+}
+
+func (m *AuthRefresh) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AuthRefresh.Unmarshal(m, b)
+}
+func (m *AuthRefresh) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AuthRefresh.Marshal(b, m, deterministic)
+}
+func (m *AuthRefresh) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AuthRefresh.Merge(m, src)
+}
+func (m *AuthRefresh) XXX_Size() int {
+	return xxx_messageInfo_AuthRefresh.Size(m)
+}
+func (m *AuthRefresh) XXX_DiscardUnknown() {
+	xxx_messageInfo_AuthRefresh.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AuthRefresh proto.InternalMessageInfo
+
+func (m *AuthRefresh) GetToken() string {
+	if m != nil {
+		return m.Token
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("PacketType", PacketType_name, PacketType_value)
 	proto.RegisterEnum("Error", Error_name, Error_value)
@@ -500,6 +620,8 @@ func init() {
 	proto.RegisterType((*CloseRequest)(nil), "CloseRequest")
 	proto.RegisterType((*CloseResponse)(nil), "CloseResponse")
 	proto.RegisterType((*Data)(nil), "Data")
+	proto.RegisterType((*GoAway)(nil), "GoAway")
+	proto.RegisterType((*AuthRefresh)(nil), "AuthRefresh")
 }
 
 func init() {
@@ -507,37 +629,43 @@ func init() {
 }
 
 var fileDescriptor_fec4258d9ecd175d = []byte{
-	// 472 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x53, 0xd1, 0x6e, 0x9b, 0x30,
-	0x14, 0x85, 0x00, 0x49, 0xb8, 0x21, 0x15, 0xb2, 0xa6, 0x09, 0x75, 0x93, 0x5a, 0xf1, 0x14, 0x55,
-	0x0b, 0x54, 0xa9, 0x34, 0xed, 0x35, 0x0d, 0xa9, 0x52, 0xa9, 0x5a, 0x99, 0xd3, 0xa7, 0xee, 0x61,
-	0xf2, 0xc0, 0x9a, 0x50, 0x18, 0x66, 0xb6, 0x97, 0x8d, 0x0f, 0xda, 0x7f, 0x4e, 0x18, 0x52, 0xc8,
-	0xa4, 0x6d, 0x52, 0x9f, 0xe0, 0x1c, 0xdf, 0x73, 0x7c, 0x7d, 0xae, 0x0d, 0xf3, 0x1d, 0x2b, 0x0a,
-	0x9a, 0xc8, 0x6c, 0x9f, 0xc9, 0x6a, 0x9e, 0xe4, 0x19, 0x2d, 0x64, 0x58, 0x72, 0x26, 0x59, 0xd8,
-	0x82, 0xe6, 0x13, 0x28, 0xce, 0xff, 0x35, 0x80, 0x61, 0x4c, 0x92, 0x1d, 0x95, 0xe8, 0x0c, 0x4c,
-	0x59, 0x95, 0xd4, 0xd3, 0xcf, 0xf5, 0xd9, 0xc9, 0x62, 0x12, 0x34, 0xf4, 0x43, 0x55, 0x52, 0xac,
-	0x16, 0xd0, 0x25, 0x4c, 0xd2, 0x8c, 0xe4, 0x98, 0x7e, 0xfb, 0x4e, 0x85, 0xf4, 0x06, 0xe7, 0xfa,
-	0x6c, 0xb2, 0x70, 0x82, 0xa8, 0xe3, 0x36, 0x1a, 0xee, 0x97, 0xa0, 0x2b, 0x70, 0x1a, 0x28, 0x4a,
-	0x56, 0x08, 0xea, 0x19, 0x4a, 0x32, 0x6d, 0x25, 0x0d, 0xb9, 0xd1, 0xf0, 0x51, 0x11, 0x7a, 0x05,
-	0x66, 0x4a, 0x24, 0xf1, 0x4c, 0x55, 0x6c, 0x05, 0x11, 0x91, 0x64, 0xa3, 0x61, 0x45, 0xd6, 0x8e,
-	0x49, 0xce, 0x04, 0x3d, 0x34, 0x61, 0xb5, 0x8e, 0xab, 0x1e, 0x59, 0x3b, 0xf6, 0x8b, 0xd0, 0x5b,
-	0x98, 0xb6, 0xb8, 0xed, 0x63, 0xa8, 0x54, 0x27, 0x07, 0xd5, 0x53, 0x23, 0xc7, 0x65, 0xd7, 0x36,
-	0x8c, 0x4a, 0x52, 0xe5, 0x8c, 0xa4, 0xfe, 0x47, 0x98, 0xf4, 0xce, 0x89, 0x4e, 0x61, 0xac, 0xf2,
-	0x4b, 0x58, 0xae, 0xf2, 0xb2, 0xf1, 0x13, 0x46, 0x1e, 0x8c, 0x48, 0x9a, 0x72, 0x2a, 0x84, 0x8a,
-	0xc8, 0xc6, 0x07, 0x88, 0x5e, 0xc2, 0x90, 0x93, 0x22, 0x65, 0x5f, 0x55, 0x10, 0x06, 0x6e, 0x91,
-	0xff, 0x08, 0x4e, 0x3f, 0x11, 0xf4, 0x02, 0x2c, 0xca, 0x39, 0xe3, 0xad, 0x75, 0x03, 0xd0, 0x6b,
-	0xb0, 0x93, 0x66, 0xb6, 0xb7, 0x91, 0x72, 0x36, 0x70, 0x47, 0xfc, 0xd5, 0xfb, 0x0d, 0x38, 0xfd,
-	0x6c, 0x8e, 0x5d, 0xf4, 0x3f, 0x5c, 0xfc, 0x15, 0x4c, 0x8f, 0x32, 0x79, 0x4e, 0x2b, 0xfe, 0x7b,
-	0x30, 0xeb, 0x99, 0xfd, 0x7b, 0xab, 0xce, 0x79, 0xd0, 0x77, 0x46, 0xed, 0xf0, 0xeb, 0x43, 0x38,
-	0xcd, 0xcc, 0x2f, 0x62, 0x80, 0xee, 0x2e, 0x22, 0x07, 0xc6, 0xd1, 0xed, 0xf2, 0xee, 0x13, 0x5e,
-	0x7f, 0x70, 0xb5, 0x0e, 0x6d, 0x63, 0x57, 0x47, 0x53, 0xb0, 0x57, 0x77, 0xf7, 0xdb, 0xb5, 0x5a,
-	0x1c, 0xf4, 0xe0, 0x36, 0x76, 0x0d, 0x34, 0x06, 0x33, 0x5a, 0x3e, 0x2c, 0x5d, 0xf3, 0xc2, 0x05,
-	0x6b, 0xad, 0xb6, 0x1b, 0x81, 0xb1, 0xbe, 0xbf, 0x71, 0xb5, 0x45, 0x08, 0x4e, 0xcc, 0xd9, 0xcf,
-	0x6a, 0x4b, 0xf9, 0x3e, 0x4b, 0x28, 0x3a, 0x03, 0x4b, 0x61, 0x34, 0x6a, 0xdf, 0xc1, 0xe9, 0xe1,
-	0xc7, 0xd7, 0x66, 0xfa, 0xa5, 0x7e, 0x7d, 0xf3, 0x18, 0x89, 0xec, 0x8b, 0x08, 0x76, 0xef, 0x44,
-	0x90, 0xb1, 0x90, 0x94, 0x99, 0xa0, 0x7c, 0x4f, 0xf9, 0xbc, 0xa0, 0xf2, 0x07, 0xe3, 0xbb, 0x79,
-	0x59, 0xcb, 0xc3, 0xff, 0xbd, 0xc6, 0xcf, 0x43, 0x85, 0xae, 0x7e, 0x07, 0x00, 0x00, 0xff, 0xff,
-	0x64, 0xe0, 0x62, 0xbe, 0xb8, 0x03, 0x00, 0x00,
+	// 565 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0x5d, 0x6f, 0xd3, 0x30,
+	0x14, 0x4d, 0xfa, 0x91, 0xb6, 0xb7, 0xe9, 0x14, 0x59, 0x08, 0x45, 0x03, 0x69, 0x23, 0xbc, 0x4c,
+	0x13, 0x4d, 0xa7, 0x4d, 0x42, 0xbc, 0x66, 0x4d, 0xb7, 0x4c, 0x9a, 0x58, 0x71, 0x87, 0x10, 0xe3,
+	0x61, 0x32, 0xa9, 0xd9, 0xa2, 0x96, 0x38, 0xd8, 0x5e, 0x47, 0xff, 0x3a, 0x4f, 0x28, 0x8e, 0x4b,
+	0x5c, 0x24, 0x40, 0xe2, 0xa9, 0x3d, 0xc7, 0xe7, 0x9e, 0x5e, 0x9f, 0x7b, 0x5d, 0x18, 0x2e, 0x58,
+	0x9e, 0xd3, 0x54, 0x66, 0xab, 0x4c, 0xae, 0x87, 0xe9, 0x32, 0xa3, 0xb9, 0x1c, 0x15, 0x9c, 0x49,
+	0x36, 0xd2, 0xa0, 0xfa, 0x08, 0x15, 0x17, 0xfc, 0x68, 0x80, 0x33, 0x25, 0xe9, 0x82, 0x4a, 0xb4,
+	0x07, 0x2d, 0xb9, 0x2e, 0xa8, 0x6f, 0xef, 0xdb, 0x07, 0x3b, 0xc7, 0xfd, 0xb0, 0xa2, 0xaf, 0xd7,
+	0x05, 0xc5, 0xea, 0x00, 0x1d, 0x41, 0x7f, 0x9e, 0x91, 0x25, 0xa6, 0xdf, 0x1e, 0xa8, 0x90, 0x7e,
+	0x63, 0xdf, 0x3e, 0xe8, 0x1f, 0xbb, 0x61, 0x5c, 0x73, 0x89, 0x85, 0x4d, 0x09, 0x3a, 0x01, 0xb7,
+	0x82, 0xa2, 0x60, 0xb9, 0xa0, 0x7e, 0x53, 0x95, 0x0c, 0xc2, 0xd8, 0x20, 0x13, 0x0b, 0x6f, 0x89,
+	0xd0, 0x33, 0x68, 0xcd, 0x89, 0x24, 0x7e, 0x4b, 0x89, 0xdb, 0x61, 0x4c, 0x24, 0x49, 0x2c, 0xac,
+	0xc8, 0xd2, 0x31, 0x5d, 0x32, 0x41, 0x37, 0x4d, 0xb4, 0xb5, 0xe3, 0xd8, 0x20, 0x4b, 0x47, 0x53,
+	0x84, 0x5e, 0xc3, 0x40, 0x63, 0xdd, 0x87, 0xa3, 0xaa, 0x76, 0xc2, 0xb1, 0xc9, 0x26, 0x16, 0xde,
+	0x96, 0xa1, 0x17, 0xe0, 0xdc, 0xb1, 0xe8, 0x91, 0xac, 0xfd, 0x8e, 0x2a, 0xe8, 0x84, 0xe7, 0x0a,
+	0x26, 0x16, 0xd6, 0x07, 0x65, 0x26, 0xe4, 0x41, 0xde, 0x63, 0xfa, 0x85, 0x53, 0x71, 0xef, 0x77,
+	0x75, 0x26, 0x51, 0xcd, 0x95, 0x99, 0x18, 0x92, 0xd3, 0x1e, 0x74, 0x0a, 0xb2, 0x5e, 0x32, 0x32,
+	0x0f, 0x3e, 0x41, 0xdf, 0x08, 0x0f, 0xed, 0x42, 0x57, 0x0d, 0x25, 0x65, 0x4b, 0x35, 0x84, 0x1e,
+	0xfe, 0x85, 0x91, 0x0f, 0x1d, 0x32, 0x9f, 0x73, 0x2a, 0x84, 0xca, 0xbd, 0x87, 0x37, 0x10, 0x3d,
+	0x05, 0x87, 0x93, 0x7c, 0xce, 0xbe, 0xaa, 0x74, 0x9b, 0x58, 0xa3, 0xe0, 0x06, 0x5c, 0x33, 0x66,
+	0xf4, 0x04, 0xda, 0x94, 0x73, 0xc6, 0xb5, 0x75, 0x05, 0xd0, 0x73, 0xe8, 0xa5, 0xd5, 0xc2, 0x5c,
+	0xc4, 0xca, 0xb9, 0x89, 0x6b, 0xe2, 0x8f, 0xde, 0xaf, 0xc0, 0x35, 0x03, 0xdf, 0x76, 0xb1, 0x7f,
+	0x73, 0x09, 0xc6, 0x30, 0xd8, 0x0a, 0xfa, 0x7f, 0x5a, 0x09, 0xde, 0x42, 0xab, 0x5c, 0x84, 0xbf,
+	0xff, 0x54, 0xed, 0xdc, 0x30, 0x9d, 0x91, 0xde, 0xa8, 0xf2, 0x12, 0x6e, 0xb5, 0x48, 0xc1, 0x3e,
+	0x38, 0xd5, 0x30, 0xd5, 0x25, 0x29, 0x11, 0x2c, 0xd7, 0xed, 0x68, 0x14, 0xbc, 0x84, 0xbe, 0x31,
+	0xc6, 0xd2, 0x5a, 0xb2, 0x05, 0xdd, 0xa8, 0x2a, 0x70, 0x98, 0x03, 0xd4, 0xef, 0x04, 0xb9, 0xd0,
+	0x8d, 0x2f, 0xa2, 0xcb, 0x5b, 0x3c, 0x79, 0xe7, 0x59, 0x35, 0x9a, 0x4d, 0x3d, 0x1b, 0x0d, 0xa0,
+	0x37, 0xbe, 0xbc, 0x9a, 0x4d, 0xd4, 0x61, 0xc3, 0x80, 0xb3, 0xa9, 0xd7, 0x44, 0x5d, 0x68, 0xc5,
+	0xd1, 0x75, 0xe4, 0xb5, 0x10, 0x80, 0x73, 0x7e, 0x15, 0x7d, 0x88, 0x3e, 0x7a, 0x6d, 0xe4, 0x81,
+	0x1b, 0xbd, 0xbf, 0x4e, 0x6e, 0xf1, 0xe4, 0x0c, 0x4f, 0x66, 0x89, 0xe7, 0x1c, 0x7a, 0xd0, 0x9e,
+	0xa8, 0x3b, 0x75, 0xa0, 0x39, 0xb9, 0x3a, 0xf3, 0xac, 0xe3, 0x11, 0xb8, 0x53, 0xce, 0xbe, 0xaf,
+	0x67, 0x94, 0xaf, 0xb2, 0x94, 0xa2, 0x3d, 0x68, 0x2b, 0x8c, 0x3a, 0xfa, 0x05, 0xef, 0x6e, 0xbe,
+	0x04, 0xd6, 0x81, 0x7d, 0x64, 0x9f, 0x9e, 0xdd, 0xc4, 0x22, 0xbb, 0x13, 0xe1, 0xe2, 0x8d, 0x08,
+	0x33, 0x36, 0x22, 0x45, 0x26, 0x28, 0x5f, 0x51, 0x3e, 0xcc, 0xa9, 0x7c, 0x64, 0x7c, 0x31, 0x2c,
+	0xca, 0xf2, 0xd1, 0xbf, 0xfe, 0x47, 0x3e, 0x3b, 0x0a, 0x9d, 0xfc, 0x1c, 0x00, 0x7a, 0x7c, 0x27,
+	0xee, 0x72, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
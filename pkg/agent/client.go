@@ -18,6 +18,7 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -42,16 +43,112 @@ type connContext struct {
 	conn      net.Conn
 	cleanFunc func()
 	dataCh    chan []byte
+	// done is closed once the connection is cleaned up. dataCh is never
+	// closed, as DATA may still be received for the connection.
+	done      chan struct{}
 	cleanOnce sync.Once
+
+	start time.Time
+	// lastActivity is the time, in unix nanoseconds, data was last sent
+	// over the connection in either direction. Accessed atomically.
+	lastActivity int64
+	// closeReason is reported in the CLOSE_RSP when the agent closes the
+	// connection on its own. Only accessed within cleanOnce.
+	closeReason string
 }
 
 func (c *connContext) cleanup() {
 	c.cleanOnce.Do(c.cleanFunc)
 }
 
+// cleanupWithReason closes the connection, reporting reason to the server
+// unless the connection is already being closed.
+func (c *connContext) cleanupWithReason(reason string) {
+	c.cleanOnce.Do(func() {
+		c.closeReason = reason
+		c.cleanFunc()
+	})
+}
+
+func (c *connContext) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// expired returns why the connection should be closed, if it is idle for
+// longer than idleTimeout or older than maxLifetime. A zero duration
+// disables the corresponding check.
+func (c *connContext) expired(now time.Time, idleTimeout, maxLifetime time.Duration) (metrics.ReapReason, bool) {
+	if maxLifetime > 0 && now.Sub(c.start) > maxLifetime {
+		return metrics.ReapMaxLifetime, true
+	}
+	lastActivity := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	if idleTimeout > 0 && now.Sub(lastActivity) > idleTimeout {
+		return metrics.ReapIdleTimeout, true
+	}
+	return "", false
+}
+
+// errAtCapacity is returned in the DIAL_RSP when the agent already serves
+// its maximum number of concurrent connections.
+var errAtCapacity = errors.New("agent is at capacity: too many concurrent connections")
+
+// goAwayPollInterval is how often a client whose proxy server sent a GOAWAY
+// checks whether its connections are done.
+const goAwayPollInterval = 100 * time.Millisecond
+
+// connectionLimit bounds the number of concurrent connections served by all
+// the AgentClients of an agent.
+type connectionLimit struct {
+	max   int64
+	count int64 // accessed atomically
+}
+
+func newConnectionLimit(max int) *connectionLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &connectionLimit{max: int64(max)}
+}
+
+func (l *connectionLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt64(&l.count, 1) > l.max {
+		atomic.AddInt64(&l.count, -1)
+		return false
+	}
+	return true
+}
+
+func (l *connectionLimit) release() {
+	if l == nil {
+		return
+	}
+	atomic.AddInt64(&l.count, -1)
+}
+
 type connectionManager struct {
 	mu          sync.RWMutex
 	connections map[int64]*connContext
+	// limit, if set, is shared with the connectionManagers of the other
+	// AgentClients of the agent.
+	limit *connectionLimit
+}
+
+// Reserve takes a connection slot before dialing. The slot is returned by
+// Delete once the connection is added, or by Unreserve if the dial fails.
+func (cm *connectionManager) Reserve() error {
+	if !cm.limit.acquire() {
+		return errAtCapacity
+	}
+	return nil
+}
+
+// Unreserve returns a slot taken by Reserve for a connection that was never
+// added.
+func (cm *connectionManager) Unreserve() {
+	cm.limit.release()
 }
 
 func (cm *connectionManager) Add(connID int64, ctx *connContext) {
@@ -70,12 +167,32 @@ func (cm *connectionManager) Get(connID int64) (*connContext, bool) {
 func (cm *connectionManager) Delete(connID int64) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	if _, ok := cm.connections[connID]; !ok {
+		return
+	}
 	delete(cm.connections, connID)
+	cm.limit.release()
+}
+
+// List returns the connections.
+func (cm *connectionManager) List() map[int64]*connContext {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	ret := make(map[int64]*connContext, len(cm.connections))
+	for connID, ctx := range cm.connections {
+		ret[connID] = ctx
+	}
+	return ret
 }
 
 func newConnectionManager() *connectionManager {
+	return newLimitedConnectionManager(nil)
+}
+
+func newLimitedConnectionManager(limit *connectionLimit) *connectionManager {
 	return &connectionManager{
 		connections: make(map[int64]*connContext),
+		limit:       limit,
 	}
 }
 
@@ -91,6 +208,9 @@ type AgentClient struct {
 	stream   agent.AgentService_ConnectClient
 	agentID  string
 	serverID string // the id of the proxy server this client connects to.
+	// serverCount is the number of proxy servers advertised by the proxy
+	// server when the client connected.
+	serverCount int
 
 	// connect opts
 	address string
@@ -102,9 +222,26 @@ type AgentClient struct {
 	recvLock      sync.Mutex
 	probeInterval time.Duration // interval between probe pings
 
+	// idleTimeout and maxLifetime bound how long connections to the node
+	// network are kept. Zero disables the corresponding limit.
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	// dialer dials the destinations of dial requests. nil means net.Dial.
+	dialer Dialer
+	// dialTimeout bounds the dial of a destination. Zero means no timeout.
+	dialTimeout time.Duration
+
 	// file path contains service account token.
 	// token's value is auto-rotated by kubernetes, based on projected volume configuration.
 	serviceAccountTokenPath string
+	// tokenRefreshInterval is how often the token is sent again to the
+	// proxy server. 0 disables it.
+	tokenRefreshInterval time.Duration
+
+	// goingAway is set, atomically, once the proxy server or the agent
+	// sent a GOAWAY: no new connection is dialed through the client.
+	goingAway int32
 }
 
 func newAgentClient(address, agentID string, cs *ClientSet, opts ...grpc.DialOption) (*AgentClient, int, error) {
@@ -114,9 +251,14 @@ func newAgentClient(address, agentID string, cs *ClientSet, opts ...grpc.DialOpt
 		agentID:                 agentID,
 		opts:                    opts,
 		probeInterval:           cs.probeInterval,
+		idleTimeout:             cs.idleTimeout,
+		maxLifetime:             cs.maxLifetime,
+		dialer:                  cs.dialer,
+		dialTimeout:             cs.dialTimeout,
 		stopCh:                  make(chan struct{}),
 		serviceAccountTokenPath: cs.serviceAccountTokenPath,
-		connManager:             newConnectionManager(),
+		tokenRefreshInterval:    cs.tokenRefreshInterval,
+		connManager:             newLimitedConnectionManager(cs.connLimit),
 	}
 	serverCount, err := a.Connect()
 	if err != nil {
@@ -133,6 +275,9 @@ func (a *AgentClient) Connect() (int, error) {
 		return 0, err
 	}
 	ctx := metadata.AppendToOutgoingContext(context.Background(), header.AgentID, a.agentID)
+	if limit := a.connManager.limit; limit != nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, header.MaxConnections, strconv.FormatInt(limit.max, 10))
+	}
 	if a.serviceAccountTokenPath != "" {
 		if ctx, err = a.initializeAuthContext(ctx); err != nil {
 			conn.Close()
@@ -157,6 +302,7 @@ func (a *AgentClient) Connect() (int, error) {
 	a.conn = conn
 	a.stream = stream
 	a.serverID = serverID
+	a.serverCount = serverCount
 	klog.V(2).InfoS("Connect to", "server", serverID)
 	return serverCount, nil
 }
@@ -177,7 +323,7 @@ func (a *AgentClient) Send(pkt *client.Packet) error {
 	err := a.stream.Send(pkt)
 	if err != nil && err != io.EOF {
 		metrics.Metrics.ObserveFailure(metrics.DirectionToServer)
-		a.cs.RemoveClient(a.serverID)
+		a.cs.removeClient(a)
 	}
 	return err
 }
@@ -187,9 +333,13 @@ func (a *AgentClient) Recv() (*client.Packet, error) {
 	defer a.recvLock.Unlock()
 
 	pkt, err := a.stream.Recv()
-	if err != nil && err != io.EOF {
-		metrics.Metrics.ObserveFailure(metrics.DirectionFromServer)
-		a.cs.RemoveClient(a.serverID)
+	if err != nil {
+		if err != io.EOF {
+			metrics.Metrics.ObserveFailure(metrics.DirectionFromServer)
+		}
+		// The stream is over, let the clientset connect to another
+		// proxy server.
+		a.cs.removeClient(a)
 	}
 	return pkt, err
 }
@@ -221,19 +371,58 @@ func serverID(stream agent.AgentService_ConnectClient) (string, error) {
 }
 
 func (a *AgentClient) initializeAuthContext(ctx context.Context) (context.Context, error) {
-	var err error
-	var b []byte
-
-	// load current service account's token value
-	if b, err = ioutil.ReadFile(a.serviceAccountTokenPath); err != nil {
-		klog.ErrorS(err, "Failed to read token", "path", a.serviceAccountTokenPath)
+	token, err := a.readToken()
+	if err != nil {
 		return nil, err
 	}
-	ctx = metadata.AppendToOutgoingContext(ctx, header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+string(b))
+	ctx = metadata.AppendToOutgoingContext(ctx, header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+token)
 
 	return ctx, nil
 }
 
+// readToken loads current service account's token value.
+func (a *AgentClient) readToken() (string, error) {
+	b, err := ioutil.ReadFile(a.serviceAccountTokenPath)
+	if err != nil {
+		klog.ErrorS(err, "Failed to read token", "path", a.serviceAccountTokenPath)
+		return "", err
+	}
+	return string(b), nil
+}
+
+// refreshToken sends the token, as rotated by kubernetes, to the proxy
+// server every tokenRefreshInterval, so that the proxy server can check it
+// is still valid.
+func (a *AgentClient) refreshToken() {
+	ticker := time.NewTicker(a.tokenRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case <-ticker.C:
+			token, err := a.readToken()
+			if err != nil {
+				// The proxy server disconnects the agent if it does
+				// not get a valid token in time.
+				continue
+			}
+			klog.V(4).InfoS("Send AUTH_REFRESH to proxy server", "serverID", a.serverID)
+			pkt := &client.Packet{
+				Type: client.PacketType_AUTH_REFRESH,
+				Payload: &client.Packet_AuthRefresh{
+					AuthRefresh: &client.AuthRefresh{
+						Token: token,
+					},
+				},
+			}
+			if err := a.Send(pkt); err != nil {
+				klog.ErrorS(err, "AUTH_REFRESH to proxy server failed", "serverID", a.serverID)
+			}
+		}
+	}
+}
+
 // Connect connects to proxy server to establish a gRPC stream,
 // on which the proxied traffic is multiplexed through the stream
 // and piped to the local connection. It register itself as a
@@ -250,6 +439,12 @@ func (a *AgentClient) initializeAuthContext(ctx context.Context) (context.Contex
 func (a *AgentClient) Serve() {
 	klog.V(2).InfoS("Start serving", "serverID", a.serverID)
 	go a.probe()
+	if a.idleTimeout > 0 || a.maxLifetime > 0 {
+		go a.reapConnections()
+	}
+	if a.serviceAccountTokenPath != "" && a.tokenRefreshInterval > 0 {
+		go a.refreshToken()
+	}
 	for {
 		select {
 		case <-a.stopCh:
@@ -286,53 +481,27 @@ func (a *AgentClient) Serve() {
 			dialReq := pkt.GetDialRequest()
 			resp.GetDialResponse().Random = dialReq.Random
 
-			start := time.Now()
-			conn, err := net.Dial(dialReq.Protocol, dialReq.Address)
-			if err != nil {
-				resp.GetDialResponse().Error = err.Error()
+			if atomic.LoadInt32(&a.goingAway) != 0 {
+				klog.V(2).InfoS("Reject dial request of connection going away", "address", dialReq.Address, "serverID", a.serverID)
+				resp.GetDialResponse().Error = "connection is going away"
 				if err := a.Send(resp); err != nil {
 					klog.ErrorS(err, "could not send stream")
 				}
 				continue
 			}
-			metrics.Metrics.ObserveDialLatency(time.Since(start))
-
-			connID := atomic.AddInt64(&a.nextConnID, 1)
-			dataCh := make(chan []byte, 5)
-			ctx := &connContext{
-				conn:   conn,
-				dataCh: dataCh,
-				cleanFunc: func() {
-					klog.V(4).InfoS("close connection", "connectionID", connID)
-					resp := &client.Packet{
-						Type:    client.PacketType_CLOSE_RSP,
-						Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{}},
-					}
-					resp.GetCloseResponse().ConnectID = connID
-
-					err := conn.Close()
-					if err != nil {
-						resp.GetCloseResponse().Error = err.Error()
-					}
-
-					if err := a.Send(resp); err != nil {
-						klog.ErrorS(err, "close response failure")
-					}
-
-					close(dataCh)
-					a.connManager.Delete(connID)
-				},
-			}
-			a.connManager.Add(connID, ctx)
 
-			resp.GetDialResponse().ConnectID = connID
-			if err := a.Send(resp); err != nil {
-				klog.ErrorS(err, "stream send failure")
+			if err := a.connManager.Reserve(); err != nil {
+				klog.V(2).InfoS("Reject dial request", "address", dialReq.Address, "reason", err)
+				resp.GetDialResponse().Error = err.Error()
+				if err := a.Send(resp); err != nil {
+					klog.ErrorS(err, "could not send stream")
+				}
 				continue
 			}
 
-			go a.remoteToProxy(connID, ctx)
-			go a.proxyToRemote(connID, ctx)
+			// A slow destination must not hold the packets of the other
+			// connections.
+			go a.serveDial(dialReq, resp)
 
 		case client.PacketType_DATA:
 			data := pkt.GetData()
@@ -340,7 +509,11 @@ func (a *AgentClient) Serve() {
 
 			ctx, ok := a.connManager.Get(data.ConnectID)
 			if ok {
-				ctx.dataCh <- data.Data
+				ctx.touch()
+				select {
+				case ctx.dataCh <- data.Data:
+				case <-ctx.done:
+				}
 			}
 
 		case client.PacketType_CLOSE_REQ:
@@ -365,12 +538,81 @@ func (a *AgentClient) Serve() {
 				}
 			}
 
+		case client.PacketType_GOAWAY:
+			klog.V(2).InfoS("received GOAWAY", "serverID", a.serverID, "reason", pkt.GetGoAway().GetReason())
+			if atomic.CompareAndSwapInt32(&a.goingAway, 0, 1) {
+				go a.leave()
+			}
+
 		default:
 			klog.V(2).InfoS("unrecognized packet", "type", pkt)
 		}
 	}
 }
 
+// serveDial dials the destination of a dial request, for which a
+// connection slot is reserved, and answers it with resp.
+func (a *AgentClient) serveDial(dialReq *client.DialRequest, resp *client.Packet) {
+	start := time.Now()
+	conn, err := a.dial(dialReq.Protocol, dialReq.Address)
+	if err != nil {
+		a.connManager.Unreserve()
+		resp.GetDialResponse().Error = err.Error()
+		if err := a.Send(resp); err != nil {
+			klog.ErrorS(err, "could not send stream")
+		}
+		return
+	}
+	metrics.Metrics.ObserveDialLatency(time.Since(start))
+
+	connID := atomic.AddInt64(&a.nextConnID, 1)
+	dataCh := make(chan []byte, 5)
+	var ctx *connContext
+	ctx = &connContext{
+		conn:   conn,
+		dataCh: dataCh,
+		done:   make(chan struct{}),
+		start:  time.Now(),
+		cleanFunc: func() {
+			klog.V(4).InfoS("close connection", "connectionID", connID)
+			resp := &client.Packet{
+				Type:    client.PacketType_CLOSE_RSP,
+				Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{}},
+			}
+			resp.GetCloseResponse().ConnectID = connID
+
+			err := conn.Close()
+			close(ctx.done)
+			if ctx.closeReason != "" {
+				resp.GetCloseResponse().Error = ctx.closeReason
+			} else if err != nil {
+				resp.GetCloseResponse().Error = err.Error()
+			}
+			// Release the connection before the CLOSE_RSP, so
+			// that the slot is free once the server learns about it.
+			a.connManager.Delete(connID)
+
+			if err := a.Send(resp); err != nil {
+				klog.ErrorS(err, "close response failure")
+			}
+		},
+	}
+	ctx.touch()
+	a.connManager.Add(connID, ctx)
+
+	resp.GetDialResponse().ConnectID = connID
+	if err := a.Send(resp); err != nil {
+		klog.ErrorS(err, "stream send failure")
+		// The server never learns about the connection: close it and
+		// free its slot.
+		ctx.cleanup()
+		return
+	}
+
+	go a.remoteToProxy(connID, ctx)
+	go a.proxyToRemote(connID, ctx)
+}
+
 func (a *AgentClient) remoteToProxy(connID int64, ctx *connContext) {
 	defer ctx.cleanup()
 
@@ -391,6 +633,7 @@ func (a *AgentClient) remoteToProxy(connID int64, ctx *connContext) {
 			klog.ErrorS(err, "connection read failure")
 			return
 		} else {
+			ctx.touch()
 			resp.Payload = &client.Packet_Data{Data: &client.Data{
 				Data:      buf[:n],
 				ConnectID: connID,
@@ -405,7 +648,13 @@ func (a *AgentClient) remoteToProxy(connID int64, ctx *connContext) {
 func (a *AgentClient) proxyToRemote(connID int64, ctx *connContext) {
 	defer ctx.cleanup()
 
-	for d := range ctx.dataCh {
+	for {
+		var d []byte
+		select {
+		case d = <-ctx.dataCh:
+		case <-ctx.done:
+			return
+		}
 		pos := 0
 		for {
 			n, err := ctx.conn.Write(d[pos:])
@@ -423,6 +672,99 @@ func (a *AgentClient) proxyToRemote(connID int64, ctx *connContext) {
 	}
 }
 
+// dial connects to the address of a dial request on the node network,
+// within the dial timeout.
+func (a *AgentClient) dial(network, address string) (net.Conn, error) {
+	ctx := context.Background()
+	if a.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.dialTimeout)
+		defer cancel()
+	}
+	if a.dialer == nil {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	return a.dialer.DialContext(ctx, network, address)
+}
+
+// reapInterval returns how often the connections are checked against the
+// idle timeout and the maximum lifetime.
+func reapInterval(idleTimeout, maxLifetime time.Duration) time.Duration {
+	interval := time.Second
+	for _, d := range []time.Duration{idleTimeout, maxLifetime} {
+		if d > 0 && d/2 < interval {
+			interval = d / 2
+		}
+	}
+	return interval
+}
+
+// reapConnections closes the connections that are idle or have exceeded
+// their maximum lifetime, reporting the reason in the CLOSE_RSP.
+func (a *AgentClient) reapConnections() {
+	ticker := time.NewTicker(reapInterval(a.idleTimeout, a.maxLifetime))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case now := <-ticker.C:
+			for connID, ctx := range a.connManager.List() {
+				reason, expired := ctx.expired(now, a.idleTimeout, a.maxLifetime)
+				if !expired {
+					continue
+				}
+				klog.V(2).InfoS("Close connection", "connectionID", connID, "reason", reason)
+				metrics.Metrics.ObserveConnectionReaped(reason)
+				ctx.cleanupWithReason(string(reason))
+			}
+		}
+	}
+}
+
+// goAway tells the proxy server that the agent is leaving, so that it stops
+// routing new connections to it. The established connections are kept.
+func (a *AgentClient) goAway(reason string) {
+	atomic.StoreInt32(&a.goingAway, 1)
+	klog.V(2).InfoS("Send GOAWAY to proxy server", "serverID", a.serverID, "reason", reason)
+	pkt := &client.Packet{
+		Type: client.PacketType_GOAWAY,
+		Payload: &client.Packet_GoAway{
+			GoAway: &client.GoAway{
+				Reason: reason,
+			},
+		},
+	}
+	if err := a.Send(pkt); err != nil {
+		klog.ErrorS(err, "GOAWAY to proxy server failed", "serverID", a.serverID)
+	}
+}
+
+func (a *AgentClient) isGoingAway() bool {
+	return atomic.LoadInt32(&a.goingAway) != 0
+}
+
+// leave removes the client from the clientset once its connections are
+// done, so that the clientset connects to another proxy server.
+func (a *AgentClient) leave() {
+	ticker := time.NewTicker(goAwayPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case <-ticker.C:
+			if len(a.connManager.List()) > 0 {
+				continue
+			}
+			klog.V(2).InfoS("Leaving proxy server going away", "serverID", a.serverID)
+			a.cs.removeClient(a)
+			return
+		}
+	}
+}
+
 func (a *AgentClient) probe() {
 	for {
 		select {
@@ -438,7 +780,7 @@ func (a *AgentClient) probe() {
 			}
 		}
 		klog.V(1).InfoS("Removing client used for server connection", "state", a.conn.GetState(), "serverID", a.serverID)
-		a.cs.RemoveClient(a.serverID)
+		a.cs.removeClient(a)
 		return
 	}
 }
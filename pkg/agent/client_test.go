@@ -1,10 +1,14 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -12,6 +16,7 @@ import (
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent/metrics"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
 )
 
@@ -195,6 +200,419 @@ func TestClose_Client(t *testing.T) {
 
 }
 
+func TestServeDial_AtCapacity(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &AgentClient{
+		connManager: newLimitedConnectionManager(newConnectionLimit(1)),
+		stopCh:      stopCh,
+	}
+	testClient.stream, stream = pipe()
+
+	// Start agent
+	go testClient.Serve()
+	defer close(stopCh)
+
+	// Start test http server as remote service
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello, world")
+	}))
+	defer ts.Close()
+
+	// The first dial takes the only connection slot.
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil {
+		t.Fatal("unexpected nil packet")
+	}
+	if errMsg := pkg.GetDialResponse().Error; errMsg != "" {
+		t.Fatalf("expect successful dial; got %v", errMsg)
+	}
+	connID := pkg.GetDialResponse().ConnectID
+
+	// The second dial is rejected.
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 112)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil {
+		t.Fatal("unexpected nil packet")
+	}
+	if pkg.Type != client.PacketType_DIAL_RSP || pkg.GetDialResponse().Random != 112 {
+		t.Fatalf("expect DIAL_RSP for random 112; got %+v", pkg)
+	}
+	if errMsg := pkg.GetDialResponse().Error; errMsg != errAtCapacity.Error() {
+		t.Errorf("expect %q; got %q", errAtCapacity.Error(), errMsg)
+	}
+
+	// Closing the first connection frees the slot.
+	if err := stream.Send(newClosePacket(connID)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %+v", pkg)
+	}
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 113)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil {
+		t.Fatal("unexpected nil packet")
+	}
+	if errMsg := pkg.GetDialResponse().Error; errMsg != "" {
+		t.Errorf("expect successful dial after close; got %v", errMsg)
+	}
+}
+
+// failingStream fails to send every packet.
+type failingStream struct {
+	fakeStream
+}
+
+func (s *failingStream) Send(packet *client.Packet) error {
+	return errors.New("stream broken")
+}
+
+func TestServeDial_SendFailure(t *testing.T) {
+	testClient := &AgentClient{
+		connManager: newLimitedConnectionManager(newConnectionLimit(1)),
+		stream:      &failingStream{},
+		cs:          &ClientSet{clients: make(map[string]*AgentClient)},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello, world")
+	}))
+	defer ts.Close()
+
+	// The DIAL_RSP of a successful dial cannot be sent.
+	if err := testClient.connManager.Reserve(); err != nil {
+		t.Fatal(err)
+	}
+	dialReq := newDialPacket("tcp", ts.URL[len("http://"):], 111).GetDialRequest()
+	resp := &client.Packet{
+		Type:    client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{Random: 111}},
+	}
+	testClient.serveDial(dialReq, resp)
+
+	// The connection is closed and its slot is free.
+	if n := len(testClient.connManager.List()); n != 0 {
+		t.Errorf("expect no connection; got %d", n)
+	}
+	if err := testClient.connManager.Reserve(); err != nil {
+		t.Errorf("expect the connection slot to be free; got %v", err)
+	}
+}
+
+// blackholeDialer never connects to the addresses it blackholes.
+type blackholeDialer struct {
+	address string
+}
+
+func (d *blackholeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address == d.address {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func TestServeDial_Timeout(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &AgentClient{
+		connManager: newConnectionManager(),
+		stopCh:      stopCh,
+		dialer:      &blackholeDialer{address: "10.0.0.1:80"},
+		dialTimeout: time.Second,
+	}
+	testClient.stream, stream = pipe()
+
+	go testClient.Serve()
+	defer close(stopCh)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello, world")
+	}))
+	defer ts.Close()
+
+	// The dial of a blackholed destination does not hold the other dials.
+	if err := stream.Send(newDialPacket("tcp", "10.0.0.1:80", 111)); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 112)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.GetDialResponse().Random != 112 || pkg.GetDialResponse().Error != "" {
+		t.Fatalf("expect successful DIAL_RSP for random 112; got %+v", pkg)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.GetDialResponse().Random != 111 || pkg.GetDialResponse().Error == "" {
+		t.Fatalf("expect failed DIAL_RSP for random 111; got %+v", pkg)
+	}
+}
+
+func TestServeGoAway(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	conn, err := grpc.Dial("127.0.0.1:0", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &ClientSet{clients: make(map[string]*AgentClient)}
+	testClient := &AgentClient{
+		connManager: newConnectionManager(),
+		cs:          cs,
+		serverID:    "server1",
+		conn:        conn,
+		stopCh:      make(chan struct{}),
+		// The connection never gets ready, don't let the probe remove
+		// the client.
+		probeInterval: time.Hour,
+	}
+	testClient.stream, stream = pipe()
+	cs.AddClient("server1", testClient)
+	defer cs.RemoveClient("server1")
+
+	go testClient.Serve()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello, world")
+	}))
+	defer ts.Close()
+
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.GetDialResponse().Error != "" {
+		t.Fatalf("expect successful dial; got %+v", pkg)
+	}
+	connID := pkg.GetDialResponse().ConnectID
+
+	goAway := &client.Packet{
+		Type:    client.PacketType_GOAWAY,
+		Payload: &client.Packet_GoAway{GoAway: &client.GoAway{Reason: "draining"}},
+	}
+	if err := stream.Send(goAway); err != nil {
+		t.Fatal(err)
+	}
+
+	// No new connection is dialed once the server is going away.
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 112)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.GetDialResponse().Random != 112 || pkg.GetDialResponse().Error == "" {
+		t.Fatalf("expect failed DIAL_RSP for random 112; got %+v", pkg)
+	}
+
+	// The established connection is kept until it is closed.
+	time.Sleep(3 * goAwayPollInterval)
+	if !cs.HasID("server1") {
+		t.Fatal("expect client to be kept while it has connections")
+	}
+	if err := stream.Send(newClosePacket(connID)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %+v", pkg)
+	}
+	deadline := time.Now().Add(time.Second)
+	for cs.HasID("server1") {
+		if time.Now().After(deadline) {
+			t.Fatal("expect client to be removed once its connections are closed")
+		}
+		time.Sleep(goAwayPollInterval)
+	}
+}
+
+// stalledDialer connects to destinations that never read.
+type stalledDialer struct{}
+
+func (stalledDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestServeData_Reaped(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &AgentClient{
+		connManager: newConnectionManager(),
+		stopCh:      stopCh,
+		dialer:      stalledDialer{},
+	}
+	testClient.stream, stream = pipe()
+
+	go testClient.Serve()
+	defer close(stopCh)
+
+	if err := stream.Send(newDialPacket("tcp", "10.0.0.1:80", 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expect PacketType_DIAL_RSP; got %+v", pkg)
+	}
+	connID := pkg.GetDialResponse().ConnectID
+	ctx, ok := testClient.connManager.Get(connID)
+	if !ok {
+		t.Fatal("expect the connection to be served")
+	}
+
+	// The destination does not read: the DATA fill the buffer, then hold
+	// the agent.
+	go func() {
+		for i := 0; i < cap(ctx.dataCh)+2; i++ {
+			stream.Send(newDataPacket(connID, []byte("hello")))
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ctx.dataCh) < cap(ctx.dataCh) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the DATA to fill the buffer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The connection is reaped while the agent waits to pass DATA on.
+	ctx.cleanupWithReason(string(metrics.ReapIdleTimeout))
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %+v", pkg)
+	}
+
+	// The agent keeps serving.
+	if err := stream.Send(newDialPacket("tcp", "10.0.0.1:80", 112)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.GetDialResponse().Random != 112 {
+		t.Fatalf("expect DIAL_RSP for random 112; got %+v", pkg)
+	}
+}
+
+func TestIdleTimeout_Client(t *testing.T) {
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &AgentClient{
+		connManager: newConnectionManager(),
+		stopCh:      stopCh,
+		idleTimeout: 200 * time.Millisecond,
+	}
+	testClient.stream, stream = pipe()
+
+	// Start agent
+	go testClient.Serve()
+	defer close(stopCh)
+
+	// Start test http server as remote service
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello, world")
+	}))
+	defer ts.Close()
+
+	if err := stream.Send(newDialPacket("tcp", ts.URL[len("http://"):], 111)); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_DIAL_RSP {
+		t.Fatalf("expect PacketType_DIAL_RSP; got %+v", pkg)
+	}
+	connID := pkg.GetDialResponse().ConnectID
+
+	// Without any data the connection is closed by the agent.
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_CLOSE_RSP {
+		t.Fatalf("expect PacketType_CLOSE_RSP; got %+v", pkg)
+	}
+	if pkg.GetCloseResponse().ConnectID != connID {
+		t.Errorf("expect connectID %d; got %d", connID, pkg.GetCloseResponse().ConnectID)
+	}
+	if reason := pkg.GetCloseResponse().Error; reason != string(metrics.ReapIdleTimeout) {
+		t.Errorf("expect close reason %q; got %q", metrics.ReapIdleTimeout, reason)
+	}
+	if _, ok := testClient.connManager.Get(connID); ok {
+		t.Error("client.connContext not released")
+	}
+}
+
+func TestRefreshToken_Client(t *testing.T) {
+	f, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("token1")
+	f.Close()
+
+	var stream agent.AgentService_ConnectClient
+	stopCh := make(chan struct{})
+	testClient := &AgentClient{
+		connManager:             newConnectionManager(),
+		stopCh:                  stopCh,
+		serviceAccountTokenPath: f.Name(),
+		tokenRefreshInterval:    50 * time.Millisecond,
+	}
+	testClient.stream, stream = pipe()
+
+	go testClient.Serve()
+	defer close(stopCh)
+
+	pkg, _ := stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_AUTH_REFRESH || pkg.GetAuthRefresh().Token != "token1" {
+		t.Fatalf("expect AUTH_REFRESH with token1; got %+v", pkg)
+	}
+
+	// The rotated token is sent on the next refresh.
+	if err := ioutil.WriteFile(f.Name(), []byte("token2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ = stream.Recv()
+	if pkg == nil || pkg.Type != client.PacketType_AUTH_REFRESH {
+		t.Fatalf("expect AUTH_REFRESH; got %+v", pkg)
+	}
+	if pkg.GetAuthRefresh().Token != "token2" {
+		// The refresh may have raced with the rotation.
+		pkg, _ = stream.Recv()
+		if pkg == nil || pkg.GetAuthRefresh().Token != "token2" {
+			t.Fatalf("expect AUTH_REFRESH with token2; got %+v", pkg)
+		}
+	}
+}
+
+func TestConnContextExpired(t *testing.T) {
+	now := time.Now()
+	ctx := &connContext{start: now.Add(-time.Hour)}
+	ctx.lastActivity = now.Add(-time.Minute).UnixNano()
+
+	testCases := []struct {
+		idleTimeout time.Duration
+		maxLifetime time.Duration
+		wantReason  metrics.ReapReason
+		wantExpired bool
+	}{
+		{},
+		{idleTimeout: 2 * time.Minute, maxLifetime: 2 * time.Hour},
+		{idleTimeout: 30 * time.Second, wantReason: metrics.ReapIdleTimeout, wantExpired: true},
+		{maxLifetime: 30 * time.Minute, wantReason: metrics.ReapMaxLifetime, wantExpired: true},
+	}
+	for _, tc := range testCases {
+		reason, expired := ctx.expired(now, tc.idleTimeout, tc.maxLifetime)
+		if reason != tc.wantReason || expired != tc.wantExpired {
+			t.Errorf("idleTimeout=%v maxLifetime=%v: expect (%q, %v); got (%q, %v)", tc.idleTimeout, tc.maxLifetime, tc.wantReason, tc.wantExpired, reason, expired)
+		}
+	}
+}
+
 // fakeStream implements AgentService_ConnectClient
 type fakeStream struct {
 	grpc.ClientStream
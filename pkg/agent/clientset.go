@@ -17,8 +17,12 @@ limitations under the License.
 package agent
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -33,11 +37,34 @@ type ClientSet struct {
 	clients map[string]*AgentClient // map between serverID and the client
 	// connects to this server.
 
-	agentID     string // ID of this agent
-	address     string // proxy server address. Assuming HA proxy server
-	serverCount int    // number of proxy server instances, should be 1
-	// unless it is an HA server. Initialized when the ClientSet creates
-	// the first client.
+	agentID string // ID of this agent
+	address string // proxy server address. Assuming HA proxy server
+	// addresses, if set, are the addresses of every proxy server, dialed
+	// instead of address.
+	addresses []string
+	// resolveAddress is set to dial every address the host of address
+	// resolves to instead of address.
+	resolveAddress bool
+	// lookupIP resolves the host of address. It is the lookup of the
+	// default resolver, except in tests.
+	lookupIP func(ctx context.Context, host string) ([]net.IPAddr, error)
+	// duplicates maps the proxy server addresses to the ID of the server
+	// they lead to, when the agent is connected to that server through
+	// another address.
+	duplicates map[string]string
+	// countReadAt is when the server count was last read.
+	countReadAt time.Time
+	// countRefreshInterval is how often the ClientSet connects to the proxy
+	// server again to read the server count, when connected to as many
+	// proxy servers as the count. 0 disables it.
+	countRefreshInterval time.Duration
+	// expected maps the IDs of the proxy servers the agent is connected
+	// to to the server count each advertised when a stream to it was last
+	// (re)connected. IDs are dropped with their client.
+	expected    map[string]int
+	serverCount int // number of proxy server instances, should be 1
+	// unless it is an HA server. Updated, under mu, to the count advertised
+	// by the proxy server every time a stream connects.
 	syncInterval time.Duration // The interval by which the agent
 	// periodically checks that it has connections to all instances of the
 	// proxy server.
@@ -46,8 +73,25 @@ type ClientSet struct {
 	dialOptions []grpc.DialOption
 	// file path contains service account token
 	serviceAccountTokenPath string
+	// tokenRefreshInterval is how often the token is sent again to the
+	// proxy servers. 0 disables it.
+	tokenRefreshInterval time.Duration
+	// connLimit bounds the concurrent connections served by all the
+	// clients. nil means unlimited.
+	connLimit *connectionLimit
+	// idleTimeout and maxLifetime bound how long connections to the node
+	// network are kept. Zero disables the corresponding limit.
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	// dialer dials the destinations of dial requests. nil means net.Dial.
+	dialer Dialer
+	// dialTimeout bounds the dial of a destination. Zero means no timeout.
+	dialTimeout time.Duration
 	// channel to signal shutting down the client set. Primarily for test.
 	stopCh <-chan struct{}
+	// draining is set, atomically, once Drain is called: no new client is
+	// connected.
+	draining int32
 }
 
 func (cs *ClientSet) ClientsCount() int {
@@ -95,6 +139,50 @@ func (cs *ClientSet) AddClient(serverID string, c *AgentClient) error {
 	return cs.addClientLocked(serverID, c)
 }
 
+// ServerIDs returns the sorted IDs of the proxy servers the agent stays
+// connected to, leaving out the ones it is leaving.
+func (cs *ClientSet) ServerIDs() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var ids []string
+	for _, c := range cs.activeClientsLocked() {
+		ids = append(ids, c.serverID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// activeClientsLocked returns the clients whose proxy server did not go
+// away.
+func (cs *ClientSet) activeClientsLocked() []*AgentClient {
+	ret := make([]*AgentClient, 0, len(cs.clients))
+	for _, c := range cs.clients {
+		if !c.isGoingAway() {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func (cs *ClientSet) activeClientsCount() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.activeClientsLocked())
+}
+
+// removeClient closes and removes c, unless another client connecting to
+// the same proxy server replaced it.
+func (cs *ClientSet) removeClient(c *AgentClient) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.clients[c.serverID] != c {
+		return
+	}
+	c.Close()
+	delete(cs.clients, c.serverID)
+	delete(cs.expected, c.serverID)
+}
+
 func (cs *ClientSet) RemoveClient(serverID string) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
@@ -103,6 +191,39 @@ func (cs *ClientSet) RemoveClient(serverID string) {
 	}
 	cs.clients[serverID].Close()
 	delete(cs.clients, serverID)
+	delete(cs.expected, serverID)
+}
+
+// recordServerCount records the server count advertised by the proxy server
+// serverID when a stream to it connected. The latest count advertised by
+// any proxy server becomes the server count, and the IDs of the proxy
+// servers the agent is no longer connected to are dropped.
+func (cs *ClientSet) recordServerCount(serverID string, serverCount int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.serverCount != 0 && cs.serverCount != serverCount {
+		klog.V(2).InfoS("Server count change suggestion by server",
+			"current", cs.serverCount, "serverID", serverID, "actual", serverCount)
+	}
+	cs.serverCount = serverCount
+	cs.countReadAt = time.Now()
+	cs.expected[serverID] = serverCount
+	for id := range cs.expected {
+		if !cs.hasIDLocked(id) {
+			delete(cs.expected, id)
+		}
+	}
+}
+
+// needsConnect returns whether the ClientSet should connect to the proxy
+// server: to reach the server count, or to read it again.
+func (cs *ClientSet) needsConnect() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.serverCount == 0 || len(cs.activeClientsLocked()) < cs.serverCount {
+		return true
+	}
+	return cs.countRefreshInterval > 0 && time.Since(cs.countReadAt) >= cs.countRefreshInterval
 }
 
 type ClientSetConfig struct {
@@ -112,6 +233,40 @@ type ClientSetConfig struct {
 	ProbeInterval           time.Duration
 	DialOptions             []grpc.DialOption
 	ServiceAccountTokenPath string
+	// TokenRefreshInterval is how often the token read from
+	// ServiceAccountTokenPath is sent again to the proxy servers, which
+	// validate it again. 0 disables it.
+	TokenRefreshInterval time.Duration
+	// MaxConnections is the maximum number of concurrent connections the
+	// agent serves. 0 means unlimited.
+	MaxConnections int
+	// IdleTimeout closes connections without data in either direction for
+	// this long. 0 disables it.
+	IdleTimeout time.Duration
+	// MaxConnectionLifetime closes connections older than this. 0 disables
+	// it.
+	MaxConnectionLifetime time.Duration
+	// Dialer dials the destinations of dial requests, e.g. a Resolver or an
+	// EgressDialer. nil means net.Dial.
+	Dialer Dialer
+	// DialTimeout bounds the dial of a destination, including its DNS
+	// lookup and the egress proxy. 0 means no timeout.
+	DialTimeout time.Duration
+	// Addresses, if set, are the host:port of every proxy server. The agent
+	// connects to each of them directly instead of to Address, and
+	// connects once to the proxy servers reachable through several
+	// addresses.
+	Addresses []string
+	// ResolveAddress, if set, resolves the host of Address to all its A
+	// and AAAA records at every sync, and the agent connects to each of
+	// them directly.
+	ResolveAddress bool
+	// ServerCountRefreshInterval is how often the agent connects through
+	// Address again to read the server count, once connected to as many
+	// proxy servers as the count. Each such connection is authenticated
+	// by the proxy server, then closed. 0 disables it: the count is read
+	// only when a stream connects.
+	ServerCountRefreshInterval time.Duration
 }
 
 func (cc *ClientSetConfig) NewAgentClientSet(stopCh <-chan struct{}) *ClientSet {
@@ -119,16 +274,28 @@ func (cc *ClientSetConfig) NewAgentClientSet(stopCh <-chan struct{}) *ClientSet
 		clients:                 make(map[string]*AgentClient),
 		agentID:                 cc.AgentID,
 		address:                 cc.Address,
+		addresses:               cc.Addresses,
+		resolveAddress:          cc.ResolveAddress,
+		lookupIP:                net.DefaultResolver.LookupIPAddr,
+		duplicates:              make(map[string]string),
+		expected:                make(map[string]int),
+		countRefreshInterval:    cc.ServerCountRefreshInterval,
 		syncInterval:            cc.SyncInterval,
 		probeInterval:           cc.ProbeInterval,
 		dialOptions:             cc.DialOptions,
 		serviceAccountTokenPath: cc.ServiceAccountTokenPath,
+		tokenRefreshInterval:    cc.TokenRefreshInterval,
+		connLimit:               newConnectionLimit(cc.MaxConnections),
+		idleTimeout:             cc.IdleTimeout,
+		maxLifetime:             cc.MaxConnectionLifetime,
+		dialer:                  cc.Dialer,
+		dialTimeout:             cc.DialTimeout,
 		stopCh:                  stopCh,
 	}
 }
 
-func (cs *ClientSet) newAgentClient() (*AgentClient, int, error) {
-	return newAgentClient(cs.address, cs.agentID, cs, cs.dialOptions...)
+func (cs *ClientSet) newAgentClient(address string) (*AgentClient, int, error) {
+	return newAgentClient(address, cs.agentID, cs, cs.dialOptions...)
 }
 
 func (cs *ClientSet) resetBackoff() *wait.Backoff {
@@ -141,7 +308,7 @@ func (cs *ClientSet) resetBackoff() *wait.Backoff {
 	}
 }
 
-// sync makes sure that #clients >= #proxy servers
+// sync makes sure that #clients == #proxy servers
 func (cs *ClientSet) sync() {
 	defer cs.shutdown()
 	backoff := cs.resetBackoff()
@@ -164,21 +331,25 @@ func (cs *ClientSet) sync() {
 }
 
 func (cs *ClientSet) syncOnce() error {
-	if cs.serverCount != 0 && cs.ClientsCount() >= cs.serverCount {
+	if atomic.LoadInt32(&cs.draining) != 0 {
 		return nil
 	}
-	c, serverCount, err := cs.newAgentClient()
+	if len(cs.addresses) > 0 || cs.resolveAddress {
+		return cs.syncAddresses()
+	}
+	// The clients beyond the server count read by this sync are shed.
+	defer cs.shedClients()
+	if !cs.needsConnect() {
+		return nil
+	}
+	c, serverCount, err := cs.newAgentClient(cs.address)
 	if err != nil {
 		return err
 	}
-	if cs.serverCount != 0 && cs.serverCount != serverCount {
-		klog.V(2).InfoS("Server count change suggestion by server",
-			"current", cs.serverCount, "serverID", c.serverID, "actual", serverCount)
-
-	}
-	cs.serverCount = serverCount
-	if err := cs.AddClient(c.serverID, c); err != nil {
-		klog.ErrorS(err, "closing connection failure when adding a client")
+	err = cs.AddClient(c.serverID, c)
+	cs.recordServerCount(c.serverID, serverCount)
+	if err != nil {
+		klog.V(4).InfoS("Proxy server already connected, read the server count", "serverID", c.serverID, "serverCount", serverCount)
 		c.Close()
 		return nil
 	}
@@ -187,15 +358,249 @@ func (cs *ClientSet) syncOnce() error {
 	return nil
 }
 
+// resolveTimeout bounds the lookup of the proxy server addresses.
+const resolveTimeout = 10 * time.Second
+
+// serverAddresses returns the addresses of every proxy server.
+func (cs *ClientSet) serverAddresses() ([]string, error) {
+	if !cs.resolveAddress {
+		return cs.addresses, nil
+	}
+	host, port, err := net.SplitHostPort(cs.address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := cs.lookupIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the proxy server host %q: %v", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("proxy server host %q resolves to no address", host)
+	}
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, ip := range ips {
+		address := net.JoinHostPort(ip.String(), port)
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// connectedTo returns whether a client connects through address, or
+// through another address to the proxy server address leads to.
+func (cs *ClientSet) connectedTo(address string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, c := range cs.clients {
+		if c.address == address {
+			return true
+		}
+	}
+	if serverID, ok := cs.duplicates[address]; ok {
+		if cs.hasIDLocked(serverID) {
+			return true
+		}
+		delete(cs.duplicates, address)
+	}
+	return false
+}
+
+// syncAddresses connects to the proxy server addresses no client connects
+// to, and leaves the addresses that are gone. The proxy servers reachable
+// through several addresses are connected once.
+func (cs *ClientSet) syncAddresses() error {
+	addresses, err := cs.serverAddresses()
+	if err != nil {
+		return err
+	}
+	cs.leaveAddressesExcept(addresses)
+
+	var failed int
+	for _, address := range addresses {
+		if cs.connectedTo(address) {
+			continue
+		}
+		c, serverCount, err := cs.newAgentClient(address)
+		if err != nil {
+			klog.ErrorS(err, "cannot connect to proxy server", "address", address)
+			failed++
+			continue
+		}
+		cs.mu.Lock()
+		err = cs.addClientLocked(c.serverID, c)
+		if err != nil {
+			cs.duplicates[address] = c.serverID
+		}
+		cs.mu.Unlock()
+		cs.recordServerCount(c.serverID, serverCount)
+		if err != nil {
+			klog.V(2).InfoS("Proxy server already connected through another address", "address", address, "serverID", c.serverID)
+			c.Close()
+			continue
+		}
+		klog.V(2).InfoS("sync added client connecting to proxy server", "serverID", c.serverID, "address", address)
+		go c.Serve()
+	}
+	if failed > 0 {
+		return fmt.Errorf("cannot connect to %d of %d proxy server addresses", failed, len(addresses))
+	}
+	return nil
+}
+
+// leaveAddressesExcept leaves the proxy servers connected through other
+// addresses than addresses.
+func (cs *ClientSet) leaveAddressesExcept(addresses []string) {
+	keep := make(map[string]bool)
+	for _, address := range addresses {
+		keep[address] = true
+	}
+	cs.mu.Lock()
+	var gone []*AgentClient
+	for _, c := range cs.activeClientsLocked() {
+		if !keep[c.address] {
+			gone = append(gone, c)
+		}
+	}
+	for address := range cs.duplicates {
+		if !keep[address] {
+			delete(cs.duplicates, address)
+		}
+	}
+	cs.mu.Unlock()
+	for _, c := range gone {
+		klog.V(2).InfoS("Leaving proxy server whose address is gone", "serverID", c.serverID, "address", c.address)
+		if c.conn.GetState() != connectivity.Ready {
+			cs.removeClient(c)
+			continue
+		}
+		c.goAway("proxy server address is gone")
+		go c.leave()
+	}
+}
+
+// shedClients leaves the proxy servers beyond the server count, e.g. after
+// the proxy servers were scaled down. The clients to keep are, in order,
+// the healthy ones, the ones whose proxy server advertised the latest
+// server count when its stream last connected, and the ones serving the
+// most connections. Unhealthy
+// clients are closed; the others are sent a GOAWAY and leave once their
+// connections are done.
+func (cs *ClientSet) shedClients() {
+	cs.mu.Lock()
+	clients := cs.activeClientsLocked()
+	serverCount := cs.serverCount
+	surplus := len(clients) - serverCount
+	if serverCount == 0 || surplus <= 0 {
+		cs.mu.Unlock()
+		return
+	}
+	type candidate struct {
+		client      *AgentClient
+		healthy     bool
+		latest      bool
+		connections int
+	}
+	candidates := make([]candidate, len(clients))
+	for i, c := range clients {
+		candidates[i] = candidate{
+			client:      c,
+			healthy:     c.conn.GetState() == connectivity.Ready,
+			latest:      cs.expected[c.serverID] == serverCount,
+			connections: len(c.connManager.List()),
+		}
+	}
+	cs.mu.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.latest != b.latest {
+			return a.latest
+		}
+		if a.connections != b.connections {
+			return a.connections > b.connections
+		}
+		return a.client.serverID < b.client.serverID
+	})
+	for _, c := range candidates[len(candidates)-surplus:] {
+		klog.V(2).InfoS("Leaving proxy server beyond the server count", "serverID", c.client.serverID, "serverCount", serverCount, "healthy", c.healthy)
+		if !c.healthy {
+			cs.removeClient(c.client)
+			continue
+		}
+		c.client.goAway("agent is connected to more proxy servers than the server count")
+		go c.client.leave()
+	}
+}
+
 func (cs *ClientSet) Serve() {
 	go cs.sync()
 }
 
+// Ready reports the agent as not ready once it is draining.
+func (cs *ClientSet) Ready() (bool, string) {
+	if atomic.LoadInt32(&cs.draining) != 0 {
+		return false, "agent is draining"
+	}
+	return true, ""
+}
+
+// Drain prepares the agent for shutting down. Every proxy server is sent a
+// GOAWAY so that it stops routing new connections to the agent, then Drain
+// waits for the established connections to finish and closes the streams.
+// The connections still open when ctx is done are closed with the streams,
+// and the error of ctx is returned.
+func (cs *ClientSet) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&cs.draining, 1)
+	for _, c := range cs.listClients() {
+		c.goAway("agent is shutting down")
+	}
+	defer cs.shutdown()
+
+	ticker := time.NewTicker(goAwayPollInterval)
+	defer ticker.Stop()
+	for {
+		var connections int
+		for _, c := range cs.listClients() {
+			connections += len(c.connManager.List())
+		}
+		if connections == 0 {
+			klog.V(1).Infoln("Agent drained")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			klog.V(1).InfoS("Closing connections left after drain timeout", "count", connections)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cs *ClientSet) listClients() []*AgentClient {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ret := make([]*AgentClient, 0, len(cs.clients))
+	for _, c := range cs.clients {
+		ret = append(ret, c)
+	}
+	return ret
+}
+
 func (cs *ClientSet) shutdown() {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	for serverID, client := range cs.clients {
 		client.Close()
 		delete(cs.clients, serverID)
+		delete(cs.expected, serverID)
 	}
 }
@@ -0,0 +1,295 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func TestShedClients(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	cs := &ClientSet{clients: make(map[string]*AgentClient), expected: make(map[string]int)}
+	defer cs.shutdown()
+	servers := make(map[string]agent.AgentService_ConnectClient)
+	addClient := func(serverID string, healthy bool, serverCount int) *AgentClient {
+		var conn *grpc.ClientConn
+		var err error
+		if healthy {
+			conn, err = grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+		} else {
+			conn, err = grpc.Dial("127.0.0.1:0", grpc.WithInsecure())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &AgentClient{
+			connManager: newConnectionManager(),
+			cs:          cs,
+			serverID:    serverID,
+			serverCount: serverCount,
+			conn:        conn,
+			stopCh:      make(chan struct{}),
+		}
+		c.stream, servers[serverID] = pipe()
+		if err := cs.AddClient(serverID, c); err != nil {
+			t.Fatal(err)
+		}
+		cs.expected[serverID] = serverCount
+		return c
+	}
+	expectGoAway := func(serverID string) {
+		t.Helper()
+		pkt, _ := servers[serverID].Recv()
+		if pkt == nil || pkt.Type != client.PacketType_GOAWAY {
+			t.Errorf("expected a GOAWAY to %s, got %+v", serverID, pkt)
+		}
+	}
+
+	addClient("a", false, 2)
+	addClient("b", true, 3)
+	addClient("c", true, 2)
+	addClient("d", true, 2).connManager.Add(1, &connContext{})
+
+	// The unhealthy client is closed, the client of the server advertising
+	// a stale count leaves.
+	cs.serverCount = 2
+	cs.shedClients()
+	if got, want := cs.ServerIDs(), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to stay connected to %v, got %v", want, got)
+	}
+	if cs.HasID("a") {
+		t.Errorf("expected the unhealthy client to be closed")
+	}
+	expectGoAway("b")
+	deadline := time.Now().Add(time.Second)
+	for cs.HasID("b") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client without connections to leave")
+		}
+		time.Sleep(goAwayPollInterval)
+	}
+
+	// The client serving connections is kept.
+	cs.serverCount = 1
+	cs.shedClients()
+	if got, want := cs.ServerIDs(), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to stay connected to %v, got %v", want, got)
+	}
+	expectGoAway("c")
+
+	// Nothing is shed within the count.
+	cs.shedClients()
+	if !cs.HasID("d") || len(cs.ServerIDs()) != 1 {
+		t.Errorf("expected to stay connected to d, got %v", cs.ServerIDs())
+	}
+}
+
+// fakeProxyServer accepts the agents with its ID and server count.
+type fakeProxyServer struct {
+	serverID    string
+	serverCount int32 // accessed atomically
+}
+
+func (s *fakeProxyServer) setServerCount(serverCount int) {
+	atomic.StoreInt32(&s.serverCount, int32(serverCount))
+}
+
+func (s *fakeProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
+	serverCount := strconv.Itoa(int(atomic.LoadInt32(&s.serverCount)))
+	if err := stream.SendHeader(metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, serverCount)); err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			return nil
+		}
+	}
+}
+
+// runFakeProxyServer serves a fakeProxyServer advertising a server count of
+// 1 and listening on address. It returns the address listened on and the
+// function stopping the server.
+func runFakeProxyServer(t *testing.T, serverID, address string) (string, func()) {
+	return serveFakeProxyServer(t, &fakeProxyServer{serverID: serverID, serverCount: 1}, address)
+}
+
+func serveFakeProxyServer(t *testing.T, s *fakeProxyServer, address string) (string, func()) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	agent.RegisterAgentServiceServer(grpcServer, s)
+	go grpcServer.Serve(lis)
+	return lis.Addr().String(), grpcServer.Stop
+}
+
+func TestSyncServerCountShrinks(t *testing.T) {
+	server1 := &fakeProxyServer{serverID: "server1", serverCount: 2}
+	address1, stop1 := serveFakeProxyServer(t, server1, "127.0.0.1:0")
+	defer stop1()
+	server2 := &fakeProxyServer{serverID: "server2", serverCount: 2}
+	address2, stop2 := serveFakeProxyServer(t, server2, "127.0.0.1:0")
+	defer stop2()
+
+	cc := &ClientSetConfig{
+		Address:     address1,
+		AgentID:     "agent1",
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+	}
+	cs := cc.NewAgentClientSet(make(chan struct{}))
+	defer cs.shutdown()
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	// The load balancer in front of the proxy servers picks server2.
+	cs.address = address2
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cs.ServerIDs(), []string{"server1", "server2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected to connect to %v, got %v", want, got)
+	}
+
+	// Connected to as many servers, the count is not read again by default.
+	server1.setServerCount(1)
+	server2.setServerCount(1)
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cs.ServerIDs(), []string{"server1", "server2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected to stay connected to %v, got %v", want, got)
+	}
+
+	// With a refresh interval, the count is read again.
+	cs.countRefreshInterval = time.Nanosecond
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cs.ServerIDs(), []string{"server2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to stay connected to %v, got %v", want, got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for cs.HasID("server1") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the client of the server advertising a stale count to leave")
+		}
+		time.Sleep(goAwayPollInterval)
+	}
+}
+
+func TestSyncAddresses(t *testing.T) {
+	address1, stop1 := runFakeProxyServer(t, "server1", "127.0.0.1:0")
+	defer stop1()
+	_, port, _ := net.SplitHostPort(address1)
+	address2, stop2 := runFakeProxyServer(t, "server2", "127.0.0.1:0")
+	defer stop2()
+
+	cc := &ClientSetConfig{
+		AgentID:     "agent1",
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		// server1 twice, through the two host names of 127.0.0.1.
+		Addresses: []string{address1, address2, net.JoinHostPort("localhost", port)},
+	}
+	cs := cc.NewAgentClientSet(make(chan struct{}))
+	defer cs.shutdown()
+
+	// The servers are connected at once, despite the server count.
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cs.ServerIDs(), []string{"server1", "server2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to connect to %v, got %v", want, got)
+	}
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cs.ClientsCount(); got != 2 {
+		t.Errorf("expected the duplicate address not to be connected, got %d clients", got)
+	}
+
+	// server2 is removed from the addresses.
+	cs.addresses = cs.addresses[:1]
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cs.ServerIDs(), []string{"server1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to stay connected to %v, got %v", want, got)
+	}
+
+	// An address failing to connect is reported.
+	cs.addresses = append(cs.addresses, "127.0.0.1:1")
+	if err := cs.syncOnce(); err == nil {
+		t.Errorf("expected an error connecting to a closed port")
+	}
+}
+
+func TestSyncResolvedAddresses(t *testing.T) {
+	address1, stop1 := runFakeProxyServer(t, "server1", "127.0.0.1:0")
+	defer stop1()
+	_, port, _ := net.SplitHostPort(address1)
+	_, stop2 := runFakeProxyServer(t, "server2", net.JoinHostPort("127.0.0.2", port))
+	defer stop2()
+
+	cc := &ClientSetConfig{
+		Address:        net.JoinHostPort("proxy.example.com", port),
+		ResolveAddress: true,
+		AgentID:        "agent1",
+		DialOptions:    []grpc.DialOption{grpc.WithInsecure()},
+	}
+	cs := cc.NewAgentClientSet(make(chan struct{}))
+	defer cs.shutdown()
+	ips := []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}
+	cs.lookupIP = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host != "proxy.example.com" {
+			return nil, fmt.Errorf("unexpected lookup of %q", host)
+		}
+		return ips, nil
+	}
+
+	if err := cs.syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cs.ServerIDs(), []string{"server1", "server2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected to connect to %v, got %v", want, got)
+	}
+
+	ips = nil
+	if err := cs.syncOnce(); err == nil {
+		t.Errorf("expected an error when the host resolves to no address")
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"k8s.io/klog/v2"
+)
+
+// Dialer dials the destinations of dial requests.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// EgressAction tells whether a dial goes through the egress proxy.
+type EgressAction string
+
+const (
+	// EgressProxy sends the dial through the egress proxy.
+	EgressProxy EgressAction = "proxy"
+	// EgressDirect dials the destination directly.
+	EgressDirect EgressAction = "direct"
+)
+
+// EgressRule selects the action for the destinations matching Pattern.
+// Pattern is one of:
+//   - "*", matching every destination,
+//   - an IP address or a CIDR, matching IP destinations,
+//   - ".example.com" or "*.example.com", matching the subdomains of
+//     example.com,
+//   - a host name, matching it exactly.
+type EgressRule struct {
+	Action  EgressAction
+	Pattern string
+}
+
+// ParseEgressRule parses a rule in the "action=pattern" format, e.g.
+// "direct=10.0.0.0/8".
+func ParseEgressRule(s string) (EgressRule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return EgressRule{}, fmt.Errorf("invalid egress rule %q, expected action=pattern", s)
+	}
+	rule := EgressRule{Action: EgressAction(parts[0]), Pattern: parts[1]}
+	if rule.Action != EgressProxy && rule.Action != EgressDirect {
+		return EgressRule{}, fmt.Errorf("invalid egress rule %q, action must be %q or %q", s, EgressProxy, EgressDirect)
+	}
+	if strings.Contains(rule.Pattern, "/") {
+		if _, _, err := net.ParseCIDR(rule.Pattern); err != nil {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: %v", s, err)
+		}
+	}
+	return rule, nil
+}
+
+func (r *EgressRule) matches(host string) bool {
+	pattern := strings.ToLower(r.Pattern)
+	host = canonicalHost(host)
+	if pattern == "*" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			return cidr.Contains(ip)
+		}
+		if p := net.ParseIP(pattern); p != nil {
+			return p.Equal(ip)
+		}
+		return false
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[1:]
+	}
+	if strings.HasPrefix(pattern, ".") {
+		return strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+// EgressProxyConfig configures the upstream proxy through which the agent
+// reaches some destinations.
+type EgressProxyConfig struct {
+	// URL of the proxy, with the "http" or "socks5" scheme, e.g.
+	// "socks5://10.0.0.1:1080".
+	URL string
+	// CredentialsFile, if non-empty, contains the "username:password"
+	// used to authenticate to the proxy. It is read on every dial, so that
+	// the credentials can be rotated.
+	CredentialsFile string
+	// Rules are evaluated in order, the first rule matching the destination
+	// host decides whether the dial goes through the proxy.
+	Rules []EgressRule
+	// DefaultAction applies to the destinations matching no rule. Empty
+	// means EgressProxy.
+	DefaultAction EgressAction
+}
+
+// EgressDialer dials destinations either directly or through an upstream
+// HTTP CONNECT or SOCKS5 proxy, depending on the rules.
+type EgressDialer struct {
+	proxyURL        *url.URL
+	credentialsFile string
+
+	mu            sync.RWMutex // protects rules and defaultAction
+	rules         []EgressRule
+	defaultAction EgressAction
+	// direct dials the destinations that bypass the proxy, and the proxy
+	// itself.
+	direct Dialer
+}
+
+// NewEgressDialer creates an EgressDialer. direct is used for the
+// destinations bypassing the proxy and to connect to the proxy.
+func NewEgressDialer(c *EgressProxyConfig, direct Dialer) (*EgressDialer, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress proxy URL %q: %v", c.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported egress proxy scheme %q, must be http or socks5", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("egress proxy URL %q must have a port", c.URL)
+	}
+	defaultAction := c.DefaultAction
+	if defaultAction == "" {
+		defaultAction = EgressProxy
+	}
+	if direct == nil {
+		direct = &net.Dialer{}
+	}
+	return &EgressDialer{
+		proxyURL:        u,
+		credentialsFile: c.CredentialsFile,
+		rules:           c.Rules,
+		defaultAction:   defaultAction,
+		direct:          direct,
+	}, nil
+}
+
+// SetRules replaces the rules and the default action, e.g. when the
+// configuration is reloaded. The established connections are kept.
+func (d *EgressDialer) SetRules(rules []EgressRule, defaultAction EgressAction) {
+	if defaultAction == "" {
+		defaultAction = EgressProxy
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = rules
+	d.defaultAction = defaultAction
+}
+
+// action returns whether the dial to address goes through the proxy.
+func (d *EgressDialer) action(address string) EgressAction {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for i := range d.rules {
+		if d.rules[i].matches(host) {
+			return d.rules[i].Action
+		}
+	}
+	return d.defaultAction
+}
+
+// credentials returns the proxy credentials, from the credentials file if
+// set, else from the proxy URL.
+func (d *EgressDialer) credentials() (*url.Userinfo, error) {
+	if d.credentialsFile == "" {
+		return d.proxyURL.User, nil
+	}
+	content, err := ioutil.ReadFile(d.credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read egress proxy credentials: %v", err)
+	}
+	line := strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("egress proxy credentials file %s must contain username:password", d.credentialsFile)
+	}
+	return url.UserPassword(parts[0], parts[1]), nil
+}
+
+// DialContext dials address, through the proxy if the rules say so.
+func (d *EgressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.action(address) == EgressDirect {
+		return d.direct.DialContext(ctx, network, address)
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("cannot dial %s network through the egress proxy", network)
+	}
+	user, err := d.credentials()
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).InfoS("Dial through egress proxy", "address", address, "proxy", d.proxyURL.Host)
+	if d.proxyURL.Scheme == "socks5" {
+		return d.dialSOCKS5(ctx, user, address)
+	}
+	return d.dialHTTPConnect(ctx, user, address)
+}
+
+// contextDialer adapts a Dialer to the proxy package.
+type contextDialer struct {
+	Dialer
+}
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *EgressDialer) dialSOCKS5(ctx context.Context, user *url.Userinfo, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", d.proxyURL.Host, auth, contextDialer{d.direct})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+func (d *EgressDialer) dialHTTPConnect(ctx context.Context, user *url.Userinfo, address string) (net.Conn, error) {
+	conn, err := d.direct.DialContext(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to egress proxy %s: %v", d.proxyURL.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to egress proxy: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from egress proxy: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("egress proxy refused CONNECT to %s: %s", address, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns the bytes read ahead by r before reading from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
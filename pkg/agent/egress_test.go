@@ -0,0 +1,368 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// echoServer accepts connections and echoes what it reads.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// fakeEgressProxy is an HTTP CONNECT or SOCKS5 proxy recording the
+// destinations it is asked to connect to.
+type fakeEgressProxy struct {
+	ln       net.Listener
+	user     string
+	password string
+
+	mu           sync.Mutex
+	destinations []string
+}
+
+func newFakeEgressProxy(t *testing.T, socks5 bool, user, password string) *fakeEgressProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeEgressProxy{ln: ln, user: user, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if socks5 {
+				go p.serveSOCKS5(conn)
+			} else {
+				go p.serveHTTPConnect(conn)
+			}
+		}
+	}()
+	return p
+}
+
+func (p *fakeEgressProxy) close() {
+	p.ln.Close()
+}
+
+func (p *fakeEgressProxy) dialed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.destinations...)
+}
+
+func (p *fakeEgressProxy) connect(address string) (net.Conn, error) {
+	p.mu.Lock()
+	p.destinations = append(p.destinations, address)
+	p.mu.Unlock()
+	return net.Dial("tcp", address)
+}
+
+func proxyPipe(client net.Conn, r io.Reader, upstream net.Conn) {
+	go func() {
+		io.Copy(upstream, r)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+func (p *fakeEgressProxy) serveHTTPConnect(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if p.user != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.password))
+		if req.Header.Get("Proxy-Authorization") != expected {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			conn.Close()
+			return
+		}
+	}
+	upstream, err := p.connect(req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	proxyPipe(conn, br, upstream)
+}
+
+func (p *fakeEgressProxy) serveSOCKS5(conn net.Conn) {
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	br := bufio.NewReader(conn)
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+	if p.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		// RFC 1929 username/password negotiation.
+		ver := make([]byte, 2)
+		if _, err := io.ReadFull(br, ver); err != nil {
+			return
+		}
+		user := make([]byte, ver[1])
+		io.ReadFull(br, user)
+		plen, _ := br.ReadByte()
+		password := make([]byte, plen)
+		io.ReadFull(br, password)
+		if string(user) != p.user || string(password) != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 3:
+		l, _ := br.ReadByte()
+		name := make([]byte, l)
+		io.ReadFull(br, name)
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	}
+	portBytes := make([]byte, 2)
+	io.ReadFull(br, portBytes)
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	upstream, err := p.connect(address)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	c := conn
+	conn = nil
+	proxyPipe(c, br, upstream)
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected hello, got %q", buf)
+	}
+}
+
+func TestParseEgressRule(t *testing.T) {
+	testcases := []struct {
+		rule    string
+		host    string
+		matches bool
+		wantErr bool
+	}{
+		{rule: "direct=*", host: "example.com", matches: true},
+		{rule: "direct=10.0.0.0/8", host: "10.1.2.3", matches: true},
+		{rule: "direct=10.0.0.0/8", host: "192.168.0.1", matches: false},
+		{rule: "direct=10.0.0.0/8", host: "example.com", matches: false},
+		{rule: "proxy=10.1.2.3", host: "10.1.2.3", matches: true},
+		{rule: "proxy=.example.com", host: "api.example.com", matches: true},
+		{rule: "proxy=*.example.com", host: "api.Example.com.", matches: true},
+		{rule: "proxy=*.example.com", host: "example.com", matches: false},
+		{rule: "proxy=example.com", host: "example.com", matches: true},
+		{rule: "proxy=example.com", host: "api.example.com", matches: false},
+		{rule: "proxy", wantErr: true},
+		{rule: "reject=*", wantErr: true},
+		{rule: "direct=10.0.0.0/99", wantErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.rule+"/"+tc.host, func(t *testing.T) {
+			rule, err := ParseEgressRule(tc.rule)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q", tc.rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.matches(tc.host); got != tc.matches {
+				t.Errorf("expected %q matching %q to be %v", tc.rule, tc.host, tc.matches)
+			}
+		})
+	}
+}
+
+func TestEgressDialerHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := newFakeEgressProxy(t, false, "agent", "secret")
+	defer proxy.close()
+
+	d, err := NewEgressDialer(&EgressProxyConfig{URL: fmt.Sprintf("http://agent:secret@%s", proxy.ln.Addr())}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if dialed := proxy.dialed(); len(dialed) != 1 || dialed[0] != echo.Addr().String() {
+		t.Errorf("expected the proxy to dial %s, got %v", echo.Addr(), dialed)
+	}
+
+	d, err = NewEgressDialer(&EgressProxyConfig{URL: fmt.Sprintf("http://%s", proxy.ln.Addr())}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Error("expected an error dialing without proxy credentials")
+	}
+}
+
+func TestEgressDialerSOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := newFakeEgressProxy(t, true, "agent", "secret")
+	defer proxy.close()
+
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("agent:secret\n")
+	f.Close()
+
+	d, err := NewEgressDialer(&EgressProxyConfig{
+		URL:             fmt.Sprintf("socks5://%s", proxy.ln.Addr()),
+		CredentialsFile: f.Name(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	// The credentials are read again on every dial.
+	ioutil.WriteFile(f.Name(), []byte("agent:wrong\n"), 0600)
+	if _, err := d.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Error("expected an error dialing with rotated wrong credentials")
+	}
+}
+
+func TestEgressDialerRules(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := newFakeEgressProxy(t, false, "", "")
+	defer proxy.close()
+
+	d, err := NewEgressDialer(&EgressProxyConfig{
+		URL:           fmt.Sprintf("http://%s", proxy.ln.Addr()),
+		Rules:         []EgressRule{{Action: EgressDirect, Pattern: "127.0.0.0/8"}},
+		DefaultAction: EgressProxy,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &AgentClient{dialer: d}
+	conn, err := ac.dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if dialed := proxy.dialed(); len(dialed) != 0 {
+		t.Errorf("expected a direct dial, got proxied dials to %v", dialed)
+	}
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	conn, err = ac.dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if dialed := proxy.dialed(); len(dialed) != 1 || dialed[0] != net.JoinHostPort("localhost", port) {
+		t.Errorf("expected the proxy to dial localhost:%s, got %v", port, dialed)
+	}
+}
+
+func TestNewEgressDialerInvalid(t *testing.T) {
+	for _, u := range []string{"ftp://127.0.0.1:21", "http://127.0.0.1", "://"} {
+		if _, err := NewEgressDialer(&EgressProxyConfig{URL: u}, nil); err == nil {
+			t.Errorf("expected an error for egress proxy URL %q", u)
+		}
+	}
+}
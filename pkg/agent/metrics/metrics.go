@@ -24,6 +24,10 @@ import (
 
 type Direction string
 
+// ReapReason is the reason why an inactive or long-lived connection was
+// closed by the agent.
+type ReapReason string
+
 const (
 	namespace = "konnectivity_network_proxy"
 	subsystem = "agent"
@@ -34,6 +38,13 @@ const (
 	// DirectionFromServer indicates that the agent attempts to receive a
 	// packet from the proxy server.
 	DirectionFromServer Direction = "from_server"
+
+	// ReapIdleTimeout indicates that no data was sent over the connection,
+	// in either direction, for longer than the idle timeout.
+	ReapIdleTimeout ReapReason = "idle_timeout"
+	// ReapMaxLifetime indicates that the connection lived longer than the
+	// maximum connection lifetime.
+	ReapMaxLifetime ReapReason = "max_lifetime"
 )
 
 var (
@@ -46,8 +57,10 @@ var (
 
 // AgentMetrics includes all the metrics of the proxy agent.
 type AgentMetrics struct {
-	latencies *prometheus.HistogramVec
-	failures  *prometheus.CounterVec
+	latencies  *prometheus.HistogramVec
+	failures   *prometheus.CounterVec
+	reaped     *prometheus.CounterVec
+	certExpiry *prometheus.GaugeVec
 }
 
 // newAgentMetrics create a new AgentMetrics, configured with default metric names.
@@ -71,15 +84,37 @@ func newAgentMetrics() *AgentMetrics {
 		},
 		[]string{"direction"},
 	)
+	reaped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connections_reaped_total",
+			Help:      "Count of connections closed by the agent, labeled by the reason (idle_timeout or max_lifetime)",
+		},
+		[]string{"reason"},
+	)
+	certExpiry := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "certificate_expiration_timestamp_seconds",
+			Help:      "Expiry of the certificate last loaded from a file, in seconds since the epoch, labeled by the file. For a CA bundle it is the earliest expiry",
+		},
+		[]string{"file"},
+	)
 	prometheus.MustRegister(failures)
 	prometheus.MustRegister(latencies)
-	return &AgentMetrics{failures: failures, latencies: latencies}
+	prometheus.MustRegister(reaped)
+	prometheus.MustRegister(certExpiry)
+	return &AgentMetrics{failures: failures, latencies: latencies, reaped: reaped, certExpiry: certExpiry}
 }
 
 // Reset resets the metrics.
 func (a *AgentMetrics) Reset() {
 	a.failures.Reset()
 	a.latencies.Reset()
+	a.reaped.Reset()
+	a.certExpiry.Reset()
 }
 
 // ObserveFailure records a failure to send to or receive from the proxy
@@ -92,3 +127,15 @@ func (a *AgentMetrics) ObserveFailure(direction Direction) {
 func (a *AgentMetrics) ObserveDialLatency(elapsed time.Duration) {
 	a.latencies.WithLabelValues().Observe(elapsed.Seconds())
 }
+
+// ObserveConnectionReaped records a connection closed by the agent because
+// it was idle or lived too long.
+func (a *AgentMetrics) ObserveConnectionReaped(reason ReapReason) {
+	a.reaped.WithLabelValues(string(reason)).Inc()
+}
+
+// SetCertificateExpiry records the expiry of the certificate loaded from
+// file.
+func (a *AgentMetrics) SetCertificateExpiry(file string, notAfter time.Time) {
+	a.certExpiry.WithLabelValues(file).Set(float64(notAfter.Unix()))
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ResolverConfig configures how the agent resolves the host names of the
+// addresses it is asked to dial.
+type ResolverConfig struct {
+	// Nameservers are the host:port addresses of the DNS servers to query,
+	// in order. Empty means the host resolver is used.
+	Nameservers []string
+	// SearchDomains are appended to names that are not fully qualified,
+	// e.g. "default.svc.cluster.local".
+	SearchDomains []string
+	// Hosts overrides the resolution of the given host names.
+	Hosts map[string][]string
+	// Timeout bounds every lookup against a single nameserver. 0 means no
+	// timeout.
+	Timeout time.Duration
+	// CacheTTL is how long successful lookups are cached. 0 disables
+	// caching.
+	CacheTTL time.Duration
+	// CacheSize is the maximum number of cached lookups. The least
+	// recently used lookups are evicted first. 0 disables caching.
+	CacheSize int
+}
+
+type resolverCacheEntry struct {
+	key     string
+	addrs   []string
+	expires time.Time
+}
+
+// Resolver resolves host names using static overrides, then the configured
+// nameservers, caching the results.
+type Resolver struct {
+	hosts         map[string][]string
+	searchDomains []string
+	timeout       time.Duration
+	cacheTTL      time.Duration
+	cacheSize     int
+	// resolvers has one resolver per nameserver, or the host resolver if no
+	// nameserver is configured.
+	resolvers []*net.Resolver
+	dialer    net.Dialer
+
+	mu    sync.Mutex // protects the following
+	lru   *list.List // of *resolverCacheEntry, most recently used first
+	cache map[string]*list.Element
+}
+
+// NewResolver creates a Resolver from the configuration.
+func NewResolver(c *ResolverConfig) *Resolver {
+	r := &Resolver{
+		hosts:     make(map[string][]string),
+		timeout:   c.Timeout,
+		cacheTTL:  c.CacheTTL,
+		cacheSize: c.CacheSize,
+		lru:       list.New(),
+		cache:     make(map[string]*list.Element),
+	}
+	for host, addrs := range c.Hosts {
+		r.hosts[canonicalHost(host)] = addrs
+	}
+	for _, d := range c.SearchDomains {
+		if d = strings.Trim(d, "."); d != "" {
+			r.searchDomains = append(r.searchDomains, d)
+		}
+	}
+	for _, ns := range c.Nameservers {
+		r.resolvers = append(r.resolvers, nameserverResolver(ns))
+	}
+	if len(r.resolvers) == 0 {
+		r.resolvers = []*net.Resolver{net.DefaultResolver}
+	}
+	return r
+}
+
+// nameserverResolver returns a resolver sending all its queries to ns.
+func nameserverResolver(ns string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, ns)
+		},
+	}
+}
+
+func canonicalHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// candidates returns the names to look up for host, applying the search
+// domains to names that are not fully qualified.
+func (r *Resolver) candidates(host string) []string {
+	if strings.HasSuffix(host, ".") || len(r.searchDomains) == 0 {
+		return []string{host}
+	}
+	var searched []string
+	for _, d := range r.searchDomains {
+		searched = append(searched, host+"."+d)
+	}
+	// Names with a dot are more likely to be fully qualified already.
+	if strings.Contains(host, ".") {
+		return append([]string{host}, searched...)
+	}
+	return append(searched, host)
+}
+
+// LookupHost returns the addresses of host.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	key := canonicalHost(host)
+	if addrs, ok := r.hosts[key]; ok {
+		return addrs, nil
+	}
+	if addrs, ok := r.cached(key); ok {
+		return addrs, nil
+	}
+
+	var lastErr error
+	for _, name := range r.candidates(host) {
+		if addrs, ok := r.hosts[canonicalHost(name)]; ok {
+			return addrs, nil
+		}
+		addrs, err := r.lookup(ctx, name)
+		if err == nil {
+			r.store(key, addrs)
+			return addrs, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// lookup queries the nameservers in order until one of them answers.
+func (r *Resolver) lookup(ctx context.Context, name string) ([]string, error) {
+	var lastErr error
+	for _, resolver := range r.resolvers {
+		lookupCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.timeout > 0 {
+			lookupCtx, cancel = context.WithTimeout(ctx, r.timeout)
+		}
+		addrs, err := resolver.LookupHost(lookupCtx, name)
+		cancel()
+		if err == nil {
+			return addrs, nil
+		}
+		lastErr = err
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			// The nameserver answered, the name does not exist.
+			break
+		}
+		klog.V(4).InfoS("DNS lookup failed", "name", name, "err", err)
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) cachingEnabled() bool {
+	return r.cacheTTL > 0 && r.cacheSize > 0
+}
+
+func (r *Resolver) cached(key string) ([]string, bool) {
+	if !r.cachingEnabled() {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elem, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*resolverCacheEntry)
+	if time.Now().After(e.expires) {
+		r.lru.Remove(elem)
+		delete(r.cache, key)
+		return nil, false
+	}
+	r.lru.MoveToFront(elem)
+	return e.addrs, true
+}
+
+// store caches addrs under key, evicting the least recently used lookups
+// beyond the cache size.
+func (r *Resolver) store(key string, addrs []string) {
+	if !r.cachingEnabled() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := &resolverCacheEntry{key: key, addrs: addrs, expires: time.Now().Add(r.cacheTTL)}
+	if elem, ok := r.cache[key]; ok {
+		elem.Value = e
+		r.lru.MoveToFront(elem)
+		return
+	}
+	r.cache[key] = r.lru.PushFront(e)
+	for r.lru.Len() > r.cacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*resolverCacheEntry).key)
+	}
+}
+
+// DialContext resolves the host of address and dials the resolved
+// addresses in turn until one succeeds.
+func (r *Resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// ParseHostsFile reads a file in the /etc/hosts format, i.e. lines of an IP
+// address followed by host names, and returns the addresses of every host
+// name.
+func ParseHostsFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("%s:%d: invalid IP address %q", path, lineNum, fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing host name", path, lineNum)
+		}
+		for _, host := range fields[1:] {
+			host = canonicalHost(host)
+			hosts[host] = append(hosts[host], fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSServer answers A queries over UDP from a static table.
+type fakeDNSServer struct {
+	conn    net.PacketConn
+	records map[string]net.IP // keyed by fully qualified name
+
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func newFakeDNSServer(t *testing.T, records map[string]string) *fakeDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDNSServer{
+		conn:    conn,
+		records: make(map[string]net.IP),
+		queries: make(map[string]int),
+	}
+	for name, ip := range records {
+		s.records[name] = net.ParseIP(ip).To4()
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeDNSServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeDNSServer) close() {
+	s.conn.Close()
+}
+
+func (s *fakeDNSServer) queryCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[name]
+}
+
+func (s *fakeDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		q := req.Questions[0]
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+			Questions: req.Questions,
+		}
+		ip, ok := s.records[q.Name.String()]
+		switch {
+		case !ok:
+			resp.RCode = dnsmessage.RCodeNameError
+		case q.Type == dnsmessage.TypeA:
+			var a [4]byte
+			copy(a[:], ip)
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: a},
+			}}
+		}
+		if q.Type == dnsmessage.TypeA {
+			s.mu.Lock()
+			s.queries[q.Name.String()]++
+			s.mu.Unlock()
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+func TestResolverNameserver(t *testing.T) {
+	dns := newFakeDNSServer(t, map[string]string{"backend.example.com.": "10.1.2.3"})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{Nameservers: []string{dns.addr()}, Timeout: time.Second})
+	addrs, err := r.LookupHost(context.Background(), "backend.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.1.2.3"}) {
+		t.Errorf("expected [10.1.2.3], got %v", addrs)
+	}
+
+	if _, err := r.LookupHost(context.Background(), "missing.example.com"); err == nil {
+		t.Error("expected an error resolving an unknown name")
+	}
+}
+
+func TestResolverFallbackNameserver(t *testing.T) {
+	// A nameserver that never answers.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	dns := newFakeDNSServer(t, map[string]string{"backend.example.com.": "10.1.2.3"})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{
+		Nameservers: []string{silent.LocalAddr().String(), dns.addr()},
+		Timeout:     200 * time.Millisecond,
+	})
+	start := time.Now()
+	addrs, err := r.LookupHost(context.Background(), "backend.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.1.2.3"}) {
+		t.Errorf("expected [10.1.2.3], got %v", addrs)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the lookup against the silent nameserver to time out, took %v", elapsed)
+	}
+}
+
+func TestResolverSearchDomains(t *testing.T) {
+	dns := newFakeDNSServer(t, map[string]string{"backend.svc.cluster.local.": "10.1.2.3"})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{
+		Nameservers:   []string{dns.addr()},
+		SearchDomains: []string{"svc.cluster.local"},
+		Timeout:       time.Second,
+	})
+	addrs, err := r.LookupHost(context.Background(), "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.1.2.3"}) {
+		t.Errorf("expected [10.1.2.3], got %v", addrs)
+	}
+}
+
+func TestResolverHostsOverride(t *testing.T) {
+	dns := newFakeDNSServer(t, map[string]string{"backend.example.com.": "10.1.2.3"})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{
+		Nameservers: []string{dns.addr()},
+		Hosts:       map[string][]string{"Backend.example.com.": {"127.0.0.1"}},
+	})
+	addrs, err := r.LookupHost(context.Background(), "backend.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1"}) {
+		t.Errorf("expected the hosts override, got %v", addrs)
+	}
+	if n := dns.queryCount("backend.example.com."); n != 0 {
+		t.Errorf("expected no query to the nameserver, got %d", n)
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	dns := newFakeDNSServer(t, map[string]string{"backend.example.com.": "10.1.2.3"})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{
+		Nameservers: []string{dns.addr()},
+		Timeout:     time.Second,
+		CacheTTL:    200 * time.Millisecond,
+		CacheSize:   10,
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := r.LookupHost(context.Background(), "backend.example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := dns.queryCount("backend.example.com."); n != 1 {
+		t.Errorf("expected 1 query while cached, got %d", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := r.LookupHost(context.Background(), "backend.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := dns.queryCount("backend.example.com."); n != 2 {
+		t.Errorf("expected a new query after the cache expired, got %d queries", n)
+	}
+}
+
+func TestResolverCacheSize(t *testing.T) {
+	dns := newFakeDNSServer(t, map[string]string{
+		"a.example.com.": "10.1.2.1",
+		"b.example.com.": "10.1.2.2",
+		"c.example.com.": "10.1.2.3",
+	})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{
+		Nameservers: []string{dns.addr()},
+		Timeout:     time.Second,
+		CacheTTL:    time.Minute,
+		CacheSize:   2,
+	})
+	lookup := func(name string) {
+		if _, err := r.LookupHost(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup("a.example.com")
+	lookup("b.example.com")
+	lookup("a.example.com")
+	// b.example.com is the least recently used, and evicted.
+	lookup("c.example.com")
+	if n := len(r.cache); n != 2 {
+		t.Errorf("expected 2 cached lookups, got %d", n)
+	}
+	lookup("a.example.com")
+	if n := dns.queryCount("a.example.com."); n != 1 {
+		t.Errorf("expected a.example.com to stay cached, got %d queries", n)
+	}
+	lookup("b.example.com")
+	if n := dns.queryCount("b.example.com."); n != 2 {
+		t.Errorf("expected b.example.com to be evicted, got %d queries", n)
+	}
+}
+
+func TestResolverDialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	dns := newFakeDNSServer(t, map[string]string{"backend.example.com.": "127.0.0.1"})
+	defer dns.close()
+
+	r := NewResolver(&ResolverConfig{Nameservers: []string{dns.addr()}, Timeout: time.Second})
+	conn, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("backend.example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	ac := &AgentClient{dialer: r}
+	conn, err = ac.dial("tcp", net.JoinHostPort("backend.example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestParseHostsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(strings.Join([]string{
+		"# comment",
+		"10.0.0.1 backend backend.example.com  # trailing comment",
+		"",
+		"10.0.0.2 Backend",
+	}, "\n"))
+	f.Close()
+
+	hosts, err := ParseHostsFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"backend":             {"10.0.0.1", "10.0.0.2"},
+		"backend.example.com": {"10.0.0.1"},
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %v, got %v", expected, hosts)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("not-an-ip backend\n"), 0644)
+	if _, err := ParseHostsFile(f.Name()); err == nil {
+		t.Error("expected an error parsing an invalid IP address")
+	}
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ConnectionInfo describes a tunneled connection, established or pending.
+type ConnectionInfo struct {
+	// AgentID and ConnectionID identify an established connection.
+	AgentID      string `json:"agentID,omitempty"`
+	ConnectionID int64  `json:"connectionID,omitempty"`
+	// Random identifies a pending dial.
+	Random      int64     `json:"random,omitempty"`
+	Mode        string    `json:"mode"`
+	Frontend    string    `json:"frontend,omitempty"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Start       time.Time `json:"start"`
+	AgeSeconds  float64   `json:"ageSeconds"`
+	// BytesFromFrontend is the number of bytes the frontend sent to the
+	// destination.
+	BytesFromFrontend int64 `json:"bytesFromFrontend"`
+	// BytesToFrontend is the number of bytes the destination sent back to
+	// the frontend.
+	BytesToFrontend int64 `json:"bytesToFrontend"`
+}
+
+func (c *ProxyClientConnection) info(now time.Time) ConnectionInfo {
+	return ConnectionInfo{
+		AgentID:           c.agentID,
+		ConnectionID:      c.connectID,
+		Mode:              c.Mode,
+		Frontend:          c.identity,
+		UserAgent:         c.userAgent,
+		Destination:       c.address,
+		Start:             c.start,
+		AgeSeconds:        now.Sub(c.start).Seconds(),
+		BytesFromFrontend: c.bytesFromFrontend(),
+		BytesToFrontend:   c.bytesToFrontend(),
+	}
+}
+
+// Connections returns the established connections, sorted by agent and
+// connection ID.
+func (s *ProxyServer) Connections() []ConnectionInfo {
+	now := time.Now()
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	var conns []ConnectionInfo
+	for _, frontends := range s.frontends {
+		for _, frontend := range frontends {
+			conns = append(conns, frontend.info(now))
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].AgentID != conns[j].AgentID {
+			return conns[i].AgentID < conns[j].AgentID
+		}
+		return conns[i].ConnectionID < conns[j].ConnectionID
+	})
+	return conns
+}
+
+// ErrUnknownConnection indicates that no established connection has the
+// given agent and connection ID.
+type ErrUnknownConnection struct {
+	AgentID      string
+	ConnectionID int64
+}
+
+// Error returns the error message.
+func (e *ErrUnknownConnection) Error() string {
+	return fmt.Sprintf("connection %d of agent %q is not established", e.ConnectionID, e.AgentID)
+}
+
+// KillConnection closes an established connection: the agent is sent a
+// CLOSE_REQ and the frontend a CLOSE_RSP carrying reason.
+func (s *ProxyServer) KillConnection(agentID string, connID int64, reason string) error {
+	frontend, err := s.getFrontend(agentID, connID)
+	if err != nil {
+		return &ErrUnknownConnection{AgentID: agentID, ConnectionID: connID}
+	}
+	if reason == "" {
+		reason = "connection closed by the proxy server administrator"
+	}
+	if s.AuditSink != nil {
+		e := newAuditEvent(AuditConnectionKilled, frontend)
+		e.Reason = reason
+		s.writeAudit(e)
+	}
+	s.closeFrontend(frontend, reason)
+	return nil
+}
+
+// CordonAgent stops picking the agent for new connections, letting its
+// established connections complete.
+func (s *ProxyServer) CordonAgent(agentID, reason string) error {
+	c, ok := s.BackendManager.(agentCordoner)
+	if !ok {
+		return fmt.Errorf("the backend manager cannot cordon agents")
+	}
+	if err := c.Cordon(agentID); err != nil {
+		return err
+	}
+	klog.V(1).InfoS("Cordoned agent", "agentID", agentID, "reason", reason)
+	s.auditAgent(AuditAgentCordoned, agentID, reason)
+	return nil
+}
+
+// UncordonAgent picks the agent for new connections again.
+func (s *ProxyServer) UncordonAgent(agentID, reason string) error {
+	c, ok := s.BackendManager.(agentCordoner)
+	if !ok {
+		return fmt.Errorf("the backend manager cannot cordon agents")
+	}
+	if err := c.Uncordon(agentID); err != nil {
+		return err
+	}
+	klog.V(1).InfoS("Uncordoned agent", "agentID", agentID, "reason", reason)
+	s.auditAgent(AuditAgentUncordoned, agentID, reason)
+	return nil
+}
+
+// List returns the pending dials, oldest first.
+func (pm *PendingDialManager) List() []ConnectionInfo {
+	now := time.Now()
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	var dials []ConnectionInfo
+	for random, conn := range pm.pendingDial {
+		info := conn.info(now)
+		info.Random = random
+		dials = append(dials, info)
+	}
+	sort.Slice(dials, func(i, j int) bool { return dials[i].Start.Before(dials[j].Start) })
+	return dials
+}
+
+// AdminHandler serves the JSON admin API of the proxy server under /api/:
+// the connected agents (/api/agents), the established connections
+// (/api/connections) and the dials waiting for the DIAL_RSP of an agent
+// (/api/pending-dials). Agents are cordoned and uncordoned with a POST to
+// /api/agents/<agentID>/cordon and /api/agents/<agentID>/uncordon, and
+// connections are closed with a DELETE of
+// /api/connections/<agentID>/<connectionID>. Actions take an optional
+// reason query parameter, which is recorded in the audit log.
+type AdminHandler struct {
+	Server *ProxyServer
+	mux    *http.ServeMux
+}
+
+// NewAdminHandler returns the admin API of s.
+func NewAdminHandler(s *ProxyServer) *AdminHandler {
+	h := &AdminHandler{Server: s, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/api/agents", h.get(h.agents))
+	h.mux.HandleFunc("/api/connections", h.get(h.connections))
+	h.mux.HandleFunc("/api/pending-dials", h.get(h.pendingDials))
+	h.mux.HandleFunc("/api/agents/", h.agentAction)
+	h.mux.HandleFunc("/api/connections/", h.killConnection)
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// get serves the result of list as JSON to GET requests.
+func (h *AdminHandler) get(list func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, list())
+	}
+}
+
+// pathSegments returns the unescaped segments of the request path after
+// prefix, or false if they are not n non-empty segments.
+func pathSegments(r *http.Request, prefix string, n int) ([]string, bool) {
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, prefix) {
+		return nil, false
+	}
+	segments := strings.Split(strings.TrimPrefix(path, prefix), "/")
+	if len(segments) != n {
+		return nil, false
+	}
+	for i, segment := range segments {
+		s, err := url.PathUnescape(segment)
+		if err != nil || s == "" {
+			return nil, false
+		}
+		segments[i] = s
+	}
+	return segments, true
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// writeActionError reports the failure of an admin action.
+func writeActionError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *ErrUnknownAgent, *ErrUnknownConnection:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// agentAction cordons or uncordons an agent.
+func (h *AdminHandler) agentAction(w http.ResponseWriter, r *http.Request) {
+	segments, ok := pathSegments(r, "/api/agents/", 2)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	agentID, action := segments[0], segments[1]
+	var act func(agentID, reason string) error
+	switch action {
+	case "cordon":
+		act = h.Server.CordonAgent
+	case "uncordon":
+		act = h.Server.UncordonAgent
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := act(agentID, r.URL.Query().Get("reason")); err != nil {
+		writeActionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// killConnection closes an established connection.
+func (h *AdminHandler) killConnection(w http.ResponseWriter, r *http.Request) {
+	segments, ok := pathSegments(r, "/api/connections/", 2)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	connID, err := strconv.ParseInt(segments[1], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid connection ID %q", segments[1]), http.StatusBadRequest)
+		return
+	}
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if err := h.Server.KillConnection(segments[0], connID, r.URL.Query().Get("reason")); err != nil {
+		writeActionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		klog.ErrorS(err, "Failed to write admin response")
+	}
+}
+
+func (h *AdminHandler) agents() interface{} {
+	agents := []AgentInfo{}
+	if l, ok := h.Server.BackendManager.(agentLister); ok {
+		agents = l.Agents()
+	}
+	return agents
+}
+
+func (h *AdminHandler) connections() interface{} {
+	conns := h.Server.Connections()
+	if conns == nil {
+		conns = []ConnectionInfo{}
+	}
+	return conns
+}
+
+func (h *AdminHandler) pendingDials() interface{} {
+	dials := h.Server.PendingDial.List()
+	if dials == nil {
+		dials = []ConnectionInfo{}
+	}
+	return dials
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/metadata"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	agentmock "sigs.k8s.io/apiserver-network-proxy/proto/agent/mocks"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// getAdmin decodes the JSON response of the admin API to a GET of path.
+func getAdmin(t *testing.T, h http.Handler, path string, v interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: expected status 200, got %d: %s", path, rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+func TestAdminHandlerLists(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{})
+	h := NewAdminHandler(p)
+
+	var agents []AgentInfo
+	getAdmin(t, h, "/api/agents", &agents)
+	if len(agents) != 0 {
+		t.Errorf("expected no agents, got %+v", agents)
+	}
+
+	md := metadata.Pairs(
+		header.AgentID, "agent1",
+		header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+"secret")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	conn1 := agentmock.NewMockAgentService_ConnectServer(stub)
+	conn1.EXPECT().Context().AnyTimes().Return(ctx)
+	conn2 := agentmock.NewMockAgentService_ConnectServer(stub)
+	conn2.EXPECT().Context().AnyTimes().Return(ctx)
+	before := time.Now()
+	backend := p.BackendManager.AddBackend("agent1", conn1, 10)
+	p.BackendManager.AddBackend("agent1", conn2, 10)
+
+	frontend := &ProxyClientConnection{
+		Mode:      "grpc",
+		start:     time.Now().Add(-time.Minute),
+		identity:  "kube-apiserver",
+		userAgent: "test",
+		address:   "10.0.0.1:443",
+		backend:   backend,
+		agentID:   "agent1",
+		connectID: 2,
+	}
+	frontend.addBytesFromFrontend(100)
+	p.addFrontend("agent1", 2, frontend)
+	p.PendingDial.Add(42, &ProxyClientConnection{
+		Mode:     "http-connect",
+		start:    time.Now(),
+		identity: "kube-apiserver",
+		address:  "10.0.0.2:443",
+		backend:  backend,
+	})
+	backend.(connectionCounter).acquire()
+
+	getAdmin(t, h, "/api/agents", &agents)
+	if len(agents) != 1 {
+		t.Fatalf("expected one agent, got %+v", agents)
+	}
+	agent := agents[0]
+	if agent.ID != "agent1" || agent.Streams != 2 || agent.Connections != 1 || agent.MaxConnections != 10 {
+		t.Errorf("unexpected agent %+v", agent)
+	}
+	if agent.ConnectedAt.Before(before.Add(-time.Second)) {
+		t.Errorf("expected the agent to be connected at %v, got %v", before, agent.ConnectedAt)
+	}
+	if !reflect.DeepEqual(agent.Metadata[strings.ToLower(header.AgentID)], []string{"agent1"}) {
+		t.Errorf("expected the agent metadata, got %v", agent.Metadata)
+	}
+	if _, ok := agent.Metadata[strings.ToLower(header.AuthenticationTokenContextKey)]; ok {
+		t.Errorf("expected the token to be redacted, got %v", agent.Metadata)
+	}
+
+	var conns []ConnectionInfo
+	getAdmin(t, h, "/api/connections", &conns)
+	if len(conns) != 1 {
+		t.Fatalf("expected one connection, got %+v", conns)
+	}
+	conn := conns[0]
+	if conn.AgentID != "agent1" || conn.ConnectionID != 2 || conn.Frontend != "kube-apiserver" || conn.Destination != "10.0.0.1:443" || conn.BytesFromFrontend != 100 {
+		t.Errorf("unexpected connection %+v", conn)
+	}
+	if conn.AgeSeconds < 60 {
+		t.Errorf("expected the connection to be a minute old, got %v", conn.AgeSeconds)
+	}
+
+	var dials []ConnectionInfo
+	getAdmin(t, h, "/api/pending-dials", &dials)
+	if len(dials) != 1 || dials[0].Random != 42 || dials[0].Mode != "http-connect" || dials[0].Destination != "10.0.0.2:443" {
+		t.Errorf("unexpected pending dials %+v", dials)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/connections", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be rejected, got %d", rec.Code)
+	}
+}
+
+// postAdmin sends a request without body to the admin API and returns the
+// response status.
+func postAdmin(h http.Handler, method, path string) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec.Code
+}
+
+func TestAdminHandlerActions(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{})
+	sink := &fakeAuditSink{}
+	p.AuditSink = sink
+	h := NewAdminHandler(p)
+
+	agentConn := agentmock.NewMockAgentService_ConnectServer(stub)
+	agentConn.EXPECT().Context().AnyTimes().Return(context.Background())
+	backend := p.BackendManager.AddBackend("agent/1", agentConn, 0)
+
+	if code := postAdmin(h, http.MethodPost, "/api/agents/agent%2F1/cordon?reason=maintenance"); code != http.StatusNoContent {
+		t.Fatalf("expected the agent to be cordoned, got %d", code)
+	}
+	var agents []AgentInfo
+	getAdmin(t, h, "/api/agents", &agents)
+	if len(agents) != 1 || !agents[0].Cordoned {
+		t.Errorf("expected the agent to be cordoned, got %+v", agents)
+	}
+	if _, err := p.BackendManager.Backend(context.Background()); err == nil {
+		t.Errorf("expected the cordoned agent not to be picked")
+	}
+	if code := postAdmin(h, http.MethodPost, "/api/agents/agent%2F1/uncordon"); code != http.StatusNoContent {
+		t.Fatalf("expected the agent to be uncordoned, got %d", code)
+	}
+	if _, err := p.BackendManager.Backend(context.Background()); err != nil {
+		t.Errorf("expected the uncordoned agent to be picked, got %v", err)
+	}
+	releaseBackend(backend)
+
+	frontendConn := &fakeFrontend{sent: make(chan *client.Packet, 1)}
+	frontend := &ProxyClientConnection{
+		Mode:      "grpc",
+		Grpc:      frontendConn,
+		start:     time.Now(),
+		backend:   backend,
+		agentID:   "agent/1",
+		connectID: 7,
+	}
+	p.addFrontend("agent/1", 7, frontend)
+	agentConn.EXPECT().Send(gomock.Any()).Do(func(pkt *client.Packet) {
+		if pkt.Type != client.PacketType_CLOSE_REQ || pkt.GetCloseRequest().ConnectID != 7 {
+			t.Errorf("expected a CLOSE_REQ for connection 7, got %v", pkt)
+		}
+	}).Return(nil)
+
+	if code := postAdmin(h, http.MethodDelete, "/api/connections/agent%2F1/7?reason=stuck"); code != http.StatusNoContent {
+		t.Fatalf("expected the connection to be closed, got %d", code)
+	}
+	pkt := <-frontendConn.sent
+	if pkt.Type != client.PacketType_CLOSE_RSP || pkt.GetCloseResponse().Error != "stuck" {
+		t.Errorf("expected a CLOSE_RSP to the frontend, got %v", pkt)
+	}
+	if conns := p.Connections(); len(conns) != 0 {
+		t.Errorf("expected the connection to be removed, got %+v", conns)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodDelete, "/api/connections/agent%2F1/7", http.StatusNotFound},
+		{http.MethodDelete, "/api/connections/agent%2F1/x", http.StatusBadRequest},
+		{http.MethodPost, "/api/agents/agent2/cordon", http.StatusNotFound},
+		{http.MethodPost, "/api/agents/agent%2F1/drain", http.StatusNotFound},
+		{http.MethodGet, "/api/agents/agent%2F1/cordon", http.StatusMethodNotAllowed},
+	} {
+		if code := postAdmin(h, tc.method, tc.path); code != tc.want {
+			t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.path, tc.want, code)
+		}
+	}
+
+	want := []AuditEventType{AuditAgentCordoned, AuditAgentUncordoned, AuditConnectionKilled, AuditConnectionClosed}
+	if got := sink.types(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected audit events %v, got %v", want, got)
+	}
+	if sink.events[0].AgentID != "agent/1" || sink.events[0].Reason != "maintenance" || sink.events[2].Reason != "stuck" {
+		t.Errorf("unexpected audit events %+v", sink.events)
+	}
+}
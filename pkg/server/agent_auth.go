@@ -0,0 +1,266 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// AgentCredentials are the credentials an agent presented to the server.
+type AgentCredentials struct {
+	// Token is the bearer token of the agent, empty if it sent none.
+	Token string
+	// Certificate is the verified client certificate of the agent, nil if
+	// the agent connected without one.
+	Certificate *x509.Certificate
+}
+
+// AgentAuthenticator authenticates the agents connecting to the server.
+type AgentAuthenticator interface {
+	// AuthenticateAgent returns the identity of the agent if its
+	// credentials are valid. ok is false if the authenticator does not
+	// handle the credentials the agent presented.
+	AuthenticateAgent(creds AgentCredentials) (user *authv1.UserInfo, ok bool, err error)
+}
+
+// ErrAgentUnauthenticated indicates that an agent did not present
+// credentials accepted by the server.
+type ErrAgentUnauthenticated struct {
+	Reason string
+}
+
+// Error returns the error message.
+func (e *ErrAgentUnauthenticated) Error() string {
+	return "agent authentication failed: " + e.Reason
+}
+
+// agentCredentials returns the credentials the agent of ctx presented.
+func agentCredentials(ctx context.Context) (AgentCredentials, error) {
+	creds := AgentCredentials{Certificate: peerCertificate(ctx)}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return creds, nil
+	}
+
+	authContext := md.Get(header.AuthenticationTokenContextKey)
+	if len(authContext) == 0 {
+		return creds, nil
+	}
+
+	if len(authContext) > 1 {
+		return creds, fmt.Errorf("too many (%d) tokens are received", len(authContext))
+	}
+
+	if !strings.HasPrefix(authContext[0], header.AuthenticationTokenContextSchemePrefix) {
+		return creds, fmt.Errorf("received token does not have %q prefix", header.AuthenticationTokenContextSchemePrefix)
+	}
+	creds.Token = strings.TrimPrefix(authContext[0], header.AuthenticationTokenContextSchemePrefix)
+	return creds, nil
+}
+
+// tokenAgentAuthenticator is implemented by the AgentAuthenticators
+// accepting the tokens of the agents, which then have to refresh them.
+type tokenAgentAuthenticator interface {
+	authenticatesToken()
+}
+
+// authenticateAgent authenticates creds with the AgentAuthenticator.
+// byToken reports whether the agent was accepted by its token.
+func (s *ProxyServer) authenticateAgent(creds AgentCredentials) (user *authv1.UserInfo, byToken bool, err error) {
+	user, accepted, err := authenticateAgentWith(s.AgentAuthenticator, creds)
+	if err != nil {
+		return nil, false, &ErrAgentUnauthenticated{Reason: err.Error()}
+	}
+	if accepted == nil {
+		return nil, false, &ErrAgentUnauthenticated{Reason: "no accepted credentials"}
+	}
+	klog.V(2).InfoS("Agent successfully authenticated", "user", user.Username)
+	_, byToken = accepted.(tokenAgentAuthenticator)
+	return user, byToken, nil
+}
+
+// authenticateAgentWith authenticates creds with a, returning the
+// authenticator accepting them, nil if none did.
+func authenticateAgentWith(a AgentAuthenticator, creds AgentCredentials) (*authv1.UserInfo, AgentAuthenticator, error) {
+	if u, ok := a.(UnionAgentAuthenticator); ok {
+		return u.authenticate(creds)
+	}
+	user, ok, err := a.AuthenticateAgent(creds)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	return user, a, nil
+}
+
+// UnionAgentAuthenticator tries each authenticator in turn.
+type UnionAgentAuthenticator []AgentAuthenticator
+
+// AuthenticateAgent returns the identity from the first authenticator
+// accepting the credentials.
+func (u UnionAgentAuthenticator) AuthenticateAgent(creds AgentCredentials) (*authv1.UserInfo, bool, error) {
+	user, accepted, err := u.authenticate(creds)
+	return user, accepted != nil, err
+}
+
+func (u UnionAgentAuthenticator) authenticate(creds AgentCredentials) (*authv1.UserInfo, AgentAuthenticator, error) {
+	var errs []string
+	for _, a := range u {
+		user, accepted, err := authenticateAgentWith(a, creds)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if accepted != nil {
+			return user, accepted, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil, nil, nil
+}
+
+// ServiceAccount identifies a Kubernetes service account.
+type ServiceAccount struct {
+	Namespace string
+	Name      string
+}
+
+// ParseServiceAccount parses a "namespace:name" service account.
+func ParseServiceAccount(s string) (ServiceAccount, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return ServiceAccount{}, fmt.Errorf("invalid service account %q, expected namespace:name", s)
+	}
+	return ServiceAccount{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// TokenReviewAgentAuthenticator authenticates the service account tokens of
+// the agents with the Kubernetes TokenReview API.
+type TokenReviewAgentAuthenticator struct {
+	KubernetesClient kubernetes.Interface
+	// Audiences the tokens must be issued for.
+	Audiences []string
+	// ServiceAccounts the agents may run as.
+	ServiceAccounts []ServiceAccount
+	// Cache, if set, caches the results of the TokenReviews.
+	Cache *TokenReviewCache
+}
+
+// AuthenticateAgent validates the token of the agent.
+func (a *TokenReviewAgentAuthenticator) AuthenticateAgent(creds AgentCredentials) (*authv1.UserInfo, bool, error) {
+	if creds.Token == "" {
+		return nil, false, nil
+	}
+	status, err := reviewToken(a.KubernetesClient, a.Cache, creds.Token, a.Audiences)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to authenticate request. err:%v", err)
+	}
+
+	if status.Error != "" {
+		return nil, false, fmt.Errorf("lookup failed: %s", status.Error)
+	}
+
+	if !status.Authenticated {
+		return nil, false, fmt.Errorf("lookup failed: service account jwt not valid")
+	}
+
+	// The username is of format: system:serviceaccount:(NAMESPACE):(SERVICEACCOUNT)
+	parts := strings.Split(status.User.Username, ":")
+	if len(parts) != 4 {
+		return nil, false, fmt.Errorf("lookup failed: unexpected username format")
+	}
+	// Validate the user that comes back from token review is a service account
+	if parts[0] != "system" || parts[1] != "serviceaccount" {
+		return nil, false, fmt.Errorf("lookup failed: username returned is not a service account")
+	}
+
+	sa := ServiceAccount{Namespace: parts[2], Name: parts[3]}
+	for _, allowed := range a.ServiceAccounts {
+		if allowed == sa {
+			return &status.User, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("lookup failed: service account %q of namespace %q is not allowed", sa.Name, sa.Namespace)
+}
+
+func (a *TokenReviewAgentAuthenticator) authenticatesToken() {}
+
+// TokenFileAgentAuthenticator authenticates the agent tokens listed in a
+// file in the Kubernetes static token file format: "token,user[,...]" lines.
+type TokenFileAgentAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewTokenFileAgentAuthenticator loads the tokens of the file.
+func NewTokenFileAgentAuthenticator(path string) (*TokenFileAgentAuthenticator, error) {
+	tokens, err := loadTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenFileAgentAuthenticator{tokens: tokens}, nil
+}
+
+// AuthenticateAgent validates the token of the agent.
+func (a *TokenFileAgentAuthenticator) AuthenticateAgent(creds AgentCredentials) (*authv1.UserInfo, bool, error) {
+	if creds.Token == "" {
+		return nil, false, nil
+	}
+	for t, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(creds.Token)) == 1 {
+			return &authv1.UserInfo{Username: user}, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("invalid agent token")
+}
+
+func (a *TokenFileAgentAuthenticator) authenticatesToken() {}
+
+// CertificateAgentAuthenticator authenticates the client certificates of
+// the agents by their common name. The certificates are verified against
+// the cluster CA during the TLS handshake.
+type CertificateAgentAuthenticator struct {
+	// CommonNames are the patterns, as of path.Match, the common name of
+	// the certificates must match.
+	CommonNames []string
+}
+
+// AuthenticateAgent validates the client certificate of the agent.
+func (a *CertificateAgentAuthenticator) AuthenticateAgent(creds AgentCredentials) (*authv1.UserInfo, bool, error) {
+	if creds.Certificate == nil {
+		return nil, false, nil
+	}
+	cn := creds.Certificate.Subject.CommonName
+	for _, pattern := range a.CommonNames {
+		if ok, _ := path.Match(pattern, cn); ok {
+			return &authv1.UserInfo{Username: cn, Groups: creds.Certificate.Subject.Organization}, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("certificate common name %q is not allowed", cn)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	fakeauthenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	agentmock "sigs.k8s.io/apiserver-network-proxy/proto/agent/mocks"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// newServiceAccountTokenClient returns a clientset authenticating the
+// tokens of the form "namespace:name" as the service account.
+func newServiceAccountTokenClient() *k8sfake.Clientset {
+	kcs := k8sfake.NewSimpleClientset()
+	kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		token := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview).Spec.Token
+		sa, err := ParseServiceAccount(token)
+		tr := &authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: err == nil,
+				User:          authv1.UserInfo{Username: "system:serviceaccount:" + sa.Namespace + ":" + sa.Name},
+			},
+		}
+		return true, tr, nil
+	})
+	return kcs
+}
+
+func TestAgentAuthenticators(t *testing.T) {
+	path := writeTempFile(t, "# agents\nstatic1,agent-static\n")
+	defer os.Remove(path)
+	tokenFile, err := NewTokenFileAgentAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := UnionAgentAuthenticator{
+		&TokenReviewAgentAuthenticator{
+			KubernetesClient: newServiceAccountTokenClient(),
+			ServiceAccounts: []ServiceAccount{
+				{Namespace: "kube-system", Name: "konnectivity-agent"},
+				{Namespace: "tenant", Name: "agent"},
+			},
+		},
+		tokenFile,
+		&CertificateAgentAuthenticator{CommonNames: []string{"system:konnectivity-agent:*"}},
+	}
+	certificate := func(cn string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{"agents"}}}
+	}
+
+	testCases := []struct {
+		desc     string
+		creds    AgentCredentials
+		username string
+		ok       bool
+		byToken  bool
+		err      bool
+	}{
+		{
+			desc:     "first service account",
+			creds:    AgentCredentials{Token: "kube-system:konnectivity-agent"},
+			username: "system:serviceaccount:kube-system:konnectivity-agent",
+			ok:       true,
+			byToken:  true,
+		},
+		{
+			desc:     "second service account",
+			creds:    AgentCredentials{Token: "tenant:agent"},
+			username: "system:serviceaccount:tenant:agent",
+			ok:       true,
+			byToken:  true,
+		},
+		{
+			desc:  "other service account",
+			creds: AgentCredentials{Token: "tenant:other"},
+			err:   true,
+		},
+		{
+			desc:     "static token",
+			creds:    AgentCredentials{Token: "static1"},
+			username: "agent-static",
+			ok:       true,
+			byToken:  true,
+		},
+		{
+			desc:     "certificate",
+			creds:    AgentCredentials{Certificate: certificate("system:konnectivity-agent:node1")},
+			username: "system:konnectivity-agent:node1",
+			ok:       true,
+		},
+		{
+			desc:  "certificate not allowed",
+			creds: AgentCredentials{Certificate: certificate("kube-apiserver")},
+			err:   true,
+		},
+		{
+			desc: "certificate accepted with an invalid token",
+			creds: AgentCredentials{
+				Token:       "invalid",
+				Certificate: certificate("system:konnectivity-agent:node1"),
+			},
+			username: "system:konnectivity-agent:node1",
+			ok:       true,
+		},
+		{
+			desc: "no credentials",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			user, ok, err := a.AuthenticateAgent(tc.creds)
+			if ok != tc.ok || (err != nil) != tc.err {
+				t.Fatalf("expected (ok=%v, err=%v), got (%v, %v)", tc.ok, tc.err, ok, err)
+			}
+			if ok && user.Username != tc.username {
+				t.Errorf("expected user %q, got %q", tc.username, user.Username)
+			}
+
+			p := NewProxyServer("", 1, nil)
+			p.AgentAuthenticator = a
+			if _, byToken, _ := p.authenticateAgent(tc.creds); byToken != tc.byToken {
+				t.Errorf("expected byToken=%v, got %v", tc.byToken, byToken)
+			}
+		})
+	}
+}
+
+func TestParseServiceAccount(t *testing.T) {
+	sa, err := ParseServiceAccount("kube-system:konnectivity-agent")
+	if err != nil || sa != (ServiceAccount{Namespace: "kube-system", Name: "konnectivity-agent"}) {
+		t.Errorf("unexpected result %+v, %v", sa, err)
+	}
+	for _, s := range []string{"", "kube-system", "kube-system:", ":agent", "a:b:c"} {
+		if _, err := ParseServiceAccount(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestConnectWithCertificateAndToken(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	// Agents present a client certificate verified against the cluster CA
+	// and a service account token.
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "agent1"}}
+	testCases := []struct {
+		desc      string
+		token     string
+		wantError bool
+	}{
+		{
+			desc:  "allowed service account",
+			token: "kube-system:konnectivity-agent",
+		},
+		{
+			desc:      "other service account",
+			token:     "default:default",
+			wantError: true,
+		},
+		{
+			desc:      "no token",
+			wantError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			md := metadata.Pairs(header.AgentID, "agent1")
+			if tc.token != "" {
+				md = metadata.Join(md, metadata.Pairs(header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+tc.token))
+			}
+			ctx := peer.NewContext(metadata.NewIncomingContext(context.Background(), md), &peer.Peer{
+				AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+				},
+			})
+			conn := agentmock.NewMockAgentService_ConnectServer(stub)
+			conn.EXPECT().Context().AnyTimes().Return(ctx)
+			if !tc.wantError {
+				conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
+				conn.EXPECT().Recv().Return(nil, io.EOF)
+			}
+
+			p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{})
+			p.AgentAuthenticator = &TokenReviewAgentAuthenticator{
+				KubernetesClient: newServiceAccountTokenClient(),
+				ServiceAccounts:  []ServiceAccount{{Namespace: "kube-system", Name: "konnectivity-agent"}},
+			}
+			p.AgentIDSource = AgentIDFromCertCN
+			bm := &recordingBackendManager{BackendManager: p.BackendManager}
+			p.BackendManager = bm
+
+			err := p.Connect(conn)
+			if tc.wantError {
+				if _, ok := err.(*ErrAgentUnauthenticated); !ok {
+					t.Errorf("expected ErrAgentUnauthenticated, got %v", err)
+				}
+				if len(bm.added) != 0 {
+					t.Errorf("expected the agent not to be registered, got %v", bm.added)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("did not expect an error, got %v", err)
+			}
+			if len(bm.added) != 1 {
+				t.Errorf("expected the agent to be registered, got %v", bm.added)
+			}
+		})
+	}
+}
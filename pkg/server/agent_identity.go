@@ -0,0 +1,131 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// AgentIDSource is the credential of an agent its agentID must match.
+type AgentIDSource string
+
+const (
+	// AgentIDFromAny lets the agents claim any agentID.
+	AgentIDFromAny AgentIDSource = ""
+	// AgentIDFromCertCN requires the agentID to be the common name of the
+	// client certificate of the agent.
+	AgentIDFromCertCN AgentIDSource = "cert-cn"
+	// AgentIDFromCertSAN requires the agentID to be one of the subject
+	// alternative names (DNS, IP or URI) of the client certificate of the
+	// agent.
+	AgentIDFromCertSAN AgentIDSource = "cert-san"
+	// AgentIDFromPodName requires the agentID to be the name of the pod
+	// the service account token of the agent is bound to.
+	AgentIDFromPodName AgentIDSource = "pod-name"
+	// AgentIDFromNodeName requires the agentID to be the name of the node
+	// the service account token of the agent is bound to.
+	AgentIDFromNodeName AgentIDSource = "node-name"
+)
+
+// The keys of the TokenReview user extra info of tokens bound to a pod.
+const (
+	podNameExtraKey  = "authentication.kubernetes.io/pod-name"
+	nodeNameExtraKey = "authentication.kubernetes.io/node-name"
+)
+
+// ErrAgentIDMismatch indicates that an agent claimed an agentID its
+// credentials are not valid for.
+type ErrAgentIDMismatch struct {
+	AgentID string
+	Source  AgentIDSource
+}
+
+// Error returns the error message.
+func (e *ErrAgentIDMismatch) Error() string {
+	return fmt.Sprintf("agent ID %q does not match the %s of the agent credentials", e.AgentID, e.Source)
+}
+
+// peerCertificate returns the client certificate of the peer of ctx, or nil.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
+
+// certificateNames returns the subject alternative names of cert.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// agentIdentities returns the agentIDs the credentials of the agent are
+// valid for, according to source. user is the result of the TokenReview of
+// the agent token, nil if token authentication is disabled.
+func agentIdentities(ctx context.Context, source AgentIDSource, user *authv1.UserInfo) []string {
+	switch source {
+	case AgentIDFromCertCN:
+		if cert := peerCertificate(ctx); cert != nil && cert.Subject.CommonName != "" {
+			return []string{cert.Subject.CommonName}
+		}
+	case AgentIDFromCertSAN:
+		if cert := peerCertificate(ctx); cert != nil {
+			return certificateNames(cert)
+		}
+	case AgentIDFromPodName:
+		if user != nil {
+			return user.Extra[podNameExtraKey]
+		}
+	case AgentIDFromNodeName:
+		if user != nil {
+			return user.Extra[nodeNameExtraKey]
+		}
+	}
+	return nil
+}
+
+// verifyAgentID checks the agentID claimed by the agent against its
+// credentials, as configured by AgentIDSource.
+func (s *ProxyServer) verifyAgentID(ctx context.Context, agentID string, user *authv1.UserInfo) error {
+	if s.AgentIDSource == AgentIDFromAny {
+		return nil
+	}
+	for _, id := range agentIdentities(ctx, s.AgentIDSource, user) {
+		if id == agentID {
+			return nil
+		}
+	}
+	return &ErrAgentIDMismatch{AgentID: agentID, Source: s.AgentIDSource}
+}
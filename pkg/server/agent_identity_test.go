@@ -0,0 +1,205 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	fakeauthenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	agentmock "sigs.k8s.io/apiserver-network-proxy/proto/agent/mocks"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// recordingBackendManager records the agents registered with it.
+type recordingBackendManager struct {
+	BackendManager
+	added []string
+}
+
+func (m *recordingBackendManager) AddBackend(agentID string, conn agent.AgentService_ConnectServer, maxConnections int) Backend {
+	m.added = append(m.added, agentID)
+	return m.BackendManager.AddBackend(agentID, conn, maxConnections)
+}
+
+func TestAgentIDVerification(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agent-cn"},
+		DNSNames:    []string{"agent-dns"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	testCases := []struct {
+		desc      string
+		source    AgentIDSource
+		agentID   string
+		token     bool
+		noCert    bool
+		wantError bool
+	}{
+		{
+			desc:    "any agentID",
+			agentID: "whatever",
+		},
+		{
+			desc:    "common name",
+			source:  AgentIDFromCertCN,
+			agentID: "agent-cn",
+		},
+		{
+			desc:      "common name mismatch",
+			source:    AgentIDFromCertCN,
+			agentID:   "agent-dns",
+			wantError: true,
+		},
+		{
+			desc:      "no client certificate",
+			source:    AgentIDFromCertCN,
+			agentID:   "agent-cn",
+			noCert:    true,
+			wantError: true,
+		},
+		{
+			desc:    "DNS SAN",
+			source:  AgentIDFromCertSAN,
+			agentID: "agent-dns",
+		},
+		{
+			desc:    "IP SAN",
+			source:  AgentIDFromCertSAN,
+			agentID: "10.0.0.1",
+		},
+		{
+			desc:      "SAN mismatch",
+			source:    AgentIDFromCertSAN,
+			agentID:   "agent-cn",
+			wantError: true,
+		},
+		{
+			desc:    "pod name",
+			source:  AgentIDFromPodName,
+			agentID: "agent-pod",
+			token:   true,
+		},
+		{
+			desc:      "pod name mismatch",
+			source:    AgentIDFromPodName,
+			agentID:   "agent-node",
+			token:     true,
+			wantError: true,
+		},
+		{
+			desc:    "node name",
+			source:  AgentIDFromNodeName,
+			agentID: "agent-node",
+			token:   true,
+		},
+		{
+			desc:      "node name mismatch",
+			source:    AgentIDFromNodeName,
+			agentID:   "agent-pod",
+			token:     true,
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			kcs := k8sfake.NewSimpleClientset()
+			kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				tr := &authv1.TokenReview{
+					Status: authv1.TokenReviewStatus{
+						Authenticated: true,
+						User: authv1.UserInfo{
+							Username: "system:serviceaccount:ns:sa",
+							Extra: map[string]authv1.ExtraValue{
+								podNameExtraKey:  {"agent-pod"},
+								nodeNameExtraKey: {"agent-node"},
+							},
+						},
+					},
+				}
+				return true, tr, nil
+			})
+
+			md := metadata.Pairs(header.AgentID, tc.agentID)
+			if tc.token {
+				md = metadata.Join(md, metadata.Pairs(header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+"token"))
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+			if !tc.noCert {
+				ctx = peer.NewContext(ctx, &peer.Peer{
+					AuthInfo: credentials.TLSInfo{
+						State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+					},
+				})
+			}
+			conn := agentmock.NewMockAgentService_ConnectServer(stub)
+			conn.EXPECT().Context().AnyTimes().Return(ctx)
+			if !tc.wantError {
+				conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
+				conn.EXPECT().Recv().Return(nil, io.EOF)
+			}
+
+			p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{
+				Enabled:             tc.token,
+				KubernetesClient:    kcs,
+				AgentNamespace:      "ns",
+				AgentServiceAccount: "sa",
+			})
+			p.AgentIDSource = tc.source
+			bm := &recordingBackendManager{BackendManager: p.BackendManager}
+			p.BackendManager = bm
+
+			err := p.Connect(conn)
+			if tc.wantError {
+				if _, ok := err.(*ErrAgentIDMismatch); !ok {
+					t.Errorf("expected ErrAgentIDMismatch, got %v", err)
+				}
+				if len(bm.added) != 0 {
+					t.Errorf("expected the agent not to be registered, got %v", bm.added)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("did not expect an error, got %v", err)
+			}
+			if len(bm.added) != 1 || bm.added[0] != tc.agentID {
+				t.Errorf("expected %q to be registered, got %v", tc.agentID, bm.added)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// AuditEventType is the lifecycle stage of a tunneled connection that an
+// AuditEvent describes.
+type AuditEventType string
+
+const (
+	// AuditDialRequested is recorded when a frontend asks for a new
+	// connection and the DIAL_REQ is forwarded to an agent.
+	AuditDialRequested AuditEventType = "DialRequested"
+	// AuditDialEstablished is recorded when the agent reports a successful
+	// dial to the destination.
+	AuditDialEstablished AuditEventType = "DialEstablished"
+	// AuditDialFailed is recorded when the dial could not be completed,
+	// either because no agent was available or the agent failed to dial.
+	AuditDialFailed AuditEventType = "DialFailed"
+	// AuditConnectionClosed is recorded when an established connection is
+	// removed from the proxy server.
+	AuditConnectionClosed AuditEventType = "ConnectionClosed"
+	// AuditConnectionKilled is recorded when an established connection is
+	// closed through the admin API. It is followed by AuditConnectionClosed.
+	AuditConnectionKilled AuditEventType = "ConnectionKilled"
+	// AuditAgentCordoned is recorded when an agent is cordoned through the
+	// admin API.
+	AuditAgentCordoned AuditEventType = "AgentCordoned"
+	// AuditAgentUncordoned is recorded when an agent is uncordoned through
+	// the admin API.
+	AuditAgentUncordoned AuditEventType = "AgentUncordoned"
+)
+
+// AuditEvent is a single entry of the connection audit log.
+type AuditEvent struct {
+	Time         time.Time      `json:"time"`
+	Type         AuditEventType `json:"event"`
+	Mode         string         `json:"mode,omitempty"`
+	Frontend     string         `json:"frontend,omitempty"`
+	UserAgent    string         `json:"userAgent,omitempty"`
+	Destination  string         `json:"destination,omitempty"`
+	AgentID      string         `json:"agentID,omitempty"`
+	ConnectionID int64          `json:"connectionID,omitempty"`
+	// BytesFromFrontend is the number of bytes the frontend sent to the
+	// destination.
+	BytesFromFrontend int64 `json:"bytesFromFrontend"`
+	// BytesToFrontend is the number of bytes the destination sent back to
+	// the frontend.
+	BytesToFrontend int64   `json:"bytesToFrontend"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+	// Reason is given by the operator of an admin action.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditSink receives the audit events of the proxy server.
+type AuditSink interface {
+	// Write records a single event. It must be safe for concurrent use.
+	Write(event *AuditEvent) error
+	// Close flushes and releases the resources held by the sink.
+	Close() error
+}
+
+var _ AuditSink = &JSONAuditSink{}
+
+// JSONAuditSink writes every audit event as one JSON line to an io.Writer.
+type JSONAuditSink struct {
+	mu  sync.Mutex // protects out
+	out io.Writer
+}
+
+// NewJSONAuditSink returns an AuditSink writing JSON lines to out.
+func NewJSONAuditSink(out io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{out: out}
+}
+
+// NewFileAuditSink returns an AuditSink writing JSON lines to the file at
+// path. The file is rotated once it grows beyond maxSize bytes, keeping at
+// most maxBackups rotated files next to it. A maxSize of 0 disables rotation.
+// The special path "-" writes to stdout.
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (*JSONAuditSink, error) {
+	if path == "-" {
+		return NewJSONAuditSink(os.Stdout), nil
+	}
+	f, err := newRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONAuditSink(f), nil
+}
+
+// Write records a single event as a JSON line.
+func (s *JSONAuditSink) Write(event *AuditEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(b)
+	return err
+}
+
+// Close closes the underlying writer if it is closable.
+func (s *JSONAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out == os.Stdout {
+		return nil
+	}
+	if c, ok := s.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+var _ AuditSink = &AsyncAuditSink{}
+
+// AsyncAuditSink writes the events to another sink from a background
+// goroutine, so that a slow sink, e.g. a file being rotated, does not hold
+// the connections being audited. The events are dropped while the buffer is
+// full.
+type AsyncAuditSink struct {
+	sink   AuditSink
+	events chan *AuditEvent
+	done   chan struct{}
+
+	mu     sync.RWMutex // protects closed, and events from being closed
+	closed bool
+}
+
+// NewAsyncAuditSink returns an AuditSink buffering up to bufferSize events
+// to be written to sink.
+func NewAsyncAuditSink(sink AuditSink, bufferSize int) *AsyncAuditSink {
+	s := &AsyncAuditSink{
+		sink:   sink,
+		events: make(chan *AuditEvent, bufferSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *AsyncAuditSink) run() {
+	defer close(s.done)
+	for e := range s.events {
+		if err := s.sink.Write(e); err != nil {
+			klog.ErrorS(err, "failed to write audit event", "event", e.Type)
+		}
+	}
+}
+
+// Write queues a single event. It is dropped if the buffer is full.
+func (s *AsyncAuditSink) Write(event *AuditEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit sink is closed")
+	}
+	select {
+	case s.events <- event:
+	default:
+		metrics.Metrics.ObserveAuditEventDropped()
+		klog.V(4).InfoS("Dropped audit event, the buffer is full", "event", event.Type)
+	}
+	return nil
+}
+
+// Close writes the buffered events, then closes the underlying sink.
+func (s *AsyncAuditSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.events)
+	s.mu.Unlock()
+	<-s.done
+	return s.sink.Close()
+}
+
+// rotatingFile is an io.WriteCloser that rotates the file it writes to once
+// the file reaches maxSize bytes. Rotated files are named path.1 through
+// path.<maxBackups>, path.1 being the most recent one.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %q: %v", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log %q: %v", r.path, err)
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) backupName(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+// rotateLocked closes the current file, shifts the backups and opens a new
+// file at path.
+func (r *rotatingFile) rotateLocked() error {
+	if err := r.file.Close(); err != nil {
+		klog.ErrorS(err, "failed to close audit log before rotation", "path", r.path)
+	}
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	if err := os.Remove(r.backupName(r.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(r.backupName(i), r.backupName(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.backupName(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotateLocked(); err != nil {
+			return 0, fmt.Errorf("failed to rotate audit log %q: %v", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// newAuditEvent builds an audit event describing the given frontend
+// connection.
+func newAuditEvent(eventType AuditEventType, c *ProxyClientConnection) *AuditEvent {
+	e := &AuditEvent{
+		Time:              time.Now(),
+		Type:              eventType,
+		Mode:              c.Mode,
+		Frontend:          c.identity,
+		UserAgent:         c.userAgent,
+		Destination:       c.address,
+		AgentID:           c.agentID,
+		ConnectionID:      c.connectID,
+		BytesFromFrontend: c.bytesFromFrontend(),
+		BytesToFrontend:   c.bytesToFrontend(),
+	}
+	if !c.start.IsZero() {
+		e.DurationSeconds = e.Time.Sub(c.start).Seconds()
+	}
+	return e
+}
+
+// audit records an event for the given connection if an audit sink is
+// configured.
+func (s *ProxyServer) audit(eventType AuditEventType, c *ProxyClientConnection, err error) {
+	if s.AuditSink == nil || c == nil {
+		return
+	}
+	e := newAuditEvent(eventType, c)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.writeAudit(e)
+}
+
+// auditAgent records an admin action on an agent if an audit sink is
+// configured.
+func (s *ProxyServer) auditAgent(eventType AuditEventType, agentID, reason string) {
+	if s.AuditSink == nil {
+		return
+	}
+	s.writeAudit(&AuditEvent{
+		Time:    time.Now(),
+		Type:    eventType,
+		AgentID: agentID,
+		Reason:  reason,
+	})
+}
+
+func (s *ProxyServer) writeAudit(e *AuditEvent) {
+	if err := s.AuditSink.Write(e); err != nil {
+		klog.ErrorS(err, "failed to write audit event", "event", e.Type)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+type fakeAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (s *fakeAuditSink) Write(e *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, *e)
+	return nil
+}
+
+func (s *fakeAuditSink) Close() error {
+	return nil
+}
+
+func (s *fakeAuditSink) types() []AuditEventType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []AuditEventType
+	for _, e := range s.events {
+		ret = append(ret, e.Type)
+	}
+	return ret
+}
+
+// fakeFrontend implements client.ProxyService_ProxyServer
+type fakeFrontend struct {
+	client.ProxyService_ProxyServer
+	sent chan *client.Packet
+}
+
+func (f *fakeFrontend) Send(pkt *client.Packet) error {
+	f.sent <- pkt
+	return nil
+}
+
+func (f *fakeFrontend) Context() context.Context {
+	return context.Background()
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+	events := []*AuditEvent{
+		{Type: AuditDialRequested, Destination: "127.0.0.1:80"},
+		{Type: AuditConnectionClosed, AgentID: "agent1", ConnectionID: 3, BytesToFrontend: 10},
+	}
+	for _, e := range events {
+		if err := sink.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	var i int
+	for ; scanner.Scan(); i++ {
+		var got AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i, err)
+		}
+		if got.Type != events[i].Type || got.AgentID != events[i].AgentID || got.BytesToFrontend != events[i].BytesToFrontend {
+			t.Errorf("expected %+v, got %+v", events[i], got)
+		}
+	}
+	if i != len(events) {
+		t.Errorf("expected %d lines, got %d", len(events), i)
+	}
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := NewFileAuditSink(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := sink.Write(&AuditEvent{Type: AuditDialRequested, Destination: "127.0.0.1:80"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("expected %s to be rotated at 200 bytes, got %d bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, got %v", err)
+	}
+}
+
+func TestAuditConnectionLifecycle(t *testing.T) {
+	sink := &fakeAuditSink{}
+	p := NewProxyServer("", 1, nil)
+	p.AuditSink = sink
+
+	frontend := &fakeFrontend{sent: make(chan *client.Packet, 10)}
+	conn := &ProxyClientConnection{
+		Mode:      "grpc",
+		Grpc:      frontend,
+		connected: make(chan struct{}),
+		start:     time.Now(),
+		identity:  "kube-apiserver",
+		address:   "10.0.0.1:443",
+	}
+	p.PendingDial.Add(111, conn)
+
+	recvCh := make(chan *client.Packet, 10)
+	done := make(chan struct{})
+	go func() {
+		p.serveRecvBackend(nil, nil, "agent1", recvCh)
+		close(done)
+	}()
+
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{Random: 111, ConnectID: 1}},
+	}
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DATA,
+		Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: []byte("hello")}},
+	}
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: 1}},
+	}
+	close(recvCh)
+	<-done
+
+	expected := []AuditEventType{AuditDialEstablished, AuditConnectionClosed}
+	got := sink.types()
+	if len(got) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("expected events %v, got %v", expected, got)
+		}
+	}
+	closed := sink.events[1]
+	if closed.AgentID != "agent1" || closed.ConnectionID != 1 || closed.Frontend != "kube-apiserver" || closed.Destination != "10.0.0.1:443" {
+		t.Errorf("unexpected close event %+v", closed)
+	}
+	if closed.BytesToFrontend != 5 {
+		t.Errorf("expected 5 bytes sent to the frontend, got %d", closed.BytesToFrontend)
+	}
+}
+
+func TestAuditDialFailure(t *testing.T) {
+	sink := &fakeAuditSink{}
+	p := NewProxyServer("", 1, nil)
+	p.AuditSink = sink
+
+	frontend := &fakeFrontend{sent: make(chan *client.Packet, 10)}
+	p.PendingDial.Add(111, &ProxyClientConnection{
+		Mode:      "grpc",
+		Grpc:      frontend,
+		connected: make(chan struct{}),
+		start:     time.Now(),
+	})
+
+	recvCh := make(chan *client.Packet, 10)
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: &client.DialResponse{Random: 111, Error: "connection refused"}},
+	}
+	close(recvCh)
+	p.serveRecvBackend(nil, nil, "agent1", recvCh)
+
+	if len(sink.events) != 1 || sink.events[0].Type != AuditDialFailed {
+		t.Fatalf("expected a single %s event, got %+v", AuditDialFailed, sink.events)
+	}
+	if sink.events[0].Error != "connection refused" {
+		t.Errorf("expected the dial error to be recorded, got %q", sink.events[0].Error)
+	}
+}
+
+// blockingAuditSink blocks every Write until unblock is closed.
+type blockingAuditSink struct {
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingAuditSink) Write(e *AuditEvent) error {
+	s.writing <- struct{}{}
+	<-s.unblock
+	return nil
+}
+
+func (s *blockingAuditSink) Close() error {
+	return nil
+}
+
+func TestAuditSlowSinkDoesNotBlockFrontends(t *testing.T) {
+	sink := &blockingAuditSink{writing: make(chan struct{}, 1), unblock: make(chan struct{})}
+	p := NewProxyServer("", 1, nil)
+	p.AuditSink = sink
+	p.addFrontend("agent1", 1, &ProxyClientConnection{Mode: "grpc", start: time.Now()})
+	p.addFrontend("agent1", 2, &ProxyClientConnection{Mode: "grpc", start: time.Now()})
+
+	removed := make(chan struct{})
+	go func() {
+		p.removeFrontend("agent1", 1)
+		close(removed)
+	}()
+	<-sink.writing
+
+	// The other frontends are looked up while the close event is written.
+	looked := make(chan error)
+	go func() {
+		_, err := p.getFrontend("agent1", 2)
+		looked <- err
+	}()
+	select {
+	case err := <-looked:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the frontends to be looked up while the audit sink is blocked")
+	}
+	close(sink.unblock)
+	<-removed
+}
+
+func TestAsyncAuditSink(t *testing.T) {
+	blocking := &blockingAuditSink{writing: make(chan struct{}, 10), unblock: make(chan struct{})}
+	sink := NewAsyncAuditSink(blocking, 2)
+
+	// The first event is being written, the next two are buffered and the
+	// last one is dropped, without holding the writer.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4; i++ {
+			if err := sink.Write(&AuditEvent{Type: AuditConnectionClosed}); err != nil {
+				t.Error(err)
+			}
+			if i == 0 {
+				<-blocking.writing
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the events to be written without waiting for the sink")
+	}
+
+	close(blocking.unblock)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blocking.writing); n != 2 {
+		t.Errorf("expected the 2 buffered events to be written on close, got %d", n)
+	}
+	if err := sink.Write(&AuditEvent{Type: AuditConnectionClosed}); err == nil {
+		t.Error("expected an error writing to a closed sink")
+	}
+}
@@ -18,13 +18,19 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"google.golang.org/grpc/metadata"
 	"k8s.io/klog/v2"
 	client "sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
 	"sigs.k8s.io/apiserver-network-proxy/proto/agent"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
 
 type Backend interface {
@@ -40,6 +46,46 @@ type backend struct {
 	// write it using channel. Let's worry about performance later.
 	mu   sync.Mutex // mu protects conn
 	conn agent.AgentService_ConnectServer
+
+	// slots counts the connections routed to the agent of the backend.
+	slots *agentSlots
+}
+
+// agentSlots bounds the concurrent connections routed to an agent. It is
+// shared by all the backends of the agent, so that the count is kept when
+// the agent opens a new stream.
+type agentSlots struct {
+	// maxConnections is the maximum number of concurrent connections the
+	// agent accepts, 0 means unlimited. connections is the number of
+	// connections, pending or established, routed to the agent. Both are
+	// accessed atomically.
+	maxConnections int64
+	connections    int64
+}
+
+// connectionCounter is implemented by backends that limit the number of
+// concurrent connections routed to their agent.
+type connectionCounter interface {
+	// acquire takes a connection slot, it returns false if the agent is
+	// full.
+	acquire() bool
+	// release returns a slot taken by acquire.
+	release()
+}
+
+var _ connectionCounter = &backend{}
+
+func (b *backend) acquire() bool {
+	max := atomic.LoadInt64(&b.slots.maxConnections)
+	if n := atomic.AddInt64(&b.slots.connections, 1); max > 0 && n > max {
+		atomic.AddInt64(&b.slots.connections, -1)
+		return false
+	}
+	return true
+}
+
+func (b *backend) release() {
+	atomic.AddInt64(&b.slots.connections, -1)
 }
 
 func (b *backend) Send(p *client.Packet) error {
@@ -53,15 +99,16 @@ func (b *backend) Context() context.Context {
 	return b.conn.Context()
 }
 
-func newBackend(conn agent.AgentService_ConnectServer) *backend {
-	return &backend{conn: conn}
+func newBackend(conn agent.AgentService_ConnectServer, slots *agentSlots) *backend {
+	return &backend{conn: conn, slots: slots}
 }
 
 // BackendStorage is an interface to manage the storage of the backend
 // connections, i.e., get, add and remove
 type BackendStorage interface {
-	// AddBackend adds a backend.
-	AddBackend(agentID string, conn agent.AgentService_ConnectServer) Backend
+	// AddBackend adds a backend. maxConnections is the maximum number of
+	// concurrent connections the agent accepts, 0 meaning unlimited.
+	AddBackend(agentID string, conn agent.AgentService_ConnectServer, maxConnections int) Backend
 	// RemoveBackend removes a backend.
 	RemoveBackend(agentID string, conn agent.AgentService_ConnectServer)
 	// NumBackends returns the number of backends.
@@ -105,6 +152,18 @@ type DefaultBackendStorage struct {
 	// Golang.
 	agentIDs []string
 	random   *rand.Rand
+	// connectedAt is when each backend connection was added.
+	connectedAt map[agent.AgentService_ConnectServer]time.Time
+	// goingAway are the backend connections of agents that sent a GOAWAY.
+	// They are not picked for new connections, and are removed once the
+	// agent closes them.
+	goingAway map[agent.AgentService_ConnectServer]bool
+	// cordoned are the connected agents not picked for new connections.
+	// An agent is uncordoned once its last backend is removed.
+	cordoned map[string]bool
+	// slots are the connection slots of the connected agents, shared by
+	// their backends.
+	slots map[string]*agentSlots
 }
 
 // NewDefaultBackendManager returns a DefaultBackendManager.
@@ -115,18 +174,30 @@ func NewDefaultBackendManager() *DefaultBackendManager {
 // NewDefaultBackendStorage returns a DefaultBackendStorage
 func NewDefaultBackendStorage() *DefaultBackendStorage {
 	return &DefaultBackendStorage{
-		backends: make(map[string][]*backend),
-		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		backends:    make(map[string][]*backend),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		connectedAt: make(map[agent.AgentService_ConnectServer]time.Time),
+		goingAway:   make(map[agent.AgentService_ConnectServer]bool),
+		cordoned:    make(map[string]bool),
+		slots:       make(map[string]*agentSlots),
 	}
 }
 
-// AddBackend adds a backend.
-func (s *DefaultBackendStorage) AddBackend(agentID string, conn agent.AgentService_ConnectServer) Backend {
+// AddBackend adds a backend. The connection limit of the agent is set
+// before the backend can be picked, and replaces the limit advertised by its
+// other streams.
+func (s *DefaultBackendStorage) AddBackend(agentID string, conn agent.AgentService_ConnectServer, maxConnections int) Backend {
 	klog.V(2).InfoS("Register backend for agent", "connection", conn, "agentID", agentID)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, ok := s.backends[agentID]
-	addedBackend := newBackend(conn)
+	slots, ok := s.slots[agentID]
+	if !ok {
+		slots = &agentSlots{}
+		s.slots[agentID] = slots
+	}
+	atomic.StoreInt64(&slots.maxConnections, int64(maxConnections))
+	_, ok = s.backends[agentID]
+	addedBackend := newBackend(conn, slots)
 	if ok {
 		for _, v := range s.backends[agentID] {
 			if v.conn == conn {
@@ -135,10 +206,12 @@ func (s *DefaultBackendStorage) AddBackend(agentID string, conn agent.AgentServi
 			}
 		}
 		s.backends[agentID] = append(s.backends[agentID], addedBackend)
+		s.connectedAt[conn] = time.Now()
 		return addedBackend
 	}
 	s.backends[agentID] = []*backend{addedBackend}
 	s.agentIDs = append(s.agentIDs, agentID)
+	s.connectedAt[conn] = time.Now()
 	return addedBackend
 }
 
@@ -156,6 +229,8 @@ func (s *DefaultBackendStorage) RemoveBackend(agentID string, conn agent.AgentSe
 	for i, c := range backends {
 		if c.conn == conn {
 			s.backends[agentID] = append(s.backends[agentID][:i], s.backends[agentID][i+1:]...)
+			delete(s.connectedAt, conn)
+			delete(s.goingAway, conn)
 			if i == 0 && len(s.backends[agentID]) != 0 {
 				klog.V(1).InfoS("This should not happen. Removed connection that is not the first connection", "connection", conn, "remainingConnections", s.backends[agentID])
 			}
@@ -164,6 +239,8 @@ func (s *DefaultBackendStorage) RemoveBackend(agentID string, conn agent.AgentSe
 	}
 	if len(s.backends[agentID]) == 0 {
 		delete(s.backends, agentID)
+		delete(s.cordoned, agentID)
+		delete(s.slots, agentID)
 		for i := range s.agentIDs {
 			if s.agentIDs[i] == agentID {
 				s.agentIDs[i] = s.agentIDs[len(s.agentIDs)-1]
@@ -184,6 +261,146 @@ func (s *DefaultBackendStorage) NumBackends() int {
 	return len(s.backends)
 }
 
+// AgentInfo describes an agent connected to the proxy server.
+type AgentInfo struct {
+	ID string `json:"id"`
+	// Streams is the number of streams the agent opened to this server.
+	Streams int `json:"streams"`
+	// ConnectedAt is when the agent opened the stream traffic is sent on.
+	ConnectedAt time.Time `json:"connectedAt"`
+	// Connections is the number of connections, pending or established,
+	// routed to the agent; MaxConnections the maximum the agent accepts,
+	// 0 meaning unlimited.
+	Connections    int64 `json:"connections"`
+	MaxConnections int64 `json:"maxConnections"`
+	// Metadata is the gRPC metadata the agent connected with, without its
+	// credentials.
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	// Cordoned is set if the agent is not picked for new connections.
+	Cordoned bool `json:"cordoned"`
+	// GoingAway is set if every stream of the agent sent a GOAWAY.
+	GoingAway bool `json:"goingAway"`
+}
+
+// agentLister is implemented by the backend managers listing their agents.
+type agentLister interface {
+	Agents() []AgentInfo
+}
+
+var _ agentLister = &DefaultBackendStorage{}
+
+// isCredentialMetadata reports if the metadata key carries credentials.
+func isCredentialMetadata(key string) bool {
+	return strings.EqualFold(key, header.AuthenticationTokenContextKey) || strings.EqualFold(key, authorizationMetadataKey)
+}
+
+// Agents returns the connected agents, sorted by ID.
+func (s *DefaultBackendStorage) Agents() []AgentInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	agents := make([]AgentInfo, 0, len(s.backends))
+	for agentID, backends := range s.backends {
+		b := backends[0]
+		info := AgentInfo{
+			ID:             agentID,
+			Streams:        len(backends),
+			ConnectedAt:    s.connectedAt[b.conn],
+			Connections:    atomic.LoadInt64(&b.slots.connections),
+			MaxConnections: atomic.LoadInt64(&b.slots.maxConnections),
+			Cordoned:       s.cordoned[agentID],
+			GoingAway:      s.pickableLocked(agentID) == nil,
+		}
+		if md, ok := metadata.FromIncomingContext(b.Context()); ok {
+			info.Metadata = make(map[string][]string)
+			for k, v := range md {
+				if !isCredentialMetadata(k) {
+					info.Metadata[k] = v
+				}
+			}
+		}
+		agents = append(agents, info)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+// agentCordoner is implemented by the backend managers that can take
+// agents out of rotation.
+type agentCordoner interface {
+	Cordon(agentID string) error
+	Uncordon(agentID string) error
+}
+
+var _ agentCordoner = &DefaultBackendStorage{}
+
+// backendLeaver is implemented by the backend managers that can stop
+// picking the backend of an agent that is leaving, while its established
+// connections are still served.
+type backendLeaver interface {
+	GoAway(agentID string, conn agent.AgentService_ConnectServer)
+}
+
+var _ backendLeaver = &DefaultBackendStorage{}
+
+// GoAway stops picking the backend of conn for new connections. It is
+// removed with RemoveBackend once the agent closes the stream.
+func (s *DefaultBackendStorage) GoAway(agentID string, conn agent.AgentService_ConnectServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.backends[agentID] {
+		if b.conn == conn {
+			s.goingAway[conn] = true
+			return
+		}
+	}
+	klog.V(1).InfoS("Cannot find connection for agent going away in backends", "connection", conn, "agentID", agentID)
+}
+
+// pickableLocked returns the backend of agentID to send new connections to:
+// its first stream that is not going away, nil if there is none.
+func (s *DefaultBackendStorage) pickableLocked(agentID string) *backend {
+	for _, b := range s.backends[agentID] {
+		if !s.goingAway[b.conn] {
+			return b
+		}
+	}
+	return nil
+}
+
+// ErrUnknownAgent indicates that an agent is not connected.
+type ErrUnknownAgent struct {
+	AgentID string
+}
+
+// Error returns the error message.
+func (e *ErrUnknownAgent) Error() string {
+	return fmt.Sprintf("agent %q is not connected", e.AgentID)
+}
+
+// Cordon stops picking the agent for new connections. Its established
+// connections are not affected. The agent stays cordoned until it is
+// uncordoned or all its streams are closed.
+func (s *DefaultBackendStorage) Cordon(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.backends[agentID]; !ok {
+		return &ErrUnknownAgent{AgentID: agentID}
+	}
+	s.cordoned[agentID] = true
+	return nil
+}
+
+// Uncordon picks the agent for new connections again.
+func (s *DefaultBackendStorage) Uncordon(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.backends[agentID]; !ok {
+		return &ErrUnknownAgent{AgentID: agentID}
+	}
+	delete(s.cordoned, agentID)
+	return nil
+}
+
 // ErrNotFound indicates that no backend can be found.
 type ErrNotFound struct{}
 
@@ -192,16 +409,58 @@ func (e *ErrNotFound) Error() string {
 	return "No backend available"
 }
 
-// GetRandomBackend returns a random backend.
+// ErrNoCapacity indicates that all the backends serve their maximum number
+// of concurrent connections.
+type ErrNoCapacity struct{}
+
+// Error returns the error message.
+func (e *ErrNoCapacity) Error() string {
+	return "All backends are at capacity"
+}
+
+// GetRandomBackend returns a random backend. Backends whose agent serves its
+// maximum number of concurrent connections, that are cordoned, or that are
+// going away, are skipped. A connection slot of the returned backend is taken; it must be
+// returned with releaseBackend once the connection is done.
 func (s *DefaultBackendStorage) GetRandomBackend() (Backend, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.backends) == 0 {
 		return nil, &ErrNotFound{}
 	}
-	agentID := s.agentIDs[s.random.Intn(len(s.agentIDs))]
-	klog.V(4).InfoS("Pick agent as backend", "agentID", agentID)
-	// always return the first connection to an agent, because the agent
-	// will close later connections if there are multiple.
-	return s.backends[agentID][0], nil
+	// The agents are tried in a random order, so that the dials an agent
+	// cannot take are spread over the others.
+	available := false
+	for _, i := range s.random.Perm(len(s.agentIDs)) {
+		agentID := s.agentIDs[i]
+		if s.cordoned[agentID] {
+			klog.V(4).InfoS("Skip cordoned agent", "agentID", agentID)
+			continue
+		}
+		// always return the first connection to an agent, because the agent
+		// will close later connections if there are multiple.
+		b := s.pickableLocked(agentID)
+		if b == nil {
+			klog.V(4).InfoS("Skip agent going away", "agentID", agentID)
+			continue
+		}
+		available = true
+		if b.acquire() {
+			klog.V(4).InfoS("Pick agent as backend", "agentID", agentID)
+			return b, nil
+		}
+		klog.V(4).InfoS("Skip agent at capacity", "agentID", agentID)
+	}
+	if !available {
+		return nil, &ErrNotFound{}
+	}
+	return nil, &ErrNoCapacity{}
+}
+
+// releaseBackend returns a connection slot taken when the backend was
+// picked.
+func releaseBackend(b Backend) {
+	if c, ok := b.(connectionCounter); ok {
+		c.release()
+	}
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package server
 
 import (
+	"math/rand"
 	"reflect"
 	"testing"
 
@@ -36,7 +37,7 @@ func TestAddRemoveBackends(t *testing.T) {
 
 	p := NewDefaultBackendManager()
 
-	p.AddBackend("agent1", conn1)
+	p.AddBackend("agent1", conn1, 0)
 	p.RemoveBackend("agent1", conn1)
 	expectedBackends := make(map[string][]*backend)
 	expectedAgentIDs := []string{}
@@ -48,21 +49,21 @@ func TestAddRemoveBackends(t *testing.T) {
 	}
 
 	p = NewDefaultBackendManager()
-	p.AddBackend("agent1", conn1)
-	p.AddBackend("agent1", conn12)
+	p.AddBackend("agent1", conn1, 0)
+	p.AddBackend("agent1", conn12, 0)
 	// Adding the same connection again should be a no-op.
-	p.AddBackend("agent1", conn12)
-	p.AddBackend("agent2", conn2)
-	p.AddBackend("agent2", conn22)
-	p.AddBackend("agent3", conn3)
+	p.AddBackend("agent1", conn12, 0)
+	p.AddBackend("agent2", conn2, 0)
+	p.AddBackend("agent2", conn22, 0)
+	p.AddBackend("agent3", conn3, 0)
 	p.RemoveBackend("agent2", conn22)
 	p.RemoveBackend("agent2", conn2)
 	p.RemoveBackend("agent1", conn1)
 	// This is invalid. agent1 doesn't have conn3. This should be a no-op.
 	p.RemoveBackend("agent1", conn3)
 	expectedBackends = map[string][]*backend{
-		"agent1": []*backend{newBackend(conn12)},
-		"agent3": []*backend{newBackend(conn3)},
+		"agent1": []*backend{newBackend(conn12, &agentSlots{})},
+		"agent3": []*backend{newBackend(conn3, &agentSlots{})},
 	}
 	expectedAgentIDs = []string{"agent1", "agent3"}
 	if e, a := expectedBackends, p.backends; !reflect.DeepEqual(e, a) {
@@ -72,3 +73,192 @@ func TestAddRemoveBackends(t *testing.T) {
 		t.Errorf("expected %v, got %v", e, a)
 	}
 }
+
+func TestGetRandomBackendCapacity(t *testing.T) {
+	conn1 := new(fakeAgentService_ConnectServer)
+	conn2 := new(fakeAgentService_ConnectServer)
+
+	p := NewDefaultBackendManager()
+	p.AddBackend("agent1", conn1, 1)
+	p.AddBackend("agent2", conn2, 1)
+
+	b1, err := p.Backend(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := p.Backend(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1 == b2 {
+		t.Errorf("expected the agent at capacity to be skipped")
+	}
+	if _, err := p.Backend(nil); err == nil {
+		t.Errorf("expected an error when all agents are at capacity")
+	} else if _, ok := err.(*ErrNoCapacity); !ok {
+		t.Errorf("expected ErrNoCapacity, got %v", err)
+	}
+
+	releaseBackend(b1)
+	b3, err := p.Backend(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b3 != b1 {
+		t.Errorf("expected the released backend to be picked")
+	}
+
+	// The connections of agent1 are counted across its streams.
+	p.AddBackend("agent1", new(fakeAgentService_ConnectServer), 1)
+	p.RemoveBackend("agent1", conn1)
+	if _, err := p.Backend(nil); err == nil {
+		t.Errorf("expected the new stream of an agent at capacity to be skipped")
+	}
+}
+
+func TestGetRandomBackendSpread(t *testing.T) {
+	p := NewDefaultBackendManager()
+	p.random = rand.New(rand.NewSource(1))
+	backends := make(map[Backend]string)
+	for _, agentID := range []string{"agent1", "agent2", "agent3"} {
+		backends[p.AddBackend(agentID, new(fakeAgentService_ConnectServer), 0)] = agentID
+	}
+	if err := p.Cordon("agent1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The share of the cordoned agent is spread over the others, instead
+	// of going to the agent after it.
+	picks := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		b, err := p.Backend(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[backends[b]]++
+		releaseBackend(b)
+	}
+	for _, agentID := range []string{"agent2", "agent3"} {
+		if n := picks[agentID]; n < 1200 || n > 1800 {
+			t.Errorf("expected about half of the picks for %s, got %v", agentID, picks)
+		}
+	}
+}
+
+func TestGetRandomBackendCordoned(t *testing.T) {
+	conn1 := new(fakeAgentService_ConnectServer)
+	conn2 := new(fakeAgentService_ConnectServer)
+
+	p := NewDefaultBackendManager()
+	if err := p.Cordon("agent1"); err == nil {
+		t.Errorf("expected an error cordoning an unknown agent")
+	}
+	b1 := p.AddBackend("agent1", conn1, 0)
+	p.AddBackend("agent2", conn2, 0)
+
+	if err := p.Cordon("agent2"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b, err := p.Backend(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != b1 {
+			t.Fatalf("expected the cordoned agent to be skipped")
+		}
+		releaseBackend(b)
+	}
+
+	if err := p.Cordon("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Backend(nil); err == nil {
+		t.Errorf("expected an error when all agents are cordoned")
+	} else if _, ok := err.(*ErrNotFound); !ok {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := p.Uncordon("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Backend(nil)
+	if err != nil {
+		t.Fatalf("expected the uncordoned agent to be picked, got %v", err)
+	}
+	releaseBackend(b)
+
+	// The cordon is forgotten once the agent disconnects.
+	p.RemoveBackend("agent2", conn2)
+	if _, ok := p.cordoned["agent2"]; ok {
+		t.Errorf("expected the disconnected agent to be uncordoned")
+	}
+	if err := p.Uncordon("agent2"); err == nil {
+		t.Errorf("expected an error uncordoning a disconnected agent")
+	}
+	p.AddBackend("agent2", conn2, 0)
+	if p.cordoned["agent2"] {
+		t.Errorf("expected the reconnected agent not to be cordoned")
+	}
+}
+
+func TestGoAwayBackend(t *testing.T) {
+	conn1 := new(fakeAgentService_ConnectServer)
+	conn2 := new(fakeAgentService_ConnectServer)
+	conn3 := new(fakeAgentService_ConnectServer)
+
+	p := NewDefaultBackendManager()
+	b1 := p.AddBackend("agent1", conn1, 0)
+	b2 := p.AddBackend("agent2", conn2, 2)
+	if !b2.(*backend).acquire() {
+		t.Fatal("expected a connection slot")
+	}
+	if err := p.Cordon("agent2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// agent2 leaves, its established connection and its cordon are kept.
+	p.GoAway("agent2", conn2)
+	if !p.cordoned["agent2"] {
+		t.Errorf("expected the agent going away to stay cordoned")
+	}
+	if n := b2.(*backend).slots.connections; n != 1 {
+		t.Errorf("expected the connection of the agent going away to be counted, got %d", n)
+	}
+	if err := p.Uncordon("agent2"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b, err := p.Backend(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != b1 {
+			t.Fatalf("expected the agent going away to be skipped")
+		}
+		releaseBackend(b)
+	}
+
+	p.GoAway("agent1", conn1)
+	if _, err := p.Backend(nil); err == nil {
+		t.Errorf("expected an error when all agents are going away")
+	} else if _, ok := err.(*ErrNotFound); !ok {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// The new stream of agent1 is picked, the stream going away is removed
+	// once closed.
+	b3 := p.AddBackend("agent1", conn3, 0)
+	b, err := p.Backend(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != b3 {
+		t.Errorf("expected the new stream of the agent to be picked")
+	}
+	releaseBackend(b)
+	p.RemoveBackend("agent1", conn1)
+	if len(p.goingAway) != 1 || !p.goingAway[conn2] {
+		t.Errorf("expected only the stream of agent2 to be going away, got %v", p.goingAway)
+	}
+}
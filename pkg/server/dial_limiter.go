@@ -0,0 +1,197 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"k8s.io/client-go/util/flowcontrol"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+const (
+	// limiterIdleTimeout is how long a per-key rate limiter is kept after
+	// its last use.
+	limiterIdleTimeout = 10 * time.Minute
+	// limiterGCInterval is the minimal interval between two sweeps of the
+	// idle rate limiters.
+	limiterGCInterval = time.Minute
+)
+
+// DialLimiterOptions configures the DialLimiter. A zero QPS or MaxPendingDials
+// disables the corresponding limit.
+type DialLimiterOptions struct {
+	// FrontendQPS and FrontendBurst configure the token bucket of every
+	// frontend identity.
+	FrontendQPS   float32
+	FrontendBurst int
+	// AgentQPS and AgentBurst configure the token bucket of every agent.
+	AgentQPS   float32
+	AgentBurst int
+	// MaxPendingDials caps the number of dials waiting for a DIAL_RSP.
+	MaxPendingDials int
+}
+
+// ErrDialRateLimited indicates that a dial request was rejected to protect
+// the proxy server or the agents from overload.
+type ErrDialRateLimited struct {
+	Reason metrics.RateLimitReason
+}
+
+// Error returns the error message.
+func (e *ErrDialRateLimited) Error() string {
+	switch e.Reason {
+	case metrics.RateLimitFrontend:
+		return "dial rate limited: too many dial requests from frontend"
+	case metrics.RateLimitAgent:
+		return "dial rate limited: too many dial requests to agent"
+	case metrics.RateLimitPendingDials:
+		return "dial rate limited: too many pending dials"
+	default:
+		return fmt.Sprintf("dial rate limited: %s", e.Reason)
+	}
+}
+
+type limiterEntry struct {
+	limiter  flowcontrol.RateLimiter
+	lastUsed time.Time
+}
+
+// DialLimiter decides whether a dial request is forwarded to an agent, based
+// on per frontend and per agent token buckets and on a global cap of pending
+// dials.
+type DialLimiter struct {
+	mu        sync.Mutex // protects the following
+	opts      DialLimiterOptions
+	frontends map[string]*limiterEntry
+	agents    map[string]*limiterEntry
+	lastGC    time.Time
+}
+
+// NewDialLimiter creates a DialLimiter.
+func NewDialLimiter(opts DialLimiterOptions) *DialLimiter {
+	return &DialLimiter{
+		opts:      opts,
+		frontends: make(map[string]*limiterEntry),
+		agents:    make(map[string]*limiterEntry),
+		lastGC:    time.Now(),
+	}
+}
+
+// SetOptions replaces the options of the limiter. The token buckets are
+// reset.
+func (l *DialLimiter) SetOptions(opts DialLimiterOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.opts = opts
+	l.frontends = make(map[string]*limiterEntry)
+	l.agents = make(map[string]*limiterEntry)
+}
+
+// tryAcceptLocked takes a token from the bucket of key in limiters, creating
+// the bucket if needed.
+func (l *DialLimiter) tryAcceptLocked(limiters map[string]*limiterEntry, key string, qps float32, burst int, now time.Time) bool {
+	e, ok := limiters[key]
+	if !ok {
+		if burst <= 0 {
+			burst = 1
+		}
+		e = &limiterEntry{limiter: flowcontrol.NewTokenBucketRateLimiter(qps, burst)}
+		limiters[key] = e
+	}
+	e.lastUsed = now
+	return e.limiter.TryAccept()
+}
+
+// gcLocked drops the rate limiters that have not been used recently.
+func (l *DialLimiter) gcLocked(now time.Time) {
+	if now.Sub(l.lastGC) < limiterGCInterval {
+		return
+	}
+	l.lastGC = now
+	for _, limiters := range []map[string]*limiterEntry{l.frontends, l.agents} {
+		for key, e := range limiters {
+			if now.Sub(e.lastUsed) > limiterIdleTimeout {
+				delete(limiters, key)
+			}
+		}
+	}
+}
+
+// AllowFrontend checks the pending dial cap and the rate limit of the
+// frontend identity. It must be called before a backend is picked.
+func (l *DialLimiter) AllowFrontend(identity string, pendingDials int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.MaxPendingDials > 0 && pendingDials >= l.opts.MaxPendingDials {
+		return l.reject(metrics.RateLimitPendingDials)
+	}
+	if l.opts.FrontendQPS <= 0 {
+		return nil
+	}
+	// Frontends without client certificates are identified by their
+	// address, of which only the host is stable across connections.
+	if host, _, err := net.SplitHostPort(identity); err == nil {
+		identity = host
+	}
+	now := time.Now()
+	l.gcLocked(now)
+	if !l.tryAcceptLocked(l.frontends, identity, l.opts.FrontendQPS, l.opts.FrontendBurst, now) {
+		return l.reject(metrics.RateLimitFrontend)
+	}
+	return nil
+}
+
+// AllowAgent checks the rate limit of the agent serving the backend.
+func (l *DialLimiter) AllowAgent(backend Backend) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.AgentQPS <= 0 {
+		return nil
+	}
+	agentID := backendAgentID(backend)
+	now := time.Now()
+	l.gcLocked(now)
+	if !l.tryAcceptLocked(l.agents, agentID, l.opts.AgentQPS, l.opts.AgentBurst, now) {
+		return l.reject(metrics.RateLimitAgent)
+	}
+	return nil
+}
+
+func (l *DialLimiter) reject(reason metrics.RateLimitReason) error {
+	metrics.Metrics.ObserveDialRateLimited(reason)
+	return &ErrDialRateLimited{Reason: reason}
+}
+
+// backendAgentID returns the ID the agent of the backend announced when it
+// connected.
+func backendAgentID(backend Backend) string {
+	md, ok := metadata.FromIncomingContext(backend.Context())
+	if !ok {
+		return ""
+	}
+	agentIDs := md.Get(header.AgentID)
+	if len(agentIDs) != 1 {
+		return ""
+	}
+	return agentIDs[0]
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+// fakeBackend implements Backend
+type fakeBackend struct {
+	ctx  context.Context
+	sent []*client.Packet
+}
+
+func newFakeBackend(agentID string) *fakeBackend {
+	md := metadata.Pairs(header.AgentID, agentID)
+	return &fakeBackend{ctx: metadata.NewIncomingContext(context.Background(), md)}
+}
+
+func (b *fakeBackend) Send(p *client.Packet) error {
+	b.sent = append(b.sent, p)
+	return nil
+}
+
+func (b *fakeBackend) Context() context.Context {
+	return b.ctx
+}
+
+func expectRateLimited(t *testing.T, err error, reason metrics.RateLimitReason) {
+	t.Helper()
+	e, ok := err.(*ErrDialRateLimited)
+	if !ok {
+		t.Fatalf("expected ErrDialRateLimited, got %v", err)
+	}
+	if e.Reason != reason {
+		t.Errorf("expected reason %q, got %q", reason, e.Reason)
+	}
+}
+
+func TestDialLimiterFrontend(t *testing.T) {
+	l := NewDialLimiter(DialLimiterOptions{FrontendQPS: 0.001, FrontendBurst: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := l.AllowFrontend("10.0.0.1:1234", 0); err != nil {
+			t.Fatalf("request %d: unexpected error %v", i, err)
+		}
+	}
+	// The port is not part of the identity of the frontend.
+	expectRateLimited(t, l.AllowFrontend("10.0.0.1:5678", 0), metrics.RateLimitFrontend)
+	// Other frontends have their own bucket.
+	if err := l.AllowFrontend("kube-apiserver", 0); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDialLimiterPendingDials(t *testing.T) {
+	l := NewDialLimiter(DialLimiterOptions{MaxPendingDials: 2})
+
+	if err := l.AllowFrontend("kube-apiserver", 1); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	expectRateLimited(t, l.AllowFrontend("kube-apiserver", 2), metrics.RateLimitPendingDials)
+}
+
+func TestDialLimiterAgent(t *testing.T) {
+	l := NewDialLimiter(DialLimiterOptions{AgentQPS: 0.001, AgentBurst: 1})
+	agent1, agent2 := newFakeBackend("agent1"), newFakeBackend("agent2")
+
+	if err := l.AllowAgent(agent1); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	expectRateLimited(t, l.AllowAgent(agent1), metrics.RateLimitAgent)
+	if err := l.AllowAgent(agent2); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRateLimitedDialResponse(t *testing.T) {
+	p := NewProxyServer("", 1, nil)
+	p.DialLimiter = NewDialLimiter(DialLimiterOptions{MaxPendingDials: 1})
+	p.PendingDial.Add(1, &ProxyClientConnection{})
+
+	frontend := &fakeFrontend{sent: make(chan *client.Packet, 10)}
+	recvCh := make(chan *client.Packet, 1)
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{Protocol: "tcp", Address: "127.0.0.1:80", Random: 111}},
+	}
+	close(recvCh)
+	p.serveRecvFrontend(frontend, "", recvCh)
+
+	select {
+	case pkt := <-frontend.sent:
+		resp := pkt.GetDialResponse()
+		if pkt.Type != client.PacketType_DIAL_RSP || resp.Random != 111 || resp.Error == "" {
+			t.Errorf("expected a failed DIAL_RSP for random 111, got %+v", pkt)
+		}
+	default:
+		t.Fatal("expected a DIAL_RSP to be sent to the frontend")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// drainPollInterval is how often Drain checks whether the connections are
+// done.
+const drainPollInterval = 100 * time.Millisecond
+
+// ErrDraining indicates that the proxy server is shutting down and does not
+// accept new connections.
+type ErrDraining struct{}
+
+// Error returns the error message.
+func (e *ErrDraining) Error() string {
+	return "proxy server is draining"
+}
+
+// draining returns a channel closed when the proxy server starts draining.
+func (s *ProxyServer) draining() <-chan struct{} {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.drainCh == nil {
+		s.drainCh = make(chan struct{})
+	}
+	return s.drainCh
+}
+
+// isDraining returns if the proxy server is draining.
+func (s *ProxyServer) isDraining() bool {
+	select {
+	case <-s.draining():
+		return true
+	default:
+		return false
+	}
+}
+
+// Ready reports the proxy server as not ready once it is draining, and
+// otherwise defers to Readiness.
+func (s *ProxyServer) Ready() (bool, string) {
+	if s.isDraining() {
+		return false, "proxy server is draining"
+	}
+	return s.Readiness.Ready()
+}
+
+// StartDrain marks the proxy server as draining: it reports as not ready,
+// new dial requests and agent connections are rejected with ErrDraining, and
+// the connected agents are sent a GOAWAY so that they reconnect to another
+// proxy server. It does not wait for the established connections.
+func (s *ProxyServer) StartDrain() {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.drainCh == nil {
+		s.drainCh = make(chan struct{})
+	}
+	select {
+	case <-s.drainCh:
+	default:
+		klog.V(1).InfoS("Draining proxy server", "serverID", s.serverID)
+		close(s.drainCh)
+	}
+}
+
+// Drain prepares the proxy server for shutting down, starting to drain it as
+// of StartDrain if it is not already. Drain then waits for the established
+// connections and the pending dials to finish. The connections still open
+// when ctx is done are closed, and the error of ctx is returned.
+func (s *ProxyServer) Drain(ctx context.Context) error {
+	s.StartDrain()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		frontends := s.listFrontends()
+		if len(frontends) == 0 && s.PendingDial.Len() == 0 {
+			klog.V(1).InfoS("Proxy server drained", "serverID", s.serverID)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			klog.V(1).InfoS("Closing connections left after drain timeout", "count", len(frontends))
+			for _, frontend := range frontends {
+				s.closeFrontend(frontend, "proxy server is shutting down")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// listFrontends returns the established connections.
+func (s *ProxyServer) listFrontends() []*ProxyClientConnection {
+	s.fmu.RLock()
+	defer s.fmu.RUnlock()
+	var ret []*ProxyClientConnection
+	for _, conns := range s.frontends {
+		for _, c := range conns {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// sendGoAway tells the agent of the backend to connect to another proxy
+// server, once the proxy server starts draining.
+func (s *ProxyServer) sendGoAway(backend Backend, agentID string) {
+	klog.V(2).InfoS("Send GOAWAY to agent", "agentID", agentID)
+	pkt := &client.Packet{
+		Type: client.PacketType_GOAWAY,
+		Payload: &client.Packet_GoAway{
+			GoAway: &client.GoAway{
+				Reason: "proxy server is draining",
+			},
+		},
+	}
+	if err := backend.Send(pkt); err != nil {
+		klog.ErrorS(err, "GOAWAY to Backend failed", "agentID", agentID)
+	}
+}
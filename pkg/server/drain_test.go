@@ -0,0 +1,196 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/metadata"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	agentmock "sigs.k8s.io/apiserver-network-proxy/proto/agent/mocks"
+	"sigs.k8s.io/apiserver-network-proxy/proto/header"
+)
+
+func addTestFrontend(p *ProxyServer, backend Backend, connID int64) *fakeFrontend {
+	frontend := &fakeFrontend{sent: make(chan *client.Packet, 10)}
+	p.addFrontend("agent1", connID, &ProxyClientConnection{
+		Mode:      "grpc",
+		Grpc:      frontend,
+		connectID: connID,
+		agentID:   "agent1",
+		start:     time.Now(),
+		backend:   backend,
+	})
+	return frontend
+}
+
+func TestDrainRejectsNewDials(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p, ts := newTunnelTestServer(backend, time.Second)
+	defer ts.Close()
+	p.BackendManager.AddBackend("agent1", new(fakeAgentService_ConnectServer), 0)
+	p.Readiness = p.BackendManager.(ReadinessManager)
+	if ready, msg := p.Ready(); !ready {
+		t.Fatalf("expected ready before draining, got %q", msg)
+	}
+
+	addTestFrontend(p, backend, 1)
+	done := make(chan error)
+	go func() {
+		done <- p.Drain(context.Background())
+	}()
+
+	// Wait for the drain to start.
+	for !p.isDraining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ready, msg := p.Ready(); ready || msg != "proxy server is draining" {
+		t.Errorf("expected not ready while draining, got (%v, %q)", ready, msg)
+	}
+	if _, err := p.pickBackend("frontend"); err == nil {
+		t.Errorf("expected new dials to be rejected")
+	} else if _, ok := err.(*ErrDraining); !ok {
+		t.Errorf("expected ErrDraining, got %v", err)
+	}
+	conn, _, res := connectThroughTunnel(t, ts.Listener.Addr().String())
+	conn.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected drain to wait for the connection, returned %v", err)
+	case <-time.After(2 * drainPollInterval):
+	}
+	p.removeFrontend("agent1", 1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected drain to complete, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected drain to complete once the connection is closed")
+	}
+}
+
+func TestStartDrain(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p := NewProxyServer("", 1, nil)
+	p.BackendManager.AddBackend("agent1", new(fakeAgentService_ConnectServer), 0)
+	p.Readiness = p.BackendManager.(ReadinessManager)
+	addTestFrontend(p, backend, 1)
+
+	// StartDrain returns with the connection still open.
+	p.StartDrain()
+	if ready, msg := p.Ready(); ready || msg != "proxy server is draining" {
+		t.Errorf("expected not ready once draining, got (%v, %q)", ready, msg)
+	}
+	if len(p.listFrontends()) != 1 {
+		t.Errorf("expected the connection to be left open")
+	}
+	p.StartDrain()
+	p.removeFrontend("agent1", 1)
+	if err := p.Drain(context.Background()); err != nil {
+		t.Errorf("expected drain to complete, got %v", err)
+	}
+}
+
+func TestDrainTimeoutClosesConnections(t *testing.T) {
+	p := NewProxyServer("", 1, nil)
+	backend := newFakeBackend("agent1")
+	frontend := addTestFrontend(p, backend, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*drainPollInterval)
+	defer cancel()
+	if err := p.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if _, err := p.getFrontend("agent1", 1); err == nil {
+		t.Error("expected the connection to be removed")
+	}
+	select {
+	case pkt := <-frontend.sent:
+		if pkt.Type != client.PacketType_CLOSE_RSP {
+			t.Errorf("expected CLOSE_RSP, got %v", pkt)
+		}
+	default:
+		t.Error("expected CLOSE_RSP to be sent to the frontend")
+	}
+	if len(backend.sent) != 1 || backend.sent[0].Type != client.PacketType_CLOSE_REQ {
+		t.Errorf("expected CLOSE_REQ to be sent to the agent, got %v", backend.sent)
+	}
+}
+
+func TestDrainSendsGoAway(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(header.AgentID, "agent1"))
+	closeStream := make(chan struct{})
+	sent := make(chan *client.Packet, 1)
+	conn := agentmock.NewMockAgentService_ConnectServer(stub)
+	conn.EXPECT().Context().AnyTimes().Return(ctx)
+	conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
+	conn.EXPECT().Recv().DoAndReturn(func() (*client.Packet, error) {
+		<-closeStream
+		return nil, io.EOF
+	})
+	conn.EXPECT().Send(gomock.Any()).DoAndReturn(func(pkt *client.Packet) error {
+		sent <- pkt
+		return nil
+	})
+
+	p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{})
+	connectErr := make(chan error)
+	go func() {
+		connectErr <- p.Connect(conn)
+	}()
+	for p.BackendManager.NumBackends() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := p.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pkt := <-sent:
+		if pkt.Type != client.PacketType_GOAWAY || pkt.GetGoAway().Reason == "" {
+			t.Errorf("expected GOAWAY with a reason, got %v", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected GOAWAY to be sent to the agent")
+	}
+
+	close(closeStream)
+	if err := <-connectErr; err != nil {
+		t.Errorf("expected agent stream to end without error, got %v", err)
+	}
+
+	// New agents are turned away.
+	if err := p.Connect(conn); err == nil {
+		t.Error("expected agent connection to be rejected while draining")
+	} else if _, ok := err.(*ErrDraining); !ok {
+		t.Errorf("expected ErrDraining, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// forwardIdleConnTimeout is how long the connections to the destinations of
+// forwarded requests are kept open between requests.
+const forwardIdleConnTimeout = 90 * time.Second
+
+type forwardContextKey int
+
+const (
+	// forwardUserAgentKey is the context key of the user agent of a
+	// forwarded request, recorded in the audit log of the connections
+	// dialed for it.
+	forwardUserAgentKey forwardContextKey = iota
+	// forwardIdentityKey is the context key of the frontend identity of a
+	// forwarded request, to which the connections dialed for it are
+	// accounted.
+	forwardIdentityKey
+)
+
+// forwardDialError is the error of an agent dial for a forwarded request.
+type forwardDialError struct {
+	err error
+}
+
+func (e *forwardDialError) Error() string {
+	return e.err.Error()
+}
+
+// forwardPool keeps the connections to the destinations of the requests
+// forwarded for a pool key alive.
+type forwardPool struct {
+	transport *http.Transport
+	// active is the number of requests being forwarded through transport.
+	active int
+	// lastUsed is when the last request through transport finished.
+	lastUsed time.Time
+}
+
+// serveForward forwards a request with an absolute URI to its destination,
+// through a connection dialed by an agent. The hop-by-hop headers are
+// stripped, and the connection is kept alive for the next requests of the
+// same pool to the same destination: pool is the authenticated identity of
+// the frontend, or empty for the unauthenticated ones, which share their
+// connections.
+func (t *Tunnel) serveForward(w http.ResponseWriter, r *http.Request, identity, pool string) {
+	if r.URL.Scheme != "http" {
+		http.Error(w, fmt.Sprintf("unsupported scheme %q, use CONNECT", r.URL.Scheme), http.StatusBadRequest)
+		return
+	}
+	transport := t.acquireForwardTransport(pool)
+	defer t.releaseForwardTransport(pool)
+	proxy := &httputil.ReverseProxy{
+		// The request URI is already the destination.
+		Director:  func(*http.Request) {},
+		Transport: transport,
+		// Stream the response back as it is received.
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			var dialErr *forwardDialError
+			if errors.As(err, &dialErr) {
+				writeDialError(w, req.Host, dialErr.err)
+				return
+			}
+			klog.V(2).InfoS("Failed to forward request", "host", req.Host, "err", err)
+			http.Error(w, fmt.Sprintf("failed to forward request to %s: %v", req.Host, err), http.StatusBadGateway)
+		},
+	}
+	ctx := context.WithValue(r.Context(), forwardUserAgentKey, r.UserAgent())
+	ctx = context.WithValue(ctx, forwardIdentityKey, identity)
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// acquireForwardTransport returns the transport of the requests forwarded
+// for pool, and evicts the pools left unused for forwardIdleConnTimeout.
+// Connections are not shared between authenticated identities, so that
+// every connection is accounted to the frontend it was dialed for.
+func (t *Tunnel) acquireForwardTransport(pool string) *http.Transport {
+	t.forwardMu.Lock()
+	defer t.forwardMu.Unlock()
+	if t.forwardPools == nil {
+		t.forwardPools = make(map[string]*forwardPool)
+	}
+	now := time.Now()
+	for key, p := range t.forwardPools {
+		if key != pool && p.active == 0 && now.Sub(p.lastUsed) >= forwardIdleConnTimeout {
+			p.transport.CloseIdleConnections()
+			delete(t.forwardPools, key)
+		}
+	}
+	p, ok := t.forwardPools[pool]
+	if !ok {
+		p = &forwardPool{
+			transport: &http.Transport{
+				DialContext: t.dialForward,
+				// Leave the content encoding to the client.
+				DisableCompression: true,
+				IdleConnTimeout:    forwardIdleConnTimeout,
+			},
+		}
+		t.forwardPools[pool] = p
+	}
+	p.active++
+	return p.transport
+}
+
+// releaseForwardTransport records the end of a request forwarded for pool.
+func (t *Tunnel) releaseForwardTransport(pool string) {
+	t.forwardMu.Lock()
+	defer t.forwardMu.Unlock()
+	if p, ok := t.forwardPools[pool]; ok {
+		p.active--
+		p.lastUsed = time.Now()
+	}
+}
+
+// dialForward dials address through an agent for the frontend of the
+// request of ctx, and returns the connection to it.
+func (t *Tunnel) dialForward(ctx context.Context, network, address string) (net.Conn, error) {
+	identity, _ := ctx.Value(forwardIdentityKey).(string)
+	userAgent, _ := ctx.Value(forwardUserAgentKey).(string)
+	connection := &ProxyClientConnection{
+		Mode:      "http-forward",
+		connected: make(chan struct{}),
+		start:     time.Now(),
+		identity:  identity,
+		userAgent: userAgent,
+		address:   address,
+	}
+	if err := t.dial(connection, ctx.Done()); err != nil {
+		return nil, &forwardDialError{err: err}
+	}
+
+	local, remote := net.Pipe()
+	if err := connection.attach(local); err != nil {
+		klog.ErrorS(err, "failed to write to connection")
+	}
+	go func() {
+		defer local.Close()
+		t.forwardToAgent(connection, local)
+	}()
+	return remote, nil
+}
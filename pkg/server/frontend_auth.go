@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// authorizationMetadataKey is the gRPC metadata key of the credentials of
+// the frontend clients, e.g. "Bearer <token>".
+const authorizationMetadataKey = "authorization"
+
+type frontendIdentityKey struct{}
+
+// WithFrontendIdentity returns a copy of ctx carrying the identity of the
+// frontend client.
+func WithFrontendIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, frontendIdentityKey{}, identity)
+}
+
+// FrontendIdentityFromContext returns the identity of the frontend client
+// attached to ctx by FrontendAuthInterceptor.
+func FrontendIdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(frontendIdentityKey{}).(string)
+	return identity, ok
+}
+
+// identityServerStream overrides the context of a server stream.
+type identityServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// FrontendAuthInterceptor returns a stream interceptor attaching the
+// identity of the gRPC frontend clients to the stream context. If
+// authenticator is not nil, the clients must send credentials it accepts in
+// the "authorization" metadata, and are identified by the authenticated
+// user. Otherwise they are identified by their client certificate or peer
+// address.
+func FrontendAuthInterceptor(authenticator ProxyAuthenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		identity := frontendIdentity(ctx)
+		if authenticator != nil {
+			var authorization string
+			if md, ok := metadata.FromIncomingContext(ctx); ok {
+				if values := md.Get(authorizationMetadataKey); len(values) == 1 {
+					authorization = values[0]
+				}
+			}
+			user, err := authenticateProxyRequest(authenticator, authorization)
+			if err != nil {
+				klog.V(2).InfoS("Rejected unauthenticated frontend", "frontend", identity, "err", err)
+				return status.Error(codes.Unauthenticated, err.Error())
+			}
+			klog.V(2).InfoS("Authenticated frontend", "frontend", identity, "user", user)
+			identity = user
+		}
+		return handler(srv, &identityServerStream{ServerStream: ss, ctx: WithFrontendIdentity(ctx, identity)})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// contextServerStream is a server stream of which only the context is used.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestFrontendAuthInterceptor(t *testing.T) {
+	path := writeTempFile(t, "token1,kube-apiserver\n")
+	defer os.Remove(path)
+	tokenFile, err := NewTokenFileProxyAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &PeerCredAddr{Addr: &net.UnixAddr{Name: "@", Net: "unix"}, Cred: PeerCred{UID: 1000, GID: 100}}
+
+	testCases := []struct {
+		desc          string
+		authenticator ProxyAuthenticator
+		authorization []string
+		wantIdentity  string
+		wantCode      codes.Code
+	}{
+		{
+			desc:         "no authentication",
+			wantIdentity: "uid=1000,gid=100",
+		},
+		{
+			desc:          "valid token",
+			authenticator: tokenFile,
+			authorization: []string{"Bearer token1"},
+			wantIdentity:  "kube-apiserver",
+		},
+		{
+			desc:          "invalid token",
+			authenticator: tokenFile,
+			authorization: []string{"Bearer token2"},
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			desc:          "no token",
+			authenticator: tokenFile,
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			desc:          "several tokens",
+			authenticator: tokenFile,
+			authorization: []string{"Bearer token1", "Bearer token1"},
+			wantCode:      codes.Unauthenticated,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			md := metadata.MD{}
+			for _, a := range tc.authorization {
+				md.Append(authorizationMetadataKey, a)
+			}
+			ctx := peer.NewContext(metadata.NewIncomingContext(context.Background(), md), &peer.Peer{Addr: addr})
+
+			var identity string
+			handled := false
+			handler := func(srv interface{}, stream grpc.ServerStream) error {
+				handled = true
+				identity = frontendIdentity(stream.Context())
+				return nil
+			}
+			err := FrontendAuthInterceptor(tc.authenticator)(nil, &contextServerStream{ctx: ctx}, &grpc.StreamServerInfo{}, handler)
+			if tc.wantCode != codes.OK {
+				if status.Code(err) != tc.wantCode || handled {
+					t.Errorf("expected the stream to be rejected with %v, got %v", tc.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity != tc.wantIdentity {
+				t.Errorf("expected identity %q, got %q", tc.wantIdentity, identity)
+			}
+		})
+	}
+}
@@ -24,9 +24,47 @@ import (
 
 type Direction string
 
+// RateLimitReason is the limit that caused a dial request to be rejected.
+type RateLimitReason string
+
+// ReapReason is the reason why an inactive or long-lived connection was
+// closed by the proxy server.
+type ReapReason string
+
+// AuthResult is the result of the authentication of a frontend request.
+type AuthResult string
+
+// CacheResult is the result of a lookup in a cache.
+type CacheResult string
+
 const (
 	namespace = "konnectivity_network_proxy"
 	subsystem = "server"
+
+	// RateLimitFrontend indicates that the frontend exceeded its dial rate.
+	RateLimitFrontend RateLimitReason = "frontend"
+	// RateLimitAgent indicates that the selected agent exceeded its dial rate.
+	RateLimitAgent RateLimitReason = "agent"
+	// RateLimitPendingDials indicates that too many dials were pending.
+	RateLimitPendingDials RateLimitReason = "pending_dials"
+
+	// ReapIdleTimeout indicates that no data was sent over the connection,
+	// in either direction, for longer than the idle timeout.
+	ReapIdleTimeout ReapReason = "idle_timeout"
+	// ReapMaxLifetime indicates that the connection lived longer than the
+	// maximum connection lifetime.
+	ReapMaxLifetime ReapReason = "max_lifetime"
+
+	// AuthSuccess indicates that the frontend presented valid credentials.
+	AuthSuccess AuthResult = "success"
+	// AuthFailure indicates that the frontend presented missing or invalid
+	// credentials.
+	AuthFailure AuthResult = "failure"
+
+	// CacheHit indicates that the result was found in the cache.
+	CacheHit CacheResult = "hit"
+	// CacheMiss indicates that the result was not in the cache, or expired.
+	CacheMiss CacheResult = "miss"
 )
 
 var (
@@ -39,7 +77,15 @@ var (
 
 // ServerMetrics includes all the metrics of the proxy server.
 type ServerMetrics struct {
-	latencies *prometheus.HistogramVec
+	latencies    *prometheus.HistogramVec
+	rateLimited  *prometheus.CounterVec
+	pendingDials prometheus.Gauge
+	reaped       *prometheus.CounterVec
+	frontendAuth *prometheus.CounterVec
+	certExpiry   *prometheus.GaugeVec
+	tokenReviews *prometheus.HistogramVec
+	tokenCache   *prometheus.CounterVec
+	auditDropped prometheus.Counter
 }
 
 // newServerMetrics create a new ServerMetrics, configured with default metric names.
@@ -54,16 +100,156 @@ func newServerMetrics() *ServerMetrics {
 		},
 		[]string{},
 	)
+	rateLimited := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dial_rate_limited_total",
+			Help:      "Count of dial requests rejected by rate limiting, labeled by the reason (frontend, agent or pending_dials)",
+		},
+		[]string{"reason"},
+	)
+	pendingDials := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "pending_dials",
+			Help:      "Number of dial requests waiting for a response from an agent",
+		},
+	)
+	reaped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "connections_reaped_total",
+			Help:      "Count of connections closed by the proxy server, labeled by the reason (idle_timeout or max_lifetime)",
+		},
+		[]string{"reason"},
+	)
+	frontendAuth := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "frontend_authentications_total",
+			Help:      "Count of frontend authentication attempts, labeled by the result (success or failure) and the type of the authenticator that handled the credentials",
+		},
+		[]string{"result", "authenticator"},
+	)
+	certExpiry := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "certificate_expiration_timestamp_seconds",
+			Help:      "Expiry of the certificate last loaded from a file, in seconds since the epoch, labeled by the file. For a CA bundle it is the earliest expiry",
+		},
+		[]string{"file"},
+	)
+	tokenReviews := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "token_review_duration_seconds",
+			Help:      "Latency of the TokenReview requests to the API server in seconds",
+			Buckets:   latencyBuckets,
+		},
+		[]string{},
+	)
+	tokenCache := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "token_review_cache_requests_total",
+			Help:      "Count of lookups in the TokenReview cache, labeled by the result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+	auditDropped := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_events_dropped_total",
+			Help:      "Count of audit events dropped because the audit log buffer was full",
+		},
+	)
 	prometheus.MustRegister(latencies)
-	return &ServerMetrics{latencies: latencies}
+	prometheus.MustRegister(rateLimited)
+	prometheus.MustRegister(pendingDials)
+	prometheus.MustRegister(reaped)
+	prometheus.MustRegister(frontendAuth)
+	prometheus.MustRegister(certExpiry)
+	prometheus.MustRegister(tokenReviews)
+	prometheus.MustRegister(tokenCache)
+	prometheus.MustRegister(auditDropped)
+	return &ServerMetrics{
+		latencies:    latencies,
+		rateLimited:  rateLimited,
+		pendingDials: pendingDials,
+		reaped:       reaped,
+		frontendAuth: frontendAuth,
+		certExpiry:   certExpiry,
+		tokenReviews: tokenReviews,
+		tokenCache:   tokenCache,
+		auditDropped: auditDropped,
+	}
 }
 
 // Reset resets the metrics.
 func (a *ServerMetrics) Reset() {
 	a.latencies.Reset()
+	a.rateLimited.Reset()
+	a.pendingDials.Set(0)
+	a.reaped.Reset()
+	a.frontendAuth.Reset()
+	a.certExpiry.Reset()
+	a.tokenReviews.Reset()
+	a.tokenCache.Reset()
 }
 
 // ObserveDialLatency records the latency of dial to the remote endpoint.
 func (a *ServerMetrics) ObserveDialLatency(elapsed time.Duration) {
 	a.latencies.WithLabelValues().Observe(elapsed.Seconds())
 }
+
+// ObserveDialRateLimited records a dial request rejected by rate limiting.
+func (a *ServerMetrics) ObserveDialRateLimited(reason RateLimitReason) {
+	a.rateLimited.WithLabelValues(string(reason)).Inc()
+}
+
+// SetPendingDials records the number of dial requests waiting for a response.
+func (a *ServerMetrics) SetPendingDials(count int) {
+	a.pendingDials.Set(float64(count))
+}
+
+// ObserveConnectionReaped records a connection closed by the proxy server
+// because it was idle or lived too long.
+func (a *ServerMetrics) ObserveConnectionReaped(reason ReapReason) {
+	a.reaped.WithLabelValues(string(reason)).Inc()
+}
+
+// ObserveFrontendAuthentication records the authentication of a frontend
+// request by an authenticator of the given type.
+func (a *ServerMetrics) ObserveFrontendAuthentication(result AuthResult, authenticator string) {
+	a.frontendAuth.WithLabelValues(string(result), authenticator).Inc()
+}
+
+// SetCertificateExpiry records the expiry of the certificate loaded from
+// file.
+func (a *ServerMetrics) SetCertificateExpiry(file string, notAfter time.Time) {
+	a.certExpiry.WithLabelValues(file).Set(float64(notAfter.Unix()))
+}
+
+// ObserveTokenReviewLatency records the latency of a TokenReview request.
+func (a *ServerMetrics) ObserveTokenReviewLatency(elapsed time.Duration) {
+	a.tokenReviews.WithLabelValues().Observe(elapsed.Seconds())
+}
+
+// ObserveTokenReviewCache records a lookup in the TokenReview cache.
+func (a *ServerMetrics) ObserveTokenReviewCache(result CacheResult) {
+	a.tokenCache.WithLabelValues(string(result)).Inc()
+}
+
+// ObserveAuditEventDropped records an audit event dropped because the audit
+// log buffer was full.
+func (a *ServerMetrics) ObserveAuditEventDropped() {
+	a.auditDropped.Inc()
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"k8s.io/klog/v2"
+)
+
+// PeerCred are the credentials of the process at the other end of a unix
+// domain socket connection.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// PeerCredAddr is the remote address of the connections accepted by a
+// PeerCredListener. It formats as the credentials of the peer, which thus
+// identify the frontend clients.
+type PeerCredAddr struct {
+	net.Addr
+	Cred PeerCred
+}
+
+func (a *PeerCredAddr) String() string {
+	return fmt.Sprintf("uid=%d,gid=%d", a.Cred.UID, a.Cred.GID)
+}
+
+type peerCredConn struct {
+	net.Conn
+	addr *PeerCredAddr
+}
+
+func (c *peerCredConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// PeerCredListener accepts the unix domain socket connections of the
+// processes running as one of the allowed users, or with one of the allowed
+// primary groups. The other connections are closed. No restriction applies
+// if neither AllowedUIDs nor AllowedGIDs are set. Only supported on Linux.
+type PeerCredListener struct {
+	net.Listener
+	AllowedUIDs []uint32
+	AllowedGIDs []uint32
+}
+
+func (l *PeerCredListener) allowed(cred PeerCred) bool {
+	if len(l.AllowedUIDs) == 0 && len(l.AllowedGIDs) == 0 {
+		return true
+	}
+	for _, uid := range l.AllowedUIDs {
+		if uid == cred.UID {
+			return true
+		}
+	}
+	for _, gid := range l.AllowedGIDs {
+		if gid == cred.GID {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next allowed connection.
+func (l *PeerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := getPeerCred(conn)
+		if err != nil {
+			klog.ErrorS(err, "Failed to get the peer credentials, closing connection")
+			conn.Close()
+			continue
+		}
+		if !l.allowed(cred) {
+			klog.V(2).InfoS("Rejected unix domain socket connection", "pid", cred.PID, "uid", cred.UID, "gid", cred.GID)
+			conn.Close()
+			continue
+		}
+		return &peerCredConn{Conn: conn, addr: &PeerCredAddr{Addr: conn.RemoteAddr(), Cred: cred}}, nil
+	}
+}
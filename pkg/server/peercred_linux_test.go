@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerCredListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	testCases := []struct {
+		desc        string
+		allowedUIDs []uint32
+		allowedGIDs []uint32
+		wantAccept  bool
+	}{
+		{
+			desc:       "no restriction",
+			wantAccept: true,
+		},
+		{
+			desc:        "allowed UID",
+			allowedUIDs: []uint32{uid + 1, uid},
+			wantAccept:  true,
+		},
+		{
+			desc:        "allowed GID",
+			allowedUIDs: []uint32{uid + 1},
+			allowedGIDs: []uint32{gid},
+			wantAccept:  true,
+		},
+		{
+			desc:        "other UID and GID",
+			allowedUIDs: []uint32{uid + 1},
+			allowedGIDs: []uint32{gid + 1},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			lis, err := net.Listen("unix", filepath.Join(dir, string(rune('a'+i))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &PeerCredListener{Listener: lis, AllowedUIDs: tc.allowedUIDs, AllowedGIDs: tc.allowedGIDs}
+			defer l.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+			client, err := net.Dial("unix", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if !tc.wantAccept {
+				// The rejected connection is closed by the server.
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := client.Read(make([]byte, 1)); err == nil {
+					t.Error("expected the connection to be closed")
+				}
+				select {
+				case <-accepted:
+					t.Error("expected the connection not to be accepted")
+				default:
+				}
+				return
+			}
+			select {
+			case conn := <-accepted:
+				defer conn.Close()
+				addr, ok := conn.RemoteAddr().(*PeerCredAddr)
+				if !ok {
+					t.Fatalf("expected the peer credentials as address, got %T", conn.RemoteAddr())
+				}
+				if addr.Cred.UID != uid || addr.Cred.GID != gid || int(addr.Cred.PID) != os.Getpid() {
+					t.Errorf("unexpected peer credentials %+v", addr.Cred)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the connection to be accepted")
+			}
+		})
+	}
+}
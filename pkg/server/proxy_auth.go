@@ -0,0 +1,380 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+const proxyAuthRealm = "konnectivity"
+
+// The types of the proxy authenticators, labeling the authentication
+// metrics. noProxyAuthenticator labels the requests no authenticator
+// handled, otherProxyAuthenticator the authenticators without a type.
+const (
+	noProxyAuthenticator          = "none"
+	otherProxyAuthenticator       = "other"
+	tokenFileProxyAuthenticator   = "token-file"
+	htpasswdProxyAuthenticator    = "htpasswd"
+	tokenReviewProxyAuthenticator = "token-review"
+)
+
+// ProxyAuthenticator authenticates the Proxy-Authorization header of an
+// HTTP CONNECT request.
+type ProxyAuthenticator interface {
+	// Authenticate returns the identity of the client if the credentials of
+	// the header are valid. ok is false if the authenticator does not
+	// handle the scheme of the header.
+	Authenticate(authorization string) (identity string, ok bool, err error)
+	// Challenge returns the Proxy-Authenticate header value asking for the
+	// credentials of the authenticator.
+	Challenge() string
+}
+
+// ErrProxyAuthenticationRequired indicates that the client of an HTTP
+// CONNECT request did not provide valid credentials.
+type ErrProxyAuthenticationRequired struct {
+	Reason string
+}
+
+// Error returns the error message.
+func (e *ErrProxyAuthenticationRequired) Error() string {
+	return "proxy authentication required: " + e.Reason
+}
+
+// parseAuthorization splits an authorization header into its scheme and
+// credentials.
+func parseAuthorization(authorization string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(authorization), " ", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// UnionProxyAuthenticator tries each authenticator in turn.
+type UnionProxyAuthenticator []ProxyAuthenticator
+
+// Authenticate returns the identity from the first authenticator accepting
+// the credentials.
+func (u UnionProxyAuthenticator) Authenticate(authorization string) (string, bool, error) {
+	identity, _, ok, err := authenticateWithType(u, authorization)
+	return identity, ok, err
+}
+
+// Challenge returns the challenges of all the authenticators.
+func (u UnionProxyAuthenticator) Challenge() string {
+	var challenges []string
+	seen := make(map[string]bool)
+	for _, a := range u {
+		if c := a.Challenge(); !seen[c] {
+			seen[c] = true
+			challenges = append(challenges, c)
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// ReloadableProxyAuthenticator delegates to an authenticator that can be
+// replaced while serving, e.g. when the credential files are reloaded.
+type ReloadableProxyAuthenticator struct {
+	mu sync.RWMutex
+	a  ProxyAuthenticator
+}
+
+// NewReloadableProxyAuthenticator returns a ReloadableProxyAuthenticator
+// delegating to a.
+func NewReloadableProxyAuthenticator(a ProxyAuthenticator) *ReloadableProxyAuthenticator {
+	return &ReloadableProxyAuthenticator{a: a}
+}
+
+// Set replaces the authenticator the requests are delegated to.
+func (r *ReloadableProxyAuthenticator) Set(a ProxyAuthenticator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.a = a
+}
+
+func (r *ReloadableProxyAuthenticator) get() ProxyAuthenticator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.a
+}
+
+// Authenticate authenticates the header with the current authenticator.
+func (r *ReloadableProxyAuthenticator) Authenticate(authorization string) (string, bool, error) {
+	return r.get().Authenticate(authorization)
+}
+
+// Challenge returns the challenge of the current authenticator.
+func (r *ReloadableProxyAuthenticator) Challenge() string {
+	return r.get().Challenge()
+}
+
+// typedProxyAuthenticator is a ProxyAuthenticator reporting its type.
+type typedProxyAuthenticator interface {
+	Type() string
+}
+
+// authenticateWithType authenticates the credentials with a, and returns
+// the type of the authenticator that accepted them, or of the first one
+// that rejected them.
+func authenticateWithType(a ProxyAuthenticator, authorization string) (string, string, bool, error) {
+	switch a := a.(type) {
+	case *ReloadableProxyAuthenticator:
+		return authenticateWithType(a.get(), authorization)
+	case UnionProxyAuthenticator:
+		authenticator := noProxyAuthenticator
+		var errs []string
+		for _, child := range a {
+			identity, childType, ok, err := authenticateWithType(child, authorization)
+			if err != nil {
+				if len(errs) == 0 {
+					authenticator = childType
+				}
+				errs = append(errs, err.Error())
+				continue
+			}
+			if ok {
+				return identity, childType, true, nil
+			}
+		}
+		if len(errs) > 0 {
+			return "", authenticator, false, fmt.Errorf("%s", strings.Join(errs, ", "))
+		}
+		return "", noProxyAuthenticator, false, nil
+	}
+	identity, ok, err := a.Authenticate(authorization)
+	if !ok && err == nil {
+		return "", noProxyAuthenticator, false, nil
+	}
+	if t, isTyped := a.(typedProxyAuthenticator); isTyped {
+		return identity, t.Type(), ok, err
+	}
+	return identity, otherProxyAuthenticator, ok, err
+}
+
+// authenticateProxyRequest authenticates the Proxy-Authorization header
+// with the authenticator, recording the result in the metrics by type of
+// authenticator. The identity is left to the logs and the audit log.
+func authenticateProxyRequest(a ProxyAuthenticator, authorization string) (string, error) {
+	if authorization == "" {
+		metrics.Metrics.ObserveFrontendAuthentication(metrics.AuthFailure, noProxyAuthenticator)
+		return "", &ErrProxyAuthenticationRequired{Reason: "missing Proxy-Authorization header"}
+	}
+	identity, authenticator, ok, err := authenticateWithType(a, authorization)
+	if err != nil {
+		metrics.Metrics.ObserveFrontendAuthentication(metrics.AuthFailure, authenticator)
+		return "", &ErrProxyAuthenticationRequired{Reason: err.Error()}
+	}
+	if !ok {
+		metrics.Metrics.ObserveFrontendAuthentication(metrics.AuthFailure, noProxyAuthenticator)
+		return "", &ErrProxyAuthenticationRequired{Reason: "unsupported authorization scheme"}
+	}
+	metrics.Metrics.ObserveFrontendAuthentication(metrics.AuthSuccess, authenticator)
+	return identity, nil
+}
+
+// TokenFileProxyAuthenticator authenticates bearer tokens listed in a file
+// in the Kubernetes static token file format: "token,user[,...]" lines.
+type TokenFileProxyAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewTokenFileProxyAuthenticator loads the tokens of the file.
+func NewTokenFileProxyAuthenticator(path string) (*TokenFileProxyAuthenticator, error) {
+	tokens, err := loadTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenFileProxyAuthenticator{tokens: tokens}, nil
+}
+
+// loadTokenFile returns the users of the tokens of a static token file.
+func loadTokenFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token file %s: %v", path, err)
+	}
+	tokens := make(map[string]string)
+	for i, record := range records {
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("%s: record %d: expected token,user", path, i+1)
+		}
+		tokens[record[0]] = record[1]
+	}
+	return tokens, nil
+}
+
+// Authenticate validates Bearer credentials.
+func (a *TokenFileProxyAuthenticator) Authenticate(authorization string) (string, bool, error) {
+	scheme, token := parseAuthorization(authorization)
+	if scheme != "bearer" {
+		return "", false, nil
+	}
+	for t, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return user, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("invalid bearer token")
+}
+
+// Challenge asks for a bearer token.
+func (a *TokenFileProxyAuthenticator) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", proxyAuthRealm)
+}
+
+// Type returns the type of the authenticator.
+func (a *TokenFileProxyAuthenticator) Type() string {
+	return tokenFileProxyAuthenticator
+}
+
+// HtpasswdProxyAuthenticator authenticates basic credentials against an
+// htpasswd file, with bcrypt or SHA1 password hashes.
+type HtpasswdProxyAuthenticator struct {
+	hashes map[string]string
+}
+
+// NewHtpasswdProxyAuthenticator loads the users of the htpasswd file.
+func NewHtpasswdProxyAuthenticator(path string) (*HtpasswdProxyAuthenticator, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, i+1)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash for user %q, use bcrypt or SHA1", path, i+1, parts[0])
+		}
+		hashes[parts[0]] = hash
+	}
+	return &HtpasswdProxyAuthenticator{hashes: hashes}, nil
+}
+
+// Authenticate validates Basic credentials.
+func (a *HtpasswdProxyAuthenticator) Authenticate(authorization string) (string, bool, error) {
+	scheme, credentials := parseAuthorization(authorization)
+	if scheme != "basic" {
+		return "", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid basic credentials")
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", false, fmt.Errorf("invalid basic credentials")
+	}
+	user, password := parts[0], parts[1]
+	hash, ok := a.hashes[user]
+	if !ok || !checkPasswordHash(hash, password) {
+		return "", false, fmt.Errorf("invalid username or password")
+	}
+	return user, true, nil
+}
+
+func checkPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Challenge asks for basic credentials.
+func (a *HtpasswdProxyAuthenticator) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", proxyAuthRealm)
+}
+
+// Type returns the type of the authenticator.
+func (a *HtpasswdProxyAuthenticator) Type() string {
+	return htpasswdProxyAuthenticator
+}
+
+// TokenReviewProxyAuthenticator authenticates bearer tokens with the
+// Kubernetes TokenReview API.
+type TokenReviewProxyAuthenticator struct {
+	KubernetesClient kubernetes.Interface
+	// Audiences the tokens must be issued for. Empty means the audience of
+	// the API server.
+	Audiences []string
+	// Cache, if set, caches the results of the TokenReviews.
+	Cache *TokenReviewCache
+}
+
+// Authenticate validates Bearer credentials.
+func (a *TokenReviewProxyAuthenticator) Authenticate(authorization string) (string, bool, error) {
+	scheme, token := parseAuthorization(authorization)
+	if scheme != "bearer" {
+		return "", false, nil
+	}
+	status, err := reviewToken(a.KubernetesClient, a.Cache, token, a.Audiences)
+	if err != nil {
+		klog.ErrorS(err, "TokenReview failed")
+		return "", false, fmt.Errorf("failed to review token")
+	}
+	if status.Error != "" {
+		return "", false, fmt.Errorf("lookup failed: %s", status.Error)
+	}
+	if !status.Authenticated {
+		return "", false, fmt.Errorf("token not valid")
+	}
+	return status.User.Username, true, nil
+}
+
+// Challenge asks for a bearer token.
+func (a *TokenReviewProxyAuthenticator) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", proxyAuthRealm)
+}
+
+// Type returns the type of the authenticator.
+func (a *TokenReviewProxyAuthenticator) Type() string {
+	return tokenReviewProxyAuthenticator
+}
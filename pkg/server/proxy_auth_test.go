@@ -0,0 +1,273 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	fakeauthenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "proxy-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func basicAuthorization(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestTokenFileProxyAuthenticator(t *testing.T) {
+	path := writeTempFile(t, "# clients\ntoken1,kube-apiserver,uid1\ntoken2,debug\n")
+	defer os.Remove(path)
+
+	a, err := NewTokenFileProxyAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		authorization string
+		identity      string
+		ok            bool
+		err           bool
+	}{
+		{authorization: "Bearer token1", identity: "kube-apiserver", ok: true},
+		{authorization: "bearer token2", identity: "debug", ok: true},
+		{authorization: "Bearer wrong", err: true},
+		{authorization: basicAuthorization("kube-apiserver", "token1")},
+	}
+	for _, tc := range testcases {
+		identity, ok, err := a.Authenticate(tc.authorization)
+		if identity != tc.identity || ok != tc.ok || (err != nil) != tc.err {
+			t.Errorf("%q: expected (%q, %v, err=%v), got (%q, %v, %v)", tc.authorization, tc.identity, tc.ok, tc.err, identity, ok, err)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("token-without-user\n"), 0600)
+	if _, err := NewTokenFileProxyAuthenticator(path); err == nil {
+		t.Error("expected an error for a record without user")
+	}
+}
+
+func TestHtpasswdProxyAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {SHA} hash of "password".
+	path := writeTempFile(t, fmt.Sprintf("kube-apiserver:%s\ndebug:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", hash))
+	defer os.Remove(path)
+
+	a, err := NewHtpasswdProxyAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		authorization string
+		identity      string
+		ok            bool
+		err           bool
+	}{
+		{authorization: basicAuthorization("kube-apiserver", "secret"), identity: "kube-apiserver", ok: true},
+		{authorization: basicAuthorization("debug", "password"), identity: "debug", ok: true},
+		{authorization: basicAuthorization("kube-apiserver", "wrong"), err: true},
+		{authorization: basicAuthorization("unknown", "secret"), err: true},
+		{authorization: "Basic !!!", err: true},
+		{authorization: "Bearer secret"},
+	}
+	for _, tc := range testcases {
+		identity, ok, err := a.Authenticate(tc.authorization)
+		if identity != tc.identity || ok != tc.ok || (err != nil) != tc.err {
+			t.Errorf("%q: expected (%q, %v, err=%v), got (%q, %v, %v)", tc.authorization, tc.identity, tc.ok, tc.err, identity, ok, err)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("user:$apr1$salt$hash\n"), 0600)
+	if _, err := NewHtpasswdProxyAuthenticator(path); err == nil {
+		t.Error("expected an error for an unsupported hash")
+	}
+}
+
+func TestAuthenticateWithType(t *testing.T) {
+	tokens := writeTempFile(t, "token1,kube-apiserver\n")
+	defer os.Remove(tokens)
+	tokenFile, err := NewTokenFileProxyAuthenticator(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := writeTempFile(t, fmt.Sprintf("debug:%s\n", hash))
+	defer os.Remove(users)
+	htpasswd, err := NewHtpasswdProxyAuthenticator(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewReloadableProxyAuthenticator(UnionProxyAuthenticator{tokenFile, htpasswd})
+
+	testcases := []struct {
+		authorization string
+		authenticator string
+		ok            bool
+	}{
+		{authorization: "Bearer token1", authenticator: tokenFileProxyAuthenticator, ok: true},
+		{authorization: basicAuthorization("debug", "secret"), authenticator: htpasswdProxyAuthenticator, ok: true},
+		{authorization: basicAuthorization("debug", "wrong"), authenticator: htpasswdProxyAuthenticator},
+		{authorization: "Negotiate abc", authenticator: noProxyAuthenticator},
+	}
+	for _, tc := range testcases {
+		_, authenticator, ok, _ := authenticateWithType(a, tc.authorization)
+		if authenticator != tc.authenticator || ok != tc.ok {
+			t.Errorf("%q: expected (%q, %v), got (%q, %v)", tc.authorization, tc.authenticator, tc.ok, authenticator, ok)
+		}
+	}
+}
+
+func TestTokenReviewProxyAuthenticator(t *testing.T) {
+	testcases := []struct {
+		desc          string
+		authenticated bool
+		authError     string
+		reviewError   error
+		ok            bool
+		err           bool
+	}{
+		{desc: "authenticated", authenticated: true, ok: true},
+		{desc: "not authenticated", err: true},
+		{desc: "lookup error", authError: "token expired", err: true},
+		{desc: "review failure", reviewError: fmt.Errorf("unavailable"), err: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.desc, func(t *testing.T) {
+			kcs := k8sfake.NewSimpleClientset()
+			var reviewed *authv1.TokenReview
+			kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				reviewed = action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview)
+				tr := &authv1.TokenReview{
+					Status: authv1.TokenReviewStatus{
+						Authenticated: tc.authenticated,
+						Error:         tc.authError,
+						User:          authv1.UserInfo{Username: "system:serviceaccount:kube-system:apiserver"},
+					},
+				}
+				return true, tr, tc.reviewError
+			})
+
+			a := &TokenReviewProxyAuthenticator{KubernetesClient: kcs, Audiences: []string{"konnectivity"}}
+			identity, ok, err := a.Authenticate("Bearer sa-token")
+			if ok != tc.ok || (err != nil) != tc.err {
+				t.Fatalf("expected (%v, err=%v), got (%v, %v)", tc.ok, tc.err, ok, err)
+			}
+			if ok && identity != "system:serviceaccount:kube-system:apiserver" {
+				t.Errorf("unexpected identity %q", identity)
+			}
+			if reviewed.Spec.Token != "sa-token" || len(reviewed.Spec.Audiences) != 1 || reviewed.Spec.Audiences[0] != "konnectivity" {
+				t.Errorf("unexpected token review %v", reviewed.Spec)
+			}
+		})
+	}
+}
+
+func TestTunnelProxyAuthentication(t *testing.T) {
+	path := writeTempFile(t, "token1,kube-apiserver\n")
+	defer os.Remove(path)
+	tokens, err := NewTokenFileProxyAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p := NewProxyServer("", 1, nil)
+	p.BackendManager = &staticBackendManager{DefaultBackendManager: NewDefaultBackendManager(), backend: backend}
+	p.DialTimeout = time.Second
+	sink := &fakeAuditSink{}
+	p.AuditSink = sink
+	ts := httptest.NewServer(&Tunnel{Server: p, Authenticator: UnionProxyAuthenticator{tokens}})
+	defer ts.Close()
+
+	connect := func(authorization string) (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://127.0.0.1:80", nil)
+		req.Host = "127.0.0.1:80"
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		req.Write(conn)
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, res
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", basicAuthorization("kube-apiserver", "token1")} {
+		conn, res := connect(authorization)
+		conn.Close()
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("%q: expected 407, got %d", authorization, res.StatusCode)
+		}
+		if challenge := res.Header.Get("Proxy-Authenticate"); !strings.HasPrefix(challenge, "Bearer") {
+			t.Errorf("%q: unexpected challenge %q", authorization, challenge)
+		}
+	}
+	select {
+	case pkt := <-backend.sent:
+		t.Fatalf("unexpected packet to the agent for unauthenticated requests: %v", pkt)
+	default:
+	}
+
+	go answerDial(t, p, backend, &client.DialResponse{ConnectID: 1})
+	conn, res := connect("Bearer token1")
+	defer conn.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.events) == 0 || sink.events[0].Frontend != "kube-apiserver" {
+		t.Errorf("expected the authenticated identity in the audit log, got %v", sink.events)
+	}
+}
@@ -25,9 +25,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
@@ -47,22 +50,128 @@ type ProxyClientConnection struct {
 	agentID   string
 	start     time.Time
 	backend   Backend
+
+	// identity, userAgent and address describe the frontend and the
+	// destination it requested; they are recorded in the audit log.
+	identity  string
+	userAgent string
+	address   string
+	// fromFrontend and toFrontend count the bytes tunneled in each
+	// direction. Accessed atomically.
+	fromFrontend int64
+	toFrontend   int64
+	// released is set once the connection slot taken on the backend has
+	// been returned. Accessed atomically.
+	released int32
+	// lastActivity is the time, in unix nanoseconds, data was last tunneled
+	// in either direction. Accessed atomically.
+	lastActivity int64
+	// dialErr is the error the agent returned in the DIAL_RSP; it is set
+	// before connected is closed.
+	dialErr error
+
+	// httpMu protects HTTP and the following fields while an http-connect
+	// frontend waits to be hijacked.
+	httpMu sync.Mutex
+	// buffered holds the data received from the agent before HTTP is
+	// attached.
+	buffered [][]byte
+	// closed is set if the connection was closed before HTTP is attached.
+	closed bool
+}
+
+// attach sets the hijacked connection of an http-connect frontend, and
+// writes to it the data received from the agent in the meantime.
+func (c *ProxyClientConnection) attach(conn net.Conn) error {
+	c.httpMu.Lock()
+	defer c.httpMu.Unlock()
+	c.HTTP = conn
+	if c.closed {
+		return conn.Close()
+	}
+	for _, data := range c.buffered {
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+	}
+	c.buffered = nil
+	return nil
+}
+
+func (c *ProxyClientConnection) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// expired returns why the connection should be closed, if it is idle for
+// longer than idleTimeout or older than maxLifetime. A zero duration
+// disables the corresponding check.
+func (c *ProxyClientConnection) expired(now time.Time, idleTimeout, maxLifetime time.Duration) (metrics.ReapReason, bool) {
+	if maxLifetime > 0 && now.Sub(c.start) > maxLifetime {
+		return metrics.ReapMaxLifetime, true
+	}
+	lastActivity := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	if idleTimeout > 0 && now.Sub(lastActivity) > idleTimeout {
+		return metrics.ReapIdleTimeout, true
+	}
+	return "", false
+}
+
+// releaseBackend returns the connection slot the connection holds on its
+// backend. It is safe to call multiple times.
+func (c *ProxyClientConnection) releaseBackend() {
+	if c.backend == nil || !atomic.CompareAndSwapInt32(&c.released, 0, 1) {
+		return
+	}
+	releaseBackend(c.backend)
+}
+
+func (c *ProxyClientConnection) addBytesFromFrontend(n int) {
+	atomic.AddInt64(&c.fromFrontend, int64(n))
+	c.touch()
+}
+
+func (c *ProxyClientConnection) bytesFromFrontend() int64 {
+	return atomic.LoadInt64(&c.fromFrontend)
+}
+
+func (c *ProxyClientConnection) bytesToFrontend() int64 {
+	return atomic.LoadInt64(&c.toFrontend)
 }
 
 func (c *ProxyClientConnection) send(pkt *client.Packet) error {
+	if pkt.Type == client.PacketType_DATA {
+		atomic.AddInt64(&c.toFrontend, int64(len(pkt.GetData().Data)))
+		c.touch()
+	}
 	if c.Mode == "grpc" {
 		stream := c.Grpc
 		return stream.Send(pkt)
-	} else if c.Mode == "http-connect" {
+	} else if c.Mode == "http-connect" || c.Mode == "http-forward" || c.Mode == "socks5" {
+		c.httpMu.Lock()
+		defer c.httpMu.Unlock()
 		if pkt.Type == client.PacketType_CLOSE_RSP {
+			if c.HTTP == nil {
+				c.closed = true
+				return nil
+			}
 			return c.HTTP.Close()
 		} else if pkt.Type == client.PacketType_DATA {
+			if c.HTTP == nil {
+				// The Tunnel has not hijacked the connection yet.
+				data := pkt.GetData().Data
+				c.buffered = append(c.buffered, append([]byte(nil), data...))
+				return nil
+			}
 			_, err := c.HTTP.Write(pkt.GetData().Data)
 			return err
 		} else if pkt.Type == client.PacketType_DIAL_RSP {
-			if pkt.GetDialResponse().Error != "" {
-				return c.HTTP.Close()
+			if c.Mode == "socks5" {
+				// Reply before the frontend is registered, so that the
+				// reply precedes the data from the agent.
+				return writeSOCKS5DialReply(c.HTTP, pkt.GetDialResponse())
 			}
+			// The Tunnel answers the CONNECT request once connected is
+			// closed.
 			return nil
 		} else {
 			return fmt.Errorf("attempt to send via unrecognized connection type %v", pkt.Type)
@@ -87,6 +196,7 @@ func (pm *PendingDialManager) Add(random int64, clientConn *ProxyClientConnectio
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 	pm.pendingDial[random] = clientConn
+	metrics.Metrics.SetPendingDials(len(pm.pendingDial))
 }
 
 func (pm *PendingDialManager) Get(random int64) (*ProxyClientConnection, bool) {
@@ -96,10 +206,21 @@ func (pm *PendingDialManager) Get(random int64) (*ProxyClientConnection, bool) {
 	return clientConn, ok
 }
 
-func (pm *PendingDialManager) Remove(random int64) {
+// Remove removes the pending dial, and returns whether it was still pending.
+func (pm *PendingDialManager) Remove(random int64) bool {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
+	_, ok := pm.pendingDial[random]
 	delete(pm.pendingDial, random)
+	metrics.Metrics.SetPendingDials(len(pm.pendingDial))
+	return ok
+}
+
+// Len returns the number of pending dials.
+func (pm *PendingDialManager) Len() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return len(pm.pendingDial)
 }
 
 // ProxyServer
@@ -124,8 +245,55 @@ type ProxyServer struct {
 	serverID    string // unique ID of this server
 	serverCount int    // Number of proxy server instances, should be 1 unless it is a HA server.
 
+	// ServerCounter, if set, counts the live proxy server instances. The
+	// count is advertised to the agents instead of serverCount, unless it
+	// is unknown.
+	ServerCounter ServerCounter
+
 	// agent authentication
 	AgentAuthenticationOptions *AgentTokenAuthenticationOptions
+
+	// AgentAuthenticator, if set, authenticates the agents before they are
+	// registered. NewProxyServer sets it from AgentAuthenticationOptions.
+	AgentAuthenticator AgentAuthenticator
+
+	// AgentIDSource, if set, is the credential of the agents their
+	// agentID must match. Agents claiming another agentID are rejected.
+	AgentIDSource AgentIDSource
+
+	// AuditSink, if set, receives an event for every stage of the
+	// lifecycle of the tunneled connections.
+	AuditSink AuditSink
+
+	// DialLimiter, if set, rejects dial requests exceeding the configured
+	// rates instead of forwarding them to the agents.
+	DialLimiter *DialLimiter
+
+	// IdleTimeout closes connections without data in either direction for
+	// this long. MaxConnectionLifetime closes connections older than this.
+	// Zero disables the corresponding limit. They are enforced by
+	// RunConnectionReaper.
+	IdleTimeout           time.Duration
+	MaxConnectionLifetime time.Duration
+
+	// DialTimeout bounds how long the http-connect and socks5 frontends
+	// wait for the DIAL_RSP of the agent. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// drainMu protects drainCh, which is closed when Drain is called.
+	drainMu sync.Mutex
+	drainCh chan struct{}
+}
+
+// ServerCount returns the number of proxy server instances advertised to
+// the agents.
+func (s *ProxyServer) ServerCount() int {
+	if s.ServerCounter != nil {
+		if count := s.ServerCounter.ServerCount(); count > 0 {
+			return count
+		}
+	}
+	return s.serverCount
 }
 
 // AgentTokenAuthenticationOptions contains list of parameters required for agent token based authentication
@@ -135,6 +303,26 @@ type AgentTokenAuthenticationOptions struct {
 	AgentServiceAccount    string
 	AuthenticationAudience string
 	KubernetesClient       kubernetes.Interface
+	// RefreshDeadline, if non-zero, is how long an agent may go without
+	// sending a new token in an AUTH_REFRESH packet. Agents whose new token
+	// fails the TokenReview, or that miss the deadline, are disconnected.
+	RefreshDeadline time.Duration
+	// MinRefreshInterval is how long an agent must wait after an
+	// AUTH_REFRESH before sending another one. Sooner ones are dropped.
+	MinRefreshInterval time.Duration
+	// TokenReviewCache, if set, caches the results of the TokenReviews.
+	TokenReviewCache *TokenReviewCache
+}
+
+// authenticator returns the authenticator of the service account of the
+// options.
+func (o *AgentTokenAuthenticationOptions) authenticator() AgentAuthenticator {
+	return &TokenReviewAgentAuthenticator{
+		KubernetesClient: o.KubernetesClient,
+		Audiences:        []string{o.AuthenticationAudience},
+		ServiceAccounts:  []ServiceAccount{{Namespace: o.AgentNamespace, Name: o.AgentServiceAccount}},
+		Cache:            o.TokenReviewCache,
+	}
 }
 
 var _ agent.AgentServiceServer = &ProxyServer{}
@@ -153,22 +341,28 @@ func (s *ProxyServer) addFrontend(agentID string, connID int64, p *ProxyClientCo
 
 func (s *ProxyServer) removeFrontend(agentID string, connID int64) {
 	s.fmu.Lock()
-	defer s.fmu.Unlock()
 	conns, ok := s.frontends[agentID]
 	if !ok {
+		s.fmu.Unlock()
 		klog.V(2).InfoS("Cannot find agent in the frontends", "agentID", agentID)
 		return
 	}
-	if _, ok := conns[connID]; !ok {
+	frontend, ok := conns[connID]
+	if !ok {
+		s.fmu.Unlock()
 		klog.V(2).InfoS("Cannot find connection for agent in the frontends", "connectionID", connID, "agentID", agentID)
 		return
 	}
-	klog.V(2).InfoS("Remove frontend for agent", "frontend", conns[connID], "agentID", agentID, "connectionID", connID)
 	delete(s.frontends[agentID], connID)
 	if len(s.frontends[agentID]) == 0 {
 		delete(s.frontends, agentID)
 	}
-	return
+	s.fmu.Unlock()
+
+	klog.V(2).InfoS("Remove frontend for agent", "frontend", frontend, "agentID", agentID, "connectionID", connID)
+	frontend.releaseBackend()
+	// The audit sink may be slow, it is written without holding fmu.
+	s.audit(AuditConnectionClosed, frontend, nil)
 }
 
 func (s *ProxyServer) getFrontend(agentID string, connID int64) (*ProxyClientConnection, error) {
@@ -201,10 +395,149 @@ func (s *ProxyServer) getFrontendsForBackendConn(agentID string, backend Backend
 	return ret, nil
 }
 
+// closeFrontend closes an established connection on behalf of the proxy
+// server: the agent is sent a CLOSE_REQ and the frontend a CLOSE_RSP
+// carrying reason.
+func (s *ProxyServer) closeFrontend(frontend *ProxyClientConnection, reason string) {
+	klog.V(2).InfoS("Close connection", "agentID", frontend.agentID, "connectionID", frontend.connectID, "reason", reason)
+	closeReq := &client.Packet{
+		Type: client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{
+			CloseRequest: &client.CloseRequest{
+				ConnectID: frontend.connectID,
+			},
+		},
+	}
+	if err := frontend.backend.Send(closeReq); err != nil {
+		klog.ErrorS(err, "CLOSE_REQ to Backend failed")
+	}
+	closeRsp := &client.Packet{
+		Type: client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{
+			CloseResponse: &client.CloseResponse{
+				ConnectID: frontend.connectID,
+				Error:     reason,
+			},
+		},
+	}
+	if err := frontend.send(closeRsp); err != nil {
+		klog.ErrorS(err, "CLOSE_RSP to frontend failed")
+	}
+	s.removeFrontend(frontend.agentID, frontend.connectID)
+}
+
+// closeOrphanConnection asks the agent to close a connection it dialed for
+// a frontend that is gone.
+func (s *ProxyServer) closeOrphanConnection(backend Backend, agentID string, connID int64) {
+	klog.V(3).InfoS("Close connection without frontend", "agentID", agentID, "connectionID", connID)
+	closeReq := &client.Packet{
+		Type: client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{
+			CloseRequest: &client.CloseRequest{
+				ConnectID: connID,
+			},
+		},
+	}
+	if err := backend.Send(closeReq); err != nil {
+		klog.ErrorS(err, "CLOSE_REQ to Backend failed", "agentID", agentID)
+	}
+}
+
+// ErrDialTimeout indicates that the agent did not answer a dial request in
+// time.
+type ErrDialTimeout struct{}
+
+// Error returns the error message.
+func (e *ErrDialTimeout) Error() string {
+	return "timed out waiting for the agent to dial"
+}
+
+// waitForDial waits for the DIAL_RSP of a pending dial of an http-connect
+// or socks5 frontend. If the dial is abandoned, because of the dial timeout,
+// the backend or the frontend going away, it is removed from the pending
+// dials and the error is returned.
+func (s *ProxyServer) waitForDial(connection *ProxyClientConnection, random int64, frontendDone <-chan struct{}) error {
+	var timeout <-chan time.Time
+	if s.DialTimeout > 0 {
+		timer := time.NewTimer(s.DialTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-connection.connected:
+		return connection.dialErr
+	case <-timeout:
+		err = &ErrDialTimeout{}
+	case <-connection.backend.Context().Done():
+		err = &ErrNotFound{}
+	case <-frontendDone:
+		err = fmt.Errorf("frontend is gone")
+	}
+	if !s.PendingDial.Remove(random) {
+		// The DIAL_RSP is being processed.
+		<-connection.connected
+		return connection.dialErr
+	}
+	connection.releaseBackend()
+	s.audit(AuditDialFailed, connection, err)
+	return err
+}
+
+// reapInterval returns how often the connections are checked against the
+// idle timeout and the maximum lifetime.
+func reapInterval(idleTimeout, maxLifetime time.Duration) time.Duration {
+	interval := time.Second
+	for _, d := range []time.Duration{idleTimeout, maxLifetime} {
+		if d > 0 && d/2 < interval {
+			interval = d / 2
+		}
+	}
+	return interval
+}
+
+// reapConnections closes the connections that are idle or have exceeded
+// their maximum lifetime.
+func (s *ProxyServer) reapConnections(now time.Time) {
+	expired := make(map[*ProxyClientConnection]metrics.ReapReason)
+	s.fmu.RLock()
+	for _, conns := range s.frontends {
+		for _, c := range conns {
+			if reason, ok := c.expired(now, s.IdleTimeout, s.MaxConnectionLifetime); ok {
+				expired[c] = reason
+			}
+		}
+	}
+	s.fmu.RUnlock()
+
+	for c, reason := range expired {
+		metrics.Metrics.ObserveConnectionReaped(reason)
+		s.closeFrontend(c, string(reason))
+	}
+}
+
+// RunConnectionReaper enforces IdleTimeout and MaxConnectionLifetime until
+// stopCh is closed. It returns immediately if both are disabled.
+func (s *ProxyServer) RunConnectionReaper(stopCh <-chan struct{}) {
+	if s.IdleTimeout <= 0 && s.MaxConnectionLifetime <= 0 {
+		return
+	}
+	ticker := time.NewTicker(reapInterval(s.IdleTimeout, s.MaxConnectionLifetime))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			s.reapConnections(now)
+		}
+	}
+}
+
 // NewProxyServer creates a new ProxyServer instance
 func NewProxyServer(serverID string, serverCount int, agentAuthenticationOptions *AgentTokenAuthenticationOptions) *ProxyServer {
 	bm := NewDefaultBackendManager()
-	return &ProxyServer{
+	s := &ProxyServer{
 		frontends:                  make(map[string](map[int64]*ProxyClientConnection)),
 		PendingDial:                NewPendingDialManager(),
 		serverID:                   serverID,
@@ -213,6 +546,10 @@ func NewProxyServer(serverID string, serverCount int, agentAuthenticationOptions
 		AgentAuthenticationOptions: agentAuthenticationOptions,
 		Readiness:                  bm,
 	}
+	if agentAuthenticationOptions != nil && agentAuthenticationOptions.Enabled {
+		s.AgentAuthenticator = agentAuthenticationOptions.authenticator()
+	}
+	return s
 }
 
 // Proxy handles incoming streams from gRPC frontend.
@@ -227,7 +564,7 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 	recvCh := make(chan *client.Packet, 10)
 	stopCh := make(chan error)
 
-	go s.serveRecvFrontend(stream, recvCh)
+	go s.serveRecvFrontend(stream, strings.Join(userAgent, " "), recvCh)
 
 	defer func() {
 		close(recvCh)
@@ -254,7 +591,7 @@ func (s *ProxyServer) Proxy(stream client.ProxyService_ProxyServer) error {
 	return <-stopCh
 }
 
-func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer, recvCh <-chan *client.Packet) {
+func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer, userAgent string, recvCh <-chan *client.Packet) {
 	klog.V(4).Infoln("start serving frontend stream")
 
 	var firstConnID int64
@@ -262,6 +599,9 @@ func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer,
 	// backend from the BackendManger then.
 	var backend Backend
 	var err error
+	// conn is the connection created by the latest DIAL_REQ.
+	var conn *ProxyClientConnection
+	identity := frontendIdentity(stream.Context())
 
 	for pkt := range recvCh {
 		switch pkt.Type {
@@ -271,24 +611,34 @@ func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer,
 			// the address, then we can send the Dial_REQ to the
 			// same agent. That way we save the agent from creating
 			// a new connection to the address.
-			backend, err = s.BackendManager.Backend(context.TODO())
+			conn = &ProxyClientConnection{
+				Mode:      "grpc",
+				Grpc:      stream,
+				connected: make(chan struct{}),
+				start:     time.Now(),
+				identity:  identity,
+				userAgent: userAgent,
+				address:   pkt.GetDialRequest().Address,
+			}
+			backend, err = s.pickBackend(identity)
 			if err != nil {
 				klog.ErrorS(err, "Failed to get a backend")
+				s.audit(AuditDialFailed, conn, err)
+				s.sendDialError(stream, pkt.GetDialRequest().Random, err)
 				continue
 			}
-			s.PendingDial.Add(
-				pkt.GetDialRequest().Random,
-				&ProxyClientConnection{
-					Mode:      "grpc",
-					Grpc:      stream,
-					connected: make(chan struct{}),
-					start:     time.Now(),
-					backend:   backend,
-				})
+			conn.backend = backend
+			s.PendingDial.Add(pkt.GetDialRequest().Random, conn)
+			s.audit(AuditDialRequested, conn, nil)
 			if err := backend.Send(pkt); err != nil {
 				klog.ErrorS(err, "DIAL_REQ to Backend failed")
+				s.PendingDial.Remove(pkt.GetDialRequest().Random)
+				conn.releaseBackend()
+				s.audit(AuditDialFailed, conn, err)
+				s.sendDialError(stream, pkt.GetDialRequest().Random, err)
+				continue
 			}
-			klog.V(5).Infoln("DIAL_REQ sent to backend") // got this. but backend didn't receive anything.
+			klog.V(5).Infoln("DIAL_REQ sent to backend")
 
 		case client.PacketType_CLOSE_REQ:
 			connID := pkt.GetCloseRequest().ConnectID
@@ -322,6 +672,9 @@ func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer,
 				klog.ErrorS(err, "DATA to Backend failed")
 				continue
 			}
+			if conn != nil {
+				conn.addBytesFromFrontend(len(data))
+			}
 			klog.V(5).Infoln("DATA sent to Backend")
 
 		default:
@@ -349,6 +702,47 @@ func (s *ProxyServer) serveRecvFrontend(stream client.ProxyService_ProxyServer,
 	}
 }
 
+// pickBackend selects the backend serving a new dial request from the
+// frontend, enforcing the dial rate limits if they are configured.
+func (s *ProxyServer) pickBackend(identity string) (Backend, error) {
+	if s.isDraining() {
+		return nil, &ErrDraining{}
+	}
+	if s.DialLimiter != nil {
+		if err := s.DialLimiter.AllowFrontend(identity, s.PendingDial.Len()); err != nil {
+			return nil, err
+		}
+	}
+	backend, err := s.BackendManager.Backend(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	if s.DialLimiter != nil {
+		if err := s.DialLimiter.AllowAgent(backend); err != nil {
+			releaseBackend(backend)
+			return nil, err
+		}
+	}
+	return backend, nil
+}
+
+// sendDialError answers a DIAL_REQ of a gRPC frontend with a failed
+// DIAL_RSP.
+func (s *ProxyServer) sendDialError(stream client.ProxyService_ProxyServer, random int64, dialErr error) {
+	resp := &client.Packet{
+		Type: client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{
+			DialResponse: &client.DialResponse{
+				Random: random,
+				Error:  dialErr.Error(),
+			},
+		},
+	}
+	if err := stream.Send(resp); err != nil {
+		klog.ErrorS(err, "DIAL_RSP send to frontend stream failure")
+	}
+}
+
 func (s *ProxyServer) serveSend(stream client.ProxyService_ProxyServer, sendCh <-chan *client.Packet) {
 	klog.V(4).Infoln("start serve send ...")
 	for pkt := range sendCh {
@@ -359,6 +753,26 @@ func (s *ProxyServer) serveSend(stream client.ProxyService_ProxyServer, sendCh <
 	}
 }
 
+// frontendIdentity returns a description of the frontend peer of the
+// context: the identity attached by FrontendAuthInterceptor, otherwise the
+// common name of its client certificate when mTLS is used, or its address.
+func frontendIdentity(ctx context.Context) string {
+	if identity, ok := FrontendIdentityFromContext(ctx); ok {
+		return identity
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+		return tlsInfo.State.PeerCertificates[0].Subject.CommonName
+	}
+	if p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
 func agentID(stream agent.AgentService_ConnectServer) (string, error) {
 	md, ok := metadata.FromIncomingContext(stream.Context())
 	if !ok {
@@ -371,74 +785,22 @@ func agentID(stream agent.AgentService_ConnectServer) (string, error) {
 	return agentIDs[0], nil
 }
 
-func (s *ProxyServer) validateAuthToken(token string) error {
-	trReq := &authv1.TokenReview{
-		Spec: authv1.TokenReviewSpec{
-			Token:     token,
-			Audiences: []string{s.AgentAuthenticationOptions.AuthenticationAudience},
-		},
-	}
-	r, err := s.AgentAuthenticationOptions.KubernetesClient.AuthenticationV1().TokenReviews().Create(trReq)
-	if err != nil {
-		return fmt.Errorf("Failed to authenticate request. err:%v", err)
-	}
-
-	if r.Status.Error != "" {
-		return fmt.Errorf("lookup failed: %s", r.Status.Error)
-	}
-
-	if !r.Status.Authenticated {
-		return fmt.Errorf("lookup failed: service account jwt not valid")
-	}
-
-	// The username is of format: system:serviceaccount:(NAMESPACE):(SERVICEACCOUNT)
-	parts := strings.Split(r.Status.User.Username, ":")
-	if len(parts) != 4 {
-		return fmt.Errorf("lookup failed: unexpected username format")
-	}
-	// Validate the user that comes back from token review is a service account
-	if parts[0] != "system" || parts[1] != "serviceaccount" {
-		return fmt.Errorf("lookup failed: username returned is not a service account")
-	}
-
-	ns := parts[2]
-	sa := parts[3]
-	if s.AgentAuthenticationOptions.AgentNamespace != ns {
-		return fmt.Errorf("lookup failed: incoming request from %q namespace. Expected %q", ns, s.AgentAuthenticationOptions.AgentNamespace)
-	}
-
-	if s.AgentAuthenticationOptions.AgentServiceAccount != sa {
-		return fmt.Errorf("lookup failed: incoming request from %q service account. Expected %q", sa, s.AgentAuthenticationOptions.AgentServiceAccount)
-	}
-
-	return nil
-}
-
-func (s *ProxyServer) authenticateAgentViaToken(ctx context.Context) error {
-	md, ok := metadata.FromIncomingContext(ctx)
+// agentMaxConnections returns the maximum number of concurrent connections
+// the agent announced, 0 meaning unlimited.
+func agentMaxConnections(stream agent.AgentService_ConnectServer) (int, error) {
+	md, ok := metadata.FromIncomingContext(stream.Context())
 	if !ok {
-		return fmt.Errorf("Failed to retrieve metadata from context")
-	}
-
-	authContext := md.Get(header.AuthenticationTokenContextKey)
-	if len(authContext) == 0 {
-		return fmt.Errorf("Authentication context was not found in metadata")
-	}
-
-	if len(authContext) > 1 {
-		return fmt.Errorf("too many (%d) tokens are received", len(authContext))
+		return 0, fmt.Errorf("failed to get context")
 	}
-
-	if !strings.HasPrefix(authContext[0], header.AuthenticationTokenContextSchemePrefix) {
-		return fmt.Errorf("received token does not have %q prefix", header.AuthenticationTokenContextSchemePrefix)
+	values := md.Get(header.MaxConnections)
+	if len(values) == 0 {
+		return 0, nil
 	}
-
-	if err := s.validateAuthToken(strings.TrimPrefix(authContext[0], header.AuthenticationTokenContextSchemePrefix)); err != nil {
-		return fmt.Errorf("Failed to validate authentication token, err:%v", err)
+	max, err := strconv.Atoi(values[0])
+	if err != nil || max < 0 {
+		return 0, fmt.Errorf("invalid max connections %q announced by agent", values[0])
 	}
-
-	klog.V(2).Infoln("Client successfully authenticated via token")
-	return nil
+	return max, nil
 }
 
 // Connect is for agent to connect to ProxyServer as next hop
@@ -448,10 +810,43 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 		return err
 	}
 	klog.V(2).InfoS("Connect request from agent", "agentID", agentID)
-	backend := s.BackendManager.AddBackend(agentID, stream)
+	if s.isDraining() {
+		return &ErrDraining{}
+	}
+	maxConnections, err := agentMaxConnections(stream)
+	if err != nil {
+		return err
+	}
+
+	// The agent is authenticated before it is registered, so that no
+	// traffic is routed to an impostor.
+	var user *authv1.UserInfo
+	var refreshDeadline, minRefreshInterval time.Duration
+	if s.AgentAuthenticator != nil {
+		var byToken bool
+		creds, err := agentCredentials(stream.Context())
+		if err == nil {
+			user, byToken, err = s.authenticateAgent(creds)
+		}
+		if err != nil {
+			klog.ErrorS(err, "Client authentication failed", "agentID", agentID)
+			return err
+		}
+		// Only the agents authenticated by their token refresh it.
+		if byToken && s.AgentAuthenticationOptions != nil {
+			refreshDeadline = s.AgentAuthenticationOptions.RefreshDeadline
+			minRefreshInterval = s.AgentAuthenticationOptions.MinRefreshInterval
+		}
+	}
+	if err := s.verifyAgentID(stream.Context(), agentID, user); err != nil {
+		klog.ErrorS(err, "Agent identity verification failed", "agentID", agentID)
+		return err
+	}
+
+	backend := s.BackendManager.AddBackend(agentID, stream, maxConnections)
 	defer s.BackendManager.RemoveBackend(agentID, stream)
 
-	h := metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, strconv.Itoa(s.serverCount))
+	h := metadata.Pairs(header.ServerID, s.serverID, header.ServerCount, strconv.Itoa(s.ServerCount()))
 	if err := stream.SendHeader(h); err != nil {
 		return err
 	}
@@ -459,20 +854,20 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 	recvCh := make(chan *client.Packet, 10)
 	stopCh := make(chan error)
 
-	if s.AgentAuthenticationOptions.Enabled {
-		if err := s.authenticateAgentViaToken(stream.Context()); err != nil {
-			klog.ErrorS(err, "Client authentication failed")
-			return err
-		}
-	}
-
 	go s.serveRecvBackend(backend, stream, agentID, recvCh)
 
-	defer func() {
-		close(recvCh)
-	}()
+	// The results of the validation of the refreshed tokens.
+	authCh := make(chan error)
+	done := make(chan struct{})
+	defer close(done)
+	// One refreshed token of the stream is validated at a time.
+	refreshing := make(chan struct{}, 1)
 
 	go func() {
+		// Closing recvCh here, rather than when Connect returns, as the
+		// agent may be disconnected while a packet is being received.
+		defer close(recvCh)
+		var lastRefresh time.Time
 		for {
 			in, err := stream.Recv()
 			if err == io.EOF {
@@ -485,11 +880,85 @@ func (s *ProxyServer) Connect(stream agent.AgentService_ConnectServer) error {
 				return
 			}
 
+			if in.Type == client.PacketType_AUTH_REFRESH {
+				if time.Since(lastRefresh) < minRefreshInterval {
+					klog.V(2).InfoS("Drop AUTH_REFRESH sent too soon after the previous one", "agentID", agentID, "minRefreshInterval", minRefreshInterval)
+					continue
+				}
+				select {
+				case refreshing <- struct{}{}:
+				default:
+					klog.V(2).InfoS("Drop AUTH_REFRESH while the previous token is validated", "agentID", agentID)
+					continue
+				}
+				lastRefresh = time.Now()
+				go func(token string) {
+					defer func() { <-refreshing }()
+					s.refreshAgentToken(stream.Context(), agentID, token, authCh, done)
+				}(in.GetAuthRefresh().GetToken())
+				continue
+			}
 			recvCh <- in
 		}
 	}()
 
-	return <-stopCh
+	var deadline <-chan time.Time
+	var timer *time.Timer
+	if refreshDeadline > 0 {
+		timer = time.NewTimer(refreshDeadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	draining := s.draining()
+	for {
+		select {
+		case err := <-stopCh:
+			return err
+		case <-draining:
+			// The established connections are served until the agent
+			// closes the stream.
+			s.sendGoAway(backend, agentID)
+			draining = nil
+		case err := <-authCh:
+			if err != nil {
+				klog.ErrorS(err, "Agent token refresh failed, disconnecting", "agentID", agentID)
+				return err
+			}
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(refreshDeadline)
+			}
+		case <-deadline:
+			klog.InfoS("Agent did not refresh its token in time, disconnecting", "agentID", agentID, "deadline", refreshDeadline)
+			return fmt.Errorf("agent did not refresh its token within %v", refreshDeadline)
+		}
+	}
+}
+
+// refreshAgentToken validates the token the agent sent in an AUTH_REFRESH,
+// including that it is still bound to the agentID, and reports the result
+// on authCh, unless the agent is already gone.
+func (s *ProxyServer) refreshAgentToken(ctx context.Context, agentID, token string, authCh chan<- error, done <-chan struct{}) {
+	if s.AgentAuthenticator == nil {
+		return
+	}
+	// The client certificate is left out, so that it does not stand in for
+	// a revoked token.
+	user, _, err := s.authenticateAgent(AgentCredentials{Token: token})
+	if err != nil {
+		err = fmt.Errorf("Failed to validate refreshed authentication token, err:%v", err)
+	} else if err = s.verifyAgentID(ctx, agentID, user); err != nil {
+		err = fmt.Errorf("Refreshed authentication token is not valid for the agent, err:%v", err)
+	} else {
+		klog.V(4).InfoS("Agent refreshed its token", "agentID", agentID)
+	}
+	select {
+	case authCh <- err:
+	case <-done:
+	}
 }
 
 // route the packet back to the correct client
@@ -522,26 +991,41 @@ func (s *ProxyServer) serveRecvBackend(backend Backend, stream agent.AgentServic
 			resp := pkt.GetDialResponse()
 			klog.V(5).InfoS("Received DIAL_RSP", "random", resp.Random, "agentID", agentID, "connectionID", resp.ConnectID)
 
-			if frontend, ok := s.PendingDial.Get(resp.Random); !ok {
+			frontend, ok := s.PendingDial.Get(resp.Random)
+			// The frontend may have given up on the dial in the meantime.
+			if ok && !s.PendingDial.Remove(resp.Random) {
+				ok = false
+			}
+			if !ok {
 				klog.V(5).Infoln("DIAL_RSP not recognized; dropped")
+				if resp.Error == "" && backend != nil {
+					s.closeOrphanConnection(backend, agentID, resp.ConnectID)
+				}
 			} else {
-				dialErr := false
+				var dialErr error
+				frontend.agentID = agentID
 				if resp.Error != "" {
-					klog.ErrorS(errors.New(resp.Error), "DIAL_RSP contains failure")
-					dialErr = true
+					dialErr = errors.New(resp.Error)
+					klog.ErrorS(dialErr, "DIAL_RSP contains failure")
 				}
 				err := frontend.send(pkt)
-				s.PendingDial.Remove(resp.Random)
 				if err != nil {
 					klog.ErrorS(err, "DIAL_RSP send to frontend stream failure")
-					dialErr = true
+					if dialErr == nil {
+						dialErr = err
+					}
 				}
 				// Avoid adding the frontend if there was an error dialing the destination
-				if dialErr == true {
+				if dialErr != nil {
+					frontend.releaseBackend()
+					s.audit(AuditDialFailed, frontend, dialErr)
+					frontend.dialErr = dialErr
+					close(frontend.connected)
 					break
 				}
 				frontend.connectID = resp.ConnectID
-				frontend.agentID = agentID
+				frontend.touch()
+				s.audit(AuditDialEstablished, frontend, nil)
 				s.addFrontend(agentID, resp.ConnectID, frontend)
 				close(frontend.connected)
 				metrics.Metrics.ObserveDialLatency(time.Since(frontend.start))
@@ -578,6 +1062,15 @@ func (s *ProxyServer) serveRecvBackend(backend Backend, stream agent.AgentServic
 			s.removeFrontend(agentID, resp.ConnectID)
 			klog.V(5).InfoS("Close streaming", "agentID", agentID, "connectionID", resp.ConnectID)
 
+		case client.PacketType_GOAWAY:
+			klog.V(2).InfoS("Received GOAWAY", "agentID", agentID, "reason", pkt.GetGoAway().GetReason())
+			// The established connections are kept until the agent
+			// closes the stream, only new dials are routed elsewhere.
+			// The backend is removed when Connect returns.
+			if l, ok := s.BackendManager.(backendLeaver); ok {
+				l.GoAway(agentID, stream)
+			}
+
 		default:
 			klog.V(2).InfoS("Unrecognized packet", "packet", pkt)
 		}
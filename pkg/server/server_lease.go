@@ -0,0 +1,176 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// ServerLeaseLabel labels the Leases the proxy servers register with.
+const ServerLeaseLabel = "konnectivity.k8s.io/proxy-server"
+
+// ServerCounter returns the number of proxy server instances the agents
+// should connect to. A count of 0 means unknown.
+type ServerCounter interface {
+	ServerCount() int
+}
+
+// ServerLease registers the proxy server in a Lease of the given namespace,
+// and counts the proxy servers whose Lease is live. The Lease is named after
+// the server ID and renewed every third of its duration. Leases expired for
+// longer than their duration are deleted.
+type ServerLease struct {
+	client        kubernetes.Interface
+	namespace     string
+	serverID      string
+	leaseDuration time.Duration
+	now           func() time.Time
+
+	count int32 // accessed atomically
+}
+
+var _ ServerCounter = &ServerLease{}
+
+// NewServerLease returns the Lease of the server serverID.
+func NewServerLease(client kubernetes.Interface, namespace, serverID string, leaseDuration time.Duration) *ServerLease {
+	return &ServerLease{
+		client:        client,
+		namespace:     namespace,
+		serverID:      serverID,
+		leaseDuration: leaseDuration,
+		now:           time.Now,
+	}
+}
+
+// ServerLeaseName returns the name of the Lease of the server serverID.
+func ServerLeaseName(serverID string) string {
+	return "konnectivity-server-" + serverID
+}
+
+// ServerCount returns the number of live Leases seen by the last sync, or 0
+// if no sync succeeded yet.
+func (l *ServerLease) ServerCount() int {
+	return int(atomic.LoadInt32(&l.count))
+}
+
+// Run renews the Lease and refreshes the count until stopCh is closed.
+func (l *ServerLease) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := l.sync(); err != nil {
+			klog.ErrorS(err, "Failed to sync the server lease", "namespace", l.namespace, "serverID", l.serverID)
+		}
+	}, l.leaseDuration/3, stopCh)
+}
+
+// Release deletes the Lease, so that the other servers stop counting this
+// one before the Lease expires.
+func (l *ServerLease) Release() error {
+	err := l.client.CoordinationV1().Leases(l.namespace).Delete(ServerLeaseName(l.serverID), &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *ServerLease) sync() error {
+	if err := l.renew(); err != nil {
+		return err
+	}
+	return l.refreshCount()
+}
+
+// renew creates the Lease of the server, or updates its renew time.
+func (l *ServerLease) renew() error {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(l.now())
+	lease, err := leases.Get(ServerLeaseName(l.serverID), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		durationSeconds := int32(l.leaseDuration.Seconds())
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ServerLeaseName(l.serverID),
+				Namespace: l.namespace,
+				Labels:    map[string]string{ServerLeaseLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.serverID,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(lease)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(lease)
+	return err
+}
+
+// refreshCount counts the live Leases and deletes the stale ones.
+func (l *ServerLease) refreshCount() error {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	list, err := leases.List(metav1.ListOptions{LabelSelector: ServerLeaseLabel + "=true"})
+	if err != nil {
+		return err
+	}
+	now := l.now()
+	count := 0
+	for i := range list.Items {
+		lease := &list.Items[i]
+		expiry, ok := leaseExpiry(lease)
+		if !ok || now.Before(expiry) {
+			// Leases without renew time or duration are counted, as
+			// their holder cannot be known to be gone.
+			count++
+			continue
+		}
+		if now.Sub(expiry) > l.leaseDuration {
+			klog.V(2).InfoS("Delete stale server lease", "lease", lease.Name)
+			err := leases.Delete(lease.Name, &metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+			})
+			if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+				klog.ErrorS(err, "Failed to delete stale server lease", "lease", lease.Name)
+			}
+		}
+	}
+	if count != l.ServerCount() {
+		klog.V(1).InfoS("Server count changed", "count", count, "previous", l.ServerCount())
+	}
+	atomic.StoreInt32(&l.count, int32(count))
+	return nil
+}
+
+// leaseExpiry returns when lease expires, or false if it does not say.
+func leaseExpiry(lease *coordinationv1.Lease) (time.Time, bool) {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return time.Time{}, false
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second), true
+}
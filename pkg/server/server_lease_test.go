@@ -0,0 +1,94 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServerLeaseCount(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	newLease := func(serverID string) *ServerLease {
+		l := NewServerLease(client, "kube-system", serverID, 30*time.Second)
+		l.now = clock
+		return l
+	}
+	sync := func(l *ServerLease, want int) {
+		t.Helper()
+		if err := l.sync(); err != nil {
+			t.Fatal(err)
+		}
+		if got := l.ServerCount(); got != want {
+			t.Errorf("%s: expected %d servers, got %d", l.serverID, want, got)
+		}
+	}
+
+	l1, l2 := newLease("server1"), newLease("server2")
+	if got := l1.ServerCount(); got != 0 {
+		t.Errorf("expected an unknown count before the first sync, got %d", got)
+	}
+	sync(l1, 1)
+	sync(l2, 2)
+	sync(l1, 2)
+
+	// server2 stops renewing its lease.
+	now = now.Add(40 * time.Second)
+	sync(l1, 1)
+	if _, err := client.CoordinationV1().Leases("kube-system").Get(ServerLeaseName("server2"), metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the recently expired lease to be kept, got %v", err)
+	}
+	now = now.Add(40 * time.Second)
+	sync(l1, 1)
+	if _, err := client.CoordinationV1().Leases("kube-system").Get(ServerLeaseName("server2"), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the stale lease to be deleted, got %v", err)
+	}
+
+	// server2 comes back.
+	sync(l2, 2)
+	if err := l2.Release(); err != nil {
+		t.Fatal(err)
+	}
+	sync(l1, 1)
+}
+
+type fixedServerCounter int
+
+func (c fixedServerCounter) ServerCount() int {
+	return int(c)
+}
+
+func TestProxyServerCount(t *testing.T) {
+	p := NewProxyServer("", 3, &AgentTokenAuthenticationOptions{})
+	if got := p.ServerCount(); got != 3 {
+		t.Errorf("expected the static count, got %d", got)
+	}
+	p.ServerCounter = fixedServerCounter(0)
+	if got := p.ServerCount(); got != 3 {
+		t.Errorf("expected the static count while the live count is unknown, got %d", got)
+	}
+	p.ServerCounter = fixedServerCounter(5)
+	if got := p.ServerCount(); got != 5 {
+		t.Errorf("expected the live count, got %d", got)
+	}
+}
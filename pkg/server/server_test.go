@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"google.golang.org/grpc/metadata"
@@ -32,6 +34,8 @@ import (
 	fakeauthenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1/fake"
 	k8stesting "k8s.io/client-go/testing"
 
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
 	agentmock "sigs.k8s.io/apiserver-network-proxy/proto/agent/mocks"
 	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
@@ -152,10 +156,11 @@ func TestAgentTokenAuthenticationErrorsToken(t *testing.T) {
 			ctx = metadata.NewIncomingContext(ctx, md)
 			conn := agentmock.NewMockAgentService_ConnectServer(stub)
 			conn.EXPECT().Context().AnyTimes().Return(ctx)
-			conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
 
-			// close agent's connection if no error is expected
+			// close agent's connection if no error is expected; rejected
+			// agents are not registered, hence get no headers.
 			if !tc.wantError {
+				conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
 				conn.EXPECT().Recv().Return(nil, io.EOF)
 			}
 
@@ -180,6 +185,228 @@ func TestAgentTokenAuthenticationErrorsToken(t *testing.T) {
 	}
 }
 
+func TestAgentTokenRefresh(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	ns := "test_ns"
+	sa := "test_sa"
+	deadline := 200 * time.Millisecond
+
+	testCases := []struct {
+		desc      string
+		refreshes []string
+		wantError bool
+	}{
+		{
+			desc:      "refreshed in time",
+			refreshes: []string{"token2", "token3"},
+		},
+		{
+			desc:      "revoked token",
+			refreshes: []string{"revoked"},
+			wantError: true,
+		},
+		{
+			desc:      "no refresh",
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			kcs := k8sfake.NewSimpleClientset()
+			kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+				token := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview).Spec.Token
+				tr := &authv1.TokenReview{
+					Status: authv1.TokenReviewStatus{
+						Authenticated: token != "revoked",
+						User: authv1.UserInfo{
+							Username: fmt.Sprintf("system:serviceaccount:%v:%v", ns, sa),
+						},
+					},
+				}
+				return true, tr, nil
+			})
+
+			md := metadata.Pairs(
+				header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+"token1",
+				header.AgentID, "agent1")
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+			packets := make(chan *client.Packet)
+			conn := agentmock.NewMockAgentService_ConnectServer(stub)
+			conn.EXPECT().Context().AnyTimes().Return(ctx)
+			conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
+			conn.EXPECT().Recv().AnyTimes().DoAndReturn(func() (*client.Packet, error) {
+				pkt, ok := <-packets
+				if !ok {
+					return nil, io.EOF
+				}
+				return pkt, nil
+			})
+
+			p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{
+				Enabled:             true,
+				KubernetesClient:    kcs,
+				AgentNamespace:      ns,
+				AgentServiceAccount: sa,
+				RefreshDeadline:     deadline,
+			})
+			connectErr := make(chan error)
+			go func() {
+				connectErr <- p.Connect(conn)
+			}()
+
+			for _, token := range tc.refreshes {
+				time.Sleep(deadline / 2)
+				packets <- &client.Packet{
+					Type: client.PacketType_AUTH_REFRESH,
+					Payload: &client.Packet_AuthRefresh{
+						AuthRefresh: &client.AuthRefresh{Token: token},
+					},
+				}
+			}
+			if !tc.wantError {
+				// Each refresh pushes the deadline back.
+				select {
+				case err := <-connectErr:
+					t.Fatalf("expected the agent to stay connected, got %v", err)
+				case <-time.After(deadline / 2):
+				}
+				close(packets)
+			}
+
+			select {
+			case err := <-connectErr:
+				if tc.wantError && err == nil {
+					t.Error("expected the agent to be disconnected with an error")
+				}
+				if !tc.wantError && err != nil {
+					t.Errorf("did not expect an error, got %v", err)
+				}
+			case <-time.After(5 * deadline):
+				t.Fatal("expected Connect to return")
+			}
+			if tc.wantError {
+				close(packets)
+			}
+		})
+	}
+}
+
+func TestAgentTokenRefreshLimited(t *testing.T) {
+	stub := gomock.NewController(t)
+	defer stub.Finish()
+
+	ns := "test_ns"
+	sa := "test_sa"
+	minInterval := 100 * time.Millisecond
+
+	var mu sync.Mutex
+	reviewed := make(map[string]int)
+	release := make(chan struct{})
+	kcs := k8sfake.NewSimpleClientset()
+	kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		token := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview).Spec.Token
+		mu.Lock()
+		reviewed[token]++
+		mu.Unlock()
+		if token == "token2" {
+			<-release
+		}
+		tr := &authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: true,
+				User: authv1.UserInfo{
+					Username: fmt.Sprintf("system:serviceaccount:%v:%v", ns, sa),
+				},
+			},
+		}
+		return true, tr, nil
+	})
+	wasReviewed := func(token string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return reviewed[token] > 0
+	}
+
+	md := metadata.Pairs(
+		header.AuthenticationTokenContextKey, header.AuthenticationTokenContextSchemePrefix+"token1",
+		header.AgentID, "agent1")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	packets := make(chan *client.Packet)
+	conn := agentmock.NewMockAgentService_ConnectServer(stub)
+	conn.EXPECT().Context().AnyTimes().Return(ctx)
+	conn.EXPECT().SendHeader(gomock.Any()).Return(nil)
+	conn.EXPECT().Recv().AnyTimes().DoAndReturn(func() (*client.Packet, error) {
+		pkt, ok := <-packets
+		if !ok {
+			return nil, io.EOF
+		}
+		return pkt, nil
+	})
+
+	p := NewProxyServer("", 1, &AgentTokenAuthenticationOptions{
+		Enabled:             true,
+		KubernetesClient:    kcs,
+		AgentNamespace:      ns,
+		AgentServiceAccount: sa,
+		MinRefreshInterval:  minInterval,
+	})
+	connectErr := make(chan error)
+	go func() {
+		connectErr <- p.Connect(conn)
+	}()
+	refresh := func(token string) {
+		packets <- &client.Packet{
+			Type: client.PacketType_AUTH_REFRESH,
+			Payload: &client.Packet_AuthRefresh{
+				AuthRefresh: &client.AuthRefresh{Token: token},
+			},
+		}
+	}
+	waitReviewed := func(token string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !wasReviewed(token) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s to be reviewed", token)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	refresh("token2")
+	waitReviewed("token2")
+	// token2 is still being reviewed.
+	time.Sleep(minInterval)
+	refresh("token3")
+	// Sent once token3 is handled.
+	refresh("token3")
+	close(release)
+	time.Sleep(minInterval)
+	refresh("token4")
+	waitReviewed("token4")
+	// Sent too soon after token4.
+	refresh("token5")
+	refresh("token5")
+	close(packets)
+
+	select {
+	case err := <-connectErr:
+		if err != nil {
+			t.Errorf("did not expect an error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Connect to return")
+	}
+	for _, token := range []string{"token3", "token5"} {
+		if wasReviewed(token) {
+			t.Errorf("expected %s to be dropped", token)
+		}
+	}
+}
+
 func TestAddRemoveFrontends(t *testing.T) {
 	agent1ConnID1 := new(ProxyClientConnection)
 	agent1ConnID2 := new(ProxyClientConnection)
@@ -216,3 +443,90 @@ func TestAddRemoveFrontends(t *testing.T) {
 		t.Errorf("expected %v, got %v", e, a)
 	}
 }
+
+func TestReapConnections(t *testing.T) {
+	p := NewProxyServer("", 1, nil)
+	p.IdleTimeout = time.Minute
+	p.MaxConnectionLifetime = time.Hour
+
+	now := time.Now()
+	backend := newFakeBackend("agent1")
+	newConn := func(connID int64, start, lastActivity time.Time) (*ProxyClientConnection, *fakeFrontend) {
+		frontend := &fakeFrontend{sent: make(chan *client.Packet, 10)}
+		c := &ProxyClientConnection{
+			Mode:         "grpc",
+			Grpc:         frontend,
+			connectID:    connID,
+			agentID:      "agent1",
+			start:        start,
+			backend:      backend,
+			lastActivity: lastActivity.UnixNano(),
+		}
+		p.addFrontend("agent1", connID, c)
+		return c, frontend
+	}
+	_, active := newConn(1, now.Add(-time.Minute), now)
+	_, idle := newConn(2, now.Add(-time.Minute), now.Add(-2*time.Minute))
+	_, old := newConn(3, now.Add(-2*time.Hour), now)
+
+	p.reapConnections(now)
+
+	if _, err := p.getFrontend("agent1", 1); err != nil {
+		t.Errorf("expected active connection to be kept: %v", err)
+	}
+	if len(active.sent) != 0 {
+		t.Errorf("expected nothing sent to the active frontend, got %d packets", len(active.sent))
+	}
+	for connID, tc := range map[int64]struct {
+		frontend *fakeFrontend
+		reason   metrics.ReapReason
+	}{
+		2: {idle, metrics.ReapIdleTimeout},
+		3: {old, metrics.ReapMaxLifetime},
+	} {
+		if _, err := p.getFrontend("agent1", connID); err == nil {
+			t.Errorf("expected connection %d to be removed", connID)
+		}
+		select {
+		case pkt := <-tc.frontend.sent:
+			if pkt.Type != client.PacketType_CLOSE_RSP || pkt.GetCloseResponse().Error != string(tc.reason) {
+				t.Errorf("expected CLOSE_RSP with reason %q for connection %d, got %+v", tc.reason, connID, pkt)
+			}
+		default:
+			t.Errorf("expected CLOSE_RSP to be sent for connection %d", connID)
+		}
+	}
+
+	closed := map[int64]bool{}
+	for _, pkt := range backend.sent {
+		if pkt.Type == client.PacketType_CLOSE_REQ {
+			closed[pkt.GetCloseRequest().ConnectID] = true
+		}
+	}
+	if !reflect.DeepEqual(closed, map[int64]bool{2: true, 3: true}) {
+		t.Errorf("expected CLOSE_REQ for connections 2 and 3, got %v", closed)
+	}
+}
+
+func TestNoBackendDialResponse(t *testing.T) {
+	p := NewProxyServer("", 1, nil)
+
+	frontend := &fakeFrontend{sent: make(chan *client.Packet, 10)}
+	recvCh := make(chan *client.Packet, 1)
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{DialRequest: &client.DialRequest{Protocol: "tcp", Address: "127.0.0.1:80", Random: 111}},
+	}
+	close(recvCh)
+	p.serveRecvFrontend(frontend, "", recvCh)
+
+	select {
+	case pkt := <-frontend.sent:
+		resp := pkt.GetDialResponse()
+		if pkt.Type != client.PacketType_DIAL_RSP || resp.Random != 111 || resp.Error == "" {
+			t.Errorf("expected a failed DIAL_RSP for random 111, got %+v", pkt)
+		}
+	default:
+		t.Fatal("expected a DIAL_RSP to be sent to the frontend without agent")
+	}
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 1
+
+	socks5CmdConnect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5NetworkUnreachable  = 3
+	socks5HostUnreachable     = 4
+	socks5TTLExpired          = 6
+	socks5CommandNotSupported = 7
+	socks5AddrNotSupported    = 8
+)
+
+// SOCKS5 implements Proxy based on SOCKS5 CONNECT, which tunnels the traffic
+// to the agent registered in ProxyServer.
+type SOCKS5 struct {
+	Server *ProxyServer
+	// Credentials maps the usernames allowed to connect to their passwords.
+	// If nil, clients connect without authentication.
+	Credentials map[string]string
+	// HandshakeTimeout bounds the time a client takes to negotiate,
+	// authenticate and send its CONNECT request. 0 means no timeout.
+	HandshakeTimeout time.Duration
+}
+
+// LoadSOCKS5Credentials reads a file of "username:password" lines.
+func LoadSOCKS5Credentials(path string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, i+1)
+		}
+		credentials[parts[0]] = parts[1]
+	}
+	return credentials, nil
+}
+
+// Serve accepts SOCKS5 connections on l until it is closed.
+func (s *SOCKS5) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single SOCKS5 connection.
+func (s *SOCKS5) ServeConn(conn net.Conn) {
+	klog.V(2).InfoS("Received SOCKS5 connection", "remoteAddr", conn.RemoteAddr())
+	br := bufio.NewReader(conn)
+
+	// The deadline is cleared once the CONNECT request is read.
+	if s.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	identity, err := s.handshake(conn, br)
+	if err != nil {
+		klog.V(2).InfoS("SOCKS5 handshake failed", "remoteAddr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	address, reply, err := readSOCKS5Request(br)
+	if err != nil {
+		klog.V(2).InfoS("Invalid SOCKS5 request", "remoteAddr", conn.RemoteAddr(), "err", err)
+		writeSOCKS5Reply(conn, reply)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	klog.V(2).InfoS("Received SOCKS5 CONNECT", "address", address, "identity", identity)
+
+	random := rand.Int63()
+	dialRequest := &client.Packet{
+		Type: client.PacketType_DIAL_REQ,
+		Payload: &client.Packet_DialRequest{
+			DialRequest: &client.DialRequest{
+				Protocol: "tcp",
+				Address:  address,
+				Random:   random,
+			},
+		},
+	}
+	connection := &ProxyClientConnection{
+		Mode:      "socks5",
+		HTTP:      conn,
+		connected: make(chan struct{}),
+		start:     time.Now(),
+		identity:  identity,
+		address:   address,
+	}
+	backend, err := s.Server.pickBackend(identity)
+	if err != nil {
+		s.Server.audit(AuditDialFailed, connection, err)
+		reply := byte(socks5NetworkUnreachable)
+		switch err.(type) {
+		case *ErrDialRateLimited, *ErrDraining:
+			reply = socks5GeneralFailure
+		}
+		writeSOCKS5Reply(conn, reply)
+		conn.Close()
+		return
+	}
+	connection.backend = backend
+
+	s.Server.PendingDial.Add(random, connection)
+	s.Server.audit(AuditDialRequested, connection, nil)
+	if err := backend.Send(dialRequest); err != nil {
+		klog.ErrorS(err, "failed to tunnel dial request")
+		s.Server.PendingDial.Remove(random)
+		connection.releaseBackend()
+		s.Server.audit(AuditDialFailed, connection, err)
+		writeSOCKS5Reply(conn, socks5GeneralFailure)
+		conn.Close()
+		return
+	}
+
+	done, stopWatching := watchSOCKS5Client(conn, br)
+	err = s.Server.waitForDial(connection, random, done)
+	stopWatching()
+	if err != nil {
+		// The failure of the dial itself was replied with the DIAL_RSP.
+		switch err.(type) {
+		case *ErrDialTimeout:
+			writeSOCKS5Reply(conn, socks5TTLExpired)
+		case *ErrNotFound:
+			writeSOCKS5Reply(conn, socks5GeneralFailure)
+		}
+		conn.Close()
+		return
+	}
+
+	connID := connection.connectID
+	pkt := make([]byte, 1<<12)
+	for {
+		n, err := br.Read(pkt)
+		if n > 0 {
+			packet := &client.Packet{
+				Type: client.PacketType_DATA,
+				Payload: &client.Packet_Data{
+					Data: &client.Data{
+						ConnectID: connID,
+						Data:      pkt[:n],
+					},
+				},
+			}
+			if err := backend.Send(packet); err != nil {
+				klog.ErrorS(err, "error sending packet")
+				break
+			}
+			connection.addBytesFromFrontend(n)
+		}
+		if err == io.EOF {
+			klog.V(1).InfoS("EOF from SOCKS5 client", "address", address)
+			break
+		}
+		if err != nil {
+			klog.V(2).InfoS("Received failure on connection", "err", err)
+			break
+		}
+	}
+
+	// The agent closed the connection first, there is nothing left to close.
+	if _, err := s.Server.getFrontend(connection.agentID, connID); err != nil {
+		conn.Close()
+		return
+	}
+	closeRequest := &client.Packet{
+		Type: client.PacketType_CLOSE_REQ,
+		Payload: &client.Packet_CloseRequest{
+			CloseRequest: &client.CloseRequest{
+				ConnectID: connID,
+			},
+		},
+	}
+	if err := backend.Send(closeRequest); err != nil {
+		klog.ErrorS(err, "CLOSE_REQ to agent failed", "connectionID", connID)
+	}
+	conn.Close()
+	klog.V(5).InfoS("Stopping transfer to host", "address", address, "agentID", connection.agentID, "connectionID", connID)
+}
+
+// watchSOCKS5Client returns a channel closed once the client disconnects
+// while the agent dials, and the function to call once the dial is done,
+// which stops watching. The data sent by the client meanwhile is left in br,
+// and the client is no longer watched once it sent some.
+func watchSOCKS5Client(conn net.Conn, br *bufio.Reader) (<-chan struct{}, func()) {
+	done := make(chan struct{})
+	stopCh := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if _, err := br.Peek(1); err != nil {
+			select {
+			case <-stopCh:
+			default:
+				klog.V(2).InfoS("SOCKS5 client is gone during the dial", "remoteAddr", conn.RemoteAddr(), "err", err)
+				close(done)
+			}
+		}
+	}()
+	return done, func() {
+		// Interrupt the Peek, so that br is read by a single goroutine.
+		close(stopCh)
+		conn.SetReadDeadline(time.Now())
+		<-exited
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// handshake negotiates the authentication method and authenticates the
+// client, returning its identity.
+func (s *SOCKS5) handshake(conn net.Conn, br *bufio.Reader) (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if s.Credentials != nil {
+		method = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == method {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", fmt.Errorf("client does not offer authentication method %d", method)
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthNone {
+		return socksFrontendIdentity(conn), nil
+	}
+
+	ver, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if ver != socks5PasswordVersion {
+		return "", fmt.Errorf("unsupported username/password authentication version %d", ver)
+	}
+	user, err := readSOCKS5String(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSOCKS5String(br)
+	if err != nil {
+		return "", err
+	}
+	expected, ok := s.Credentials[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		conn.Write([]byte{socks5PasswordVersion, 1})
+		return "", fmt.Errorf("invalid credentials for user %q", user)
+	}
+	if _, err := conn.Write([]byte{socks5PasswordVersion, 0}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// socksFrontendIdentity returns a description of the SOCKS5 client: the
+// common name of its client certificate when mTLS is used, otherwise its
+// remote address.
+func socksFrontendIdentity(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			return state.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	return conn.RemoteAddr().String()
+}
+
+func readSOCKS5String(br *bufio.Reader) (string, error) {
+	l, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readSOCKS5Request reads a CONNECT request and returns the destination
+// address. On error, it returns the reply code for the client.
+func readSOCKS5Request(br *bufio.Reader) (string, byte, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return "", socks5GeneralFailure, err
+	}
+	if hdr[0] != socks5Version {
+		return "", socks5GeneralFailure, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	if hdr[1] != socks5CmdConnect {
+		return "", socks5CommandNotSupported, fmt.Errorf("unsupported SOCKS command %d", hdr[1])
+	}
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		l := net.IPv4len
+		if hdr[3] == socks5AddrIPv6 {
+			l = net.IPv6len
+		}
+		ip := make([]byte, l)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		name, err := readSOCKS5String(br)
+		if err != nil {
+			return "", socks5GeneralFailure, err
+		}
+		host = name
+	default:
+		return "", socks5AddrNotSupported, fmt.Errorf("unsupported SOCKS address type %d", hdr[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", socks5GeneralFailure, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), socks5Succeeded, nil
+}
+
+// writeSOCKS5DialReply tells the client the result of the dial.
+func writeSOCKS5DialReply(conn net.Conn, resp *client.DialResponse) error {
+	if resp.Error != "" {
+		writeSOCKS5Reply(conn, socks5HostUnreachable)
+		return conn.Close()
+	}
+	return writeSOCKS5Reply(conn, socks5Succeeded)
+}
+
+// writeSOCKS5Reply sends a reply with an unspecified bound address.
+func writeSOCKS5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+func TestLoadSOCKS5Credentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# frontends\nkube-apiserver:secret\n\ndebug:pass:word\n")
+	f.Close()
+
+	credentials, err := LoadSOCKS5Credentials(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"kube-apiserver": "secret", "debug": "pass:word"}
+	if !reflect.DeepEqual(credentials, expected) {
+		t.Errorf("expected %v, got %v", expected, credentials)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("no-password\n"), 0600)
+	if _, err := LoadSOCKS5Credentials(f.Name()); err == nil {
+		t.Error("expected an error for a line without password")
+	}
+}
+
+func TestReadSOCKS5Request(t *testing.T) {
+	testcases := []struct {
+		name    string
+		req     []byte
+		address string
+		reply   byte
+	}{
+		{
+			name:    "ipv4",
+			req:     []byte{5, socks5CmdConnect, 0, socks5AddrIPv4, 10, 0, 0, 1, 0x01, 0xbb},
+			address: "10.0.0.1:443",
+			reply:   socks5Succeeded,
+		},
+		{
+			name:    "domain",
+			req:     append(append([]byte{5, socks5CmdConnect, 0, socks5AddrDomain, 11}, "example.com"...), 0, 80),
+			address: "example.com:80",
+			reply:   socks5Succeeded,
+		},
+		{
+			name:    "ipv6",
+			req:     append(append([]byte{5, socks5CmdConnect, 0, socks5AddrIPv6}, net.ParseIP("::1")...), 0, 80),
+			address: "[::1]:80",
+			reply:   socks5Succeeded,
+		},
+		{
+			name:  "bind",
+			req:   []byte{5, 2, 0, socks5AddrIPv4, 10, 0, 0, 1, 0, 80},
+			reply: socks5CommandNotSupported,
+		},
+		{
+			name:  "unknown address type",
+			req:   []byte{5, socks5CmdConnect, 0, 9},
+			reply: socks5AddrNotSupported,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			address, reply, err := readSOCKS5Request(bufio.NewReader(bytes.NewReader(tc.req)))
+			if reply != tc.reply {
+				t.Errorf("expected reply %d, got %d (%v)", tc.reply, reply, err)
+			}
+			if tc.reply == socks5Succeeded && (err != nil || address != tc.address) {
+				t.Errorf("expected %s, got %s (%v)", tc.address, address, err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5NoBackend(t *testing.T) {
+	p := NewProxyServer("", 1, nil)
+	socks := &SOCKS5{Server: p}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go socks.ServeConn(server)
+
+	client.Write([]byte{5, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	if _, err := client.Read(method); err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != socks5AuthNone {
+		t.Fatalf("expected no authentication, got method %d", method[1])
+	}
+	client.Write([]byte{5, socks5CmdConnect, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 80})
+	reply := make([]byte, 10)
+	if _, err := client.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5NetworkUnreachable {
+		t.Errorf("expected network unreachable without backend, got reply %d", reply[1])
+	}
+}
+
+func TestSOCKS5HandshakeTimeout(t *testing.T) {
+	p := NewProxyServer("", 1, nil)
+	socks := &SOCKS5{Server: p, HandshakeTimeout: 50 * time.Millisecond}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go socks.ServeConn(server)
+
+	// The client negotiates, then never sends its CONNECT request.
+	client.Write([]byte{5, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	if _, err := client.Read(method); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Errorf("expected the connection to be closed after the handshake timeout, got %v", err)
+	}
+}
+
+// connectSOCKS5 negotiates no authentication on conn and sends a CONNECT
+// request to 127.0.0.1:80.
+func connectSOCKS5(t *testing.T, conn net.Conn) {
+	conn.Write([]byte{5, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{5, socks5CmdConnect, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 80})
+}
+
+func TestSOCKS5ClientGoneDuringDial(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p := NewProxyServer("", 1, nil)
+	p.BackendManager = &staticBackendManager{DefaultBackendManager: NewDefaultBackendManager(), backend: backend}
+	socks := &SOCKS5{Server: p}
+
+	conn, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		socks.ServeConn(server)
+	}()
+	connectSOCKS5(t, conn)
+	if pkt := <-backend.sent; pkt.Type != client.PacketType_DIAL_REQ {
+		t.Fatalf("expected DIAL_REQ, got %v", pkt.Type)
+	}
+
+	// The client disconnects before the agent answers.
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the SOCKS5 connection to be served until the client disconnects")
+	}
+	if n := p.PendingDial.Len(); n != 0 {
+		t.Errorf("expected the pending dial to be removed, got %d", n)
+	}
+}
+
+func TestSOCKS5DataSentDuringDial(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p := NewProxyServer("", 1, nil)
+	p.BackendManager = &staticBackendManager{DefaultBackendManager: NewDefaultBackendManager(), backend: backend}
+	socks := &SOCKS5{Server: p}
+
+	conn, server := net.Pipe()
+	defer conn.Close()
+	go socks.ServeConn(server)
+	connectSOCKS5(t, conn)
+
+	// The client sends data before the agent answers.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		conn.Write([]byte("hello"))
+	}()
+	recvCh := answerDial(t, p, backend, &client.DialResponse{ConnectID: 1})
+	if recvCh == nil {
+		return
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5Succeeded {
+		t.Fatalf("expected success, got reply %d", reply[1])
+	}
+	<-written
+
+	select {
+	case pkt := <-backend.sent:
+		if pkt.Type != client.PacketType_DATA || string(pkt.GetData().Data) != "hello" {
+			t.Errorf("expected the data sent during the dial, got %+v", pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the data sent during the dial to be tunneled")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
+)
+
+// TokenReviewCacheOptions configures a TokenReviewCache.
+type TokenReviewCacheOptions struct {
+	// MaxSize is the maximum number of cached results. The least recently
+	// used results are evicted first.
+	MaxSize int
+	// TTL is how long the result of a valid token is cached.
+	TTL time.Duration
+	// NegativeTTL is how long the result of an invalid token is cached.
+	NegativeTTL time.Duration
+}
+
+type tokenReviewEntry struct {
+	key     [sha256.Size]byte
+	status  authv1.TokenReviewStatus
+	expires time.Time
+}
+
+// TokenReviewCache caches the results of the TokenReview API, so that the
+// agents reconnecting at once, e.g. on a restart of the proxy server, do not
+// all hit the API server. Results are keyed by a hash of the token and the
+// audiences; the tokens themselves are not kept. Failed calls to the API are
+// not cached.
+type TokenReviewCache struct {
+	client kubernetes.Interface
+	opts   TokenReviewCacheOptions
+	now    func() time.Time
+
+	mu      sync.Mutex // protects the following
+	lru     *list.List // of *tokenReviewEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+// NewTokenReviewCache returns a cache of the TokenReviews made with client.
+func NewTokenReviewCache(client kubernetes.Interface, opts TokenReviewCacheOptions) *TokenReviewCache {
+	return &TokenReviewCache{
+		client:  client,
+		opts:    opts,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+func tokenReviewKey(token string, audiences []string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token + "\x00" + strings.Join(audiences, "\x00")))
+}
+
+// get returns the cached status of key, if it did not expire.
+func (c *TokenReviewCache) get(key [sha256.Size]byte) (authv1.TokenReviewStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return authv1.TokenReviewStatus{}, false
+	}
+	entry := elem.Value.(*tokenReviewEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return authv1.TokenReviewStatus{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.status, true
+}
+
+// add caches status under key, evicting the least recently used results
+// beyond MaxSize.
+func (c *TokenReviewCache) add(key [sha256.Size]byte, status authv1.TokenReviewStatus) {
+	ttl := c.opts.TTL
+	if !status.Authenticated || status.Error != "" {
+		ttl = c.opts.NegativeTTL
+	}
+	if ttl <= 0 || c.opts.MaxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &tokenReviewEntry{key: key, status: status, expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.opts.MaxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tokenReviewEntry).key)
+	}
+}
+
+// Len returns the number of cached results.
+func (c *TokenReviewCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Review returns the status of the TokenReview of token for audiences, from
+// the cache if possible.
+func (c *TokenReviewCache) Review(token string, audiences []string) (*authv1.TokenReviewStatus, error) {
+	key := tokenReviewKey(token, audiences)
+	if status, ok := c.get(key); ok {
+		metrics.Metrics.ObserveTokenReviewCache(metrics.CacheHit)
+		return &status, nil
+	}
+	metrics.Metrics.ObserveTokenReviewCache(metrics.CacheMiss)
+	status, err := createTokenReview(c.client, token, audiences)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, *status)
+	return status, nil
+}
+
+// reviewToken returns the status of the TokenReview of token, from cache if
+// it is not nil.
+func reviewToken(client kubernetes.Interface, cache *TokenReviewCache, token string, audiences []string) (*authv1.TokenReviewStatus, error) {
+	if cache != nil {
+		return cache.Review(token, audiences)
+	}
+	return createTokenReview(client, token, audiences)
+}
+
+// createTokenReview calls the TokenReview API.
+func createTokenReview(client kubernetes.Interface, token string, audiences []string) (*authv1.TokenReviewStatus, error) {
+	trReq := &authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: audiences,
+		},
+	}
+	start := time.Now()
+	r, err := client.AuthenticationV1().TokenReviews().Create(trReq)
+	metrics.Metrics.ObserveTokenReviewLatency(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	return &r.Status, nil
+}
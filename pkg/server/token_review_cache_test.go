@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	fakeauthenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeTokenReviewClient returns a clientset authenticating the tokens
+// prefixed with "valid", and counting the TokenReviews per token.
+func newFakeTokenReviewClient(reviews map[string]int, apiErr *error) *k8sfake.Clientset {
+	kcs := k8sfake.NewSimpleClientset()
+	kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		token := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview).Spec.Token
+		reviews[token]++
+		if *apiErr != nil {
+			return true, &authv1.TokenReview{}, *apiErr
+		}
+		tr := &authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: len(token) >= 5 && token[:5] == "valid",
+				User:          authv1.UserInfo{Username: "user-" + token},
+			},
+		}
+		return true, tr, nil
+	})
+	return kcs
+}
+
+func TestTokenReviewCache(t *testing.T) {
+	reviews := make(map[string]int)
+	var apiErr error
+	now := time.Now()
+	c := NewTokenReviewCache(newFakeTokenReviewClient(reviews, &apiErr), TokenReviewCacheOptions{
+		MaxSize:     2,
+		TTL:         time.Minute,
+		NegativeTTL: time.Second,
+	})
+	c.now = func() time.Time { return now }
+
+	review := func(token string, audiences ...string) *authv1.TokenReviewStatus {
+		t.Helper()
+		status, err := c.Review(token, audiences)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	// Positive results are cached for the TTL.
+	if status := review("valid1"); !status.Authenticated || status.User.Username != "user-valid1" {
+		t.Errorf("expected valid1 to be authenticated, got %+v", status)
+	}
+	review("valid1")
+	if reviews["valid1"] != 1 {
+		t.Errorf("expected one TokenReview of valid1, got %d", reviews["valid1"])
+	}
+	// The audiences are part of the key.
+	review("valid1", "konnectivity")
+	if reviews["valid1"] != 2 {
+		t.Errorf("expected a TokenReview for other audiences, got %d", reviews["valid1"])
+	}
+
+	// Negative results expire sooner.
+	if status := review("invalid"); status.Authenticated {
+		t.Errorf("expected invalid not to be authenticated, got %+v", status)
+	}
+	review("invalid")
+	if reviews["invalid"] != 1 {
+		t.Errorf("expected one TokenReview of invalid, got %d", reviews["invalid"])
+	}
+	now = now.Add(2 * time.Second)
+	review("invalid")
+	if reviews["invalid"] != 2 {
+		t.Errorf("expected the negative result to expire, got %d TokenReviews", reviews["invalid"])
+	}
+
+	// The cache is bounded, the least recently used results are evicted.
+	if n := c.Len(); n != 2 {
+		t.Errorf("expected 2 cached results, got %d", n)
+	}
+	review("valid1", "konnectivity")
+	if reviews["valid1"] != 2 {
+		t.Errorf("expected the result to be cached, got %d TokenReviews", reviews["valid1"])
+	}
+	review("valid1")
+	if reviews["valid1"] != 3 {
+		t.Errorf("expected the evicted result to be reviewed again, got %d TokenReviews", reviews["valid1"])
+	}
+
+	// Positive results expire after the TTL.
+	now = now.Add(2 * time.Minute)
+	review("valid1")
+	if reviews["valid1"] != 4 {
+		t.Errorf("expected the positive result to expire, got %d TokenReviews", reviews["valid1"])
+	}
+
+	// Failed TokenReviews are not cached.
+	apiErr = fmt.Errorf("API server unavailable")
+	if _, err := c.Review("valid2", nil); err == nil {
+		t.Error("expected the TokenReview error")
+	}
+	apiErr = nil
+	review("valid2")
+	if reviews["valid2"] != 2 {
+		t.Errorf("expected the failure not to be cached, got %d TokenReviews", reviews["valid2"])
+	}
+}
+
+func TestAgentAuthenticationUsesTokenReviewCache(t *testing.T) {
+	reviews := make(map[string]int)
+	kcs := k8sfake.NewSimpleClientset()
+	kcs.AuthenticationV1().(*fakeauthenticationv1.FakeAuthenticationV1).Fake.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		token := action.(k8stesting.CreateAction).GetObject().(*authv1.TokenReview).Spec.Token
+		reviews[token]++
+		tr := &authv1.TokenReview{
+			Status: authv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authv1.UserInfo{Username: "system:serviceaccount:ns:sa"},
+			},
+		}
+		return true, tr, nil
+	})
+	a := &TokenReviewAgentAuthenticator{
+		KubernetesClient: kcs,
+		ServiceAccounts:  []ServiceAccount{{Namespace: "ns", Name: "sa"}},
+		Cache: NewTokenReviewCache(kcs, TokenReviewCacheOptions{
+			MaxSize: 10,
+			TTL:     time.Minute,
+		}),
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok, err := a.AuthenticateAgent(AgentCredentials{Token: "token"}); !ok || err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reviews["token"] != 1 {
+		t.Errorf("expected one TokenReview, got %d", reviews["token"])
+	}
+}
@@ -17,105 +17,211 @@ limitations under the License.
 package server
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server/metrics"
 )
 
 // Tunnel implements Proxy based on HTTP Connect, which tunnels the traffic to
 // the agent registered in ProxyServer.
 type Tunnel struct {
 	Server *ProxyServer
+	// Authenticator validates the Proxy-Authorization header of the
+	// requests. No authentication is required when nil.
+	Authenticator ProxyAuthenticator
+	// ForwardProxy enables forwarding plain HTTP requests with an absolute
+	// URI, e.g. "GET http://host:port/path", in addition to CONNECT.
+	ForwardProxy bool
+
+	// forwardMu protects forwardPools.
+	forwardMu sync.Mutex
+	// forwardPools keeps the connections to the destinations of forwarded
+	// requests alive, per authenticated frontend identity.
+	forwardPools map[string]*forwardPool
 }
 
 func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	klog.V(2).InfoS("Received request for host", "method", r.Method, "host", r.Host, "userAgent", r.UserAgent())
-	if r.TLS != nil {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 		klog.V(2).InfoS("TLS", "commonName", r.TLS.PeerCertificates[0].Subject.CommonName)
 	}
-	if r.Method != http.MethodConnect {
+	forward := r.Method != http.MethodConnect
+	if forward && !(t.ForwardProxy && r.URL.IsAbs()) {
 		http.Error(w, "this proxy only supports CONNECT passthrough", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// HTTP/2 connections carry many CONNECT streams and cannot be
+	// hijacked, the stream itself is tunneled instead.
 	hijacker, ok := w.(http.Hijacker)
-	if !ok {
+	if !forward && !ok && r.ProtoMajor != 2 {
 		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
 
-	conn, bufrw, err := hijacker.Hijack()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	identity := httpFrontendIdentity(r)
+	authenticated := r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+	if t.Authenticator != nil {
+		user, err := authenticateProxyRequest(t.Authenticator, r.Header.Get("Proxy-Authorization"))
+		if err != nil {
+			klog.V(2).InfoS("Rejected unauthenticated request", "host", r.Host, "frontend", identity, "err", err)
+			w.Header().Set("Proxy-Authenticate", t.Authenticator.Challenge())
+			http.Error(w, err.Error(), http.StatusProxyAuthRequired)
+			return
+		}
+		klog.V(2).InfoS("Authenticated request", "host", r.Host, "frontend", identity, "user", user)
+		identity = user
+		authenticated = true
+	}
+
+	if forward {
+		pool := ""
+		if authenticated {
+			pool = identity
+		}
+		t.serveForward(w, r, identity, pool)
 		return
 	}
 
+	connection := &ProxyClientConnection{
+		Mode:      "http-connect",
+		connected: make(chan struct{}),
+		start:     time.Now(),
+		identity:  identity,
+		userAgent: r.UserAgent(),
+		address:   r.Host,
+	}
+	// Wait for the DIAL_RSP before answering, so that the client can tell
+	// a failed dial from a closed connection.
+	if err := t.dial(connection, r.Context().Done()); err != nil {
+		writeDialError(w, r.Host, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	var conn net.Conn
+	var reader io.Reader
+	if r.ProtoMajor == 2 {
+		stream, err := newHTTP2StreamConn(w, r)
+		if err != nil {
+			klog.ErrorS(err, "failed to tunnel HTTP/2 stream")
+			t.Server.closeFrontend(connection, err.Error())
+			return
+		}
+		conn, reader = stream, stream
+	} else {
+		hijacked, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			klog.ErrorS(err, "failed to hijack connection")
+			t.Server.closeFrontend(connection, err.Error())
+			return
+		}
+		conn, reader = hijacked, bufrw
+	}
+	if err := connection.attach(conn); err != nil {
+		klog.ErrorS(err, "failed to write to connection")
+	}
+
+	defer conn.Close()
+
+	klog.V(3).InfoS("Starting proxy to host", "host", r.Host, "proto", r.Proto)
+	t.forwardToAgent(connection, reader)
+}
+
+// errNoTunnel indicates that no agent could be asked to dial.
+type errNoTunnel struct {
+	err error
+}
+
+func (e *errNoTunnel) Error() string {
+	return fmt.Sprintf("currently no tunnels available: %v", e.err)
+}
+
+// dial asks an agent to dial the address of the connection, and waits for
+// the DIAL_RSP or until done is closed.
+func (t *Tunnel) dial(connection *ProxyClientConnection, done <-chan struct{}) error {
 	random := rand.Int63()
 	dialRequest := &client.Packet{
 		Type: client.PacketType_DIAL_REQ,
 		Payload: &client.Packet_DialRequest{
 			DialRequest: &client.DialRequest{
 				Protocol: "tcp",
-				Address:  r.Host,
+				Address:  connection.address,
 				Random:   random,
 			},
 		},
 	}
-	klog.V(4).InfoS("Set pending", "random", random, "value", w)
-	backend, err := t.Server.BackendManager.Backend(context.TODO())
+	klog.V(4).InfoS("Set pending", "random", random, "address", connection.address)
+	backend, err := t.Server.pickBackend(connection.identity)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("currently no tunnels available: %v", err), http.StatusInternalServerError)
-		return
-	}
-	connected := make(chan struct{})
-	connection := &ProxyClientConnection{
-		Mode:      "http-connect",
-		HTTP:      conn,
-		connected: connected,
-		start:     time.Now(),
-		backend:   backend,
+		t.Server.audit(AuditDialFailed, connection, err)
+		if _, ok := err.(*ErrDialRateLimited); ok {
+			return err
+		}
+		return &errNoTunnel{err: err}
 	}
+	connection.backend = backend
+
 	t.Server.PendingDial.Add(random, connection)
+	t.Server.audit(AuditDialRequested, connection, nil)
 	if err := backend.Send(dialRequest); err != nil {
 		klog.ErrorS(err, "failed to tunnel dial request")
-		return
-	}
-	ctxt := backend.Context()
-	if ctxt.Err() != nil {
-		klog.ErrorS(err, "context reports failure")
+		t.Server.PendingDial.Remove(random)
+		connection.releaseBackend()
+		t.Server.audit(AuditDialFailed, connection, err)
+		return &errNoTunnel{err: err}
 	}
 
-	select {
-	case <-ctxt.Done():
-		klog.V(5).Infoln("context reports done")
-	default:
+	if err := t.Server.waitForDial(connection, random, done); err != nil {
+		if _, ok := err.(*ErrNotFound); ok {
+			return &errNoTunnel{err: err}
+		}
+		return err
 	}
+	return nil
+}
 
-	select {
-	case <-connection.connected: // Waiting for response before we begin full communication.
+// writeDialError answers a request whose dial to host failed.
+func writeDialError(w http.ResponseWriter, host string, err error) {
+	switch e := err.(type) {
+	case *ErrDialRateLimited:
+		status := http.StatusTooManyRequests
+		if e.Reason == metrics.RateLimitPendingDials {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+	case *errNoTunnel:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case *ErrDialTimeout:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, fmt.Sprintf("failed to dial %s: %v", host, err), http.StatusBadGateway)
 	}
+}
 
-	defer conn.Close()
-
-	klog.V(3).InfoS("Starting proxy to host", "host", r.Host)
+// forwardToAgent sends the data read from the frontend of the connection to
+// its agent, until the frontend or the agent closes the connection.
+func (t *Tunnel) forwardToAgent(connection *ProxyClientConnection, reader io.Reader) {
 	pkt := make([]byte, 1<<12)
 
+	backend := connection.backend
 	connID := connection.connectID
 	agentID := connection.agentID
 	var acc int
 
 	for {
-		n, err := bufrw.Read(pkt[:])
+		n, err := reader.Read(pkt[:])
 		acc += n
 		if err == io.EOF {
-			klog.V(1).InfoS("EOF from host", "host", r.Host)
+			klog.V(1).InfoS("EOF from host", "host", connection.address)
 			break
 		}
 		if err != nil {
@@ -137,6 +243,7 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			klog.ErrorS(err, "error sending packet")
 			break
 		}
+		connection.addBytesFromFrontend(n)
 		klog.V(5).InfoS("Forwarding data on tunnel to agent",
 			"bytes", n,
 			"totalBytes", acc,
@@ -144,5 +251,123 @@ func (t *Tunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"connectionID", connection.connectID)
 	}
 
-	klog.V(5).InfoS("Stopping transfer to host", "host", r.Host, "agentID", agentID, "connectionID", connID)
+	// The client went away first, e.g. the HTTP/2 stream was reset: the
+	// agent must close its side of the connection.
+	if _, err := t.Server.getFrontend(agentID, connID); err == nil {
+		closeRequest := &client.Packet{
+			Type: client.PacketType_CLOSE_REQ,
+			Payload: &client.Packet_CloseRequest{
+				CloseRequest: &client.CloseRequest{
+					ConnectID: connID,
+				},
+			},
+		}
+		if err := backend.Send(closeRequest); err != nil {
+			klog.ErrorS(err, "CLOSE_REQ to agent failed", "connectionID", connID)
+		}
+	}
+
+	klog.V(5).InfoS("Stopping transfer to host", "host", connection.address, "agentID", agentID, "connectionID", connID)
+}
+
+// http2StreamConn adapts the stream of an HTTP/2 CONNECT request to a
+// net.Conn: the tunneled data is read from the request body and written to
+// the response.
+type http2StreamConn struct {
+	body    io.ReadCloser
+	w       io.Writer
+	flusher http.Flusher
+	local   net.Addr
+	remote  net.Addr
+
+	// mu serializes the writes with Close, the response must not be
+	// written once the handler returned.
+	mu     sync.Mutex
+	closed bool
+}
+
+var _ net.Conn = &http2StreamConn{}
+
+func newHTTP2StreamConn(w http.ResponseWriter, r *http.Request) (*http2StreamConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("flushing not supported")
+	}
+	// Send the 200 response headers right away.
+	flusher.Flush()
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return &http2StreamConn{
+		body:    r.Body,
+		w:       w,
+		flusher: flusher,
+		local:   local,
+		remote:  http2StreamAddr(r.RemoteAddr),
+	}, nil
+}
+
+func (c *http2StreamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *http2StreamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	c.flusher.Flush()
+	return n, nil
+}
+
+// Close ends the tunnel, unblocking the pending Read of the request body.
+func (c *http2StreamConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.body.Close()
+}
+
+func (c *http2StreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *http2StreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *http2StreamConn) SetDeadline(t time.Time) error {
+	return fmt.Errorf("deadlines are not supported on HTTP/2 streams")
+}
+
+func (c *http2StreamConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *http2StreamConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// http2StreamAddr is the address of the client of an HTTP/2 stream.
+type http2StreamAddr string
+
+func (a http2StreamAddr) Network() string {
+	return "tcp"
+}
+
+func (a http2StreamAddr) String() string {
+	return string(a)
+}
+
+// httpFrontendIdentity returns a description of the client of an HTTP
+// request: the common name of its client certificate when mTLS is used,
+// otherwise its remote address.
+func httpFrontendIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return r.RemoteAddr
 }
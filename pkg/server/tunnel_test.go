@@ -0,0 +1,404 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/proto/client"
+)
+
+// chanBackend implements Backend, forwarding the packets sent to the agent
+// to a channel.
+type chanBackend struct {
+	ctx  context.Context
+	sent chan *client.Packet
+}
+
+func (b *chanBackend) Send(p *client.Packet) error {
+	b.sent <- p
+	return nil
+}
+
+func (b *chanBackend) Context() context.Context {
+	return b.ctx
+}
+
+// staticBackendManager always returns the same backend, or ErrNotFound if
+// it is nil.
+type staticBackendManager struct {
+	*DefaultBackendManager
+	backend Backend
+}
+
+func (m *staticBackendManager) Backend(_ context.Context) (Backend, error) {
+	if m.backend == nil {
+		return nil, &ErrNotFound{}
+	}
+	return m.backend, nil
+}
+
+// connectThroughTunnel sends a CONNECT request to the Tunnel at addr and
+// returns the response, and the reader of the tunneled data.
+func connectThroughTunnel(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:80 HTTP/1.1\r\nHost: 127.0.0.1:80\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res
+}
+
+func newTunnelTestServer(backend Backend, dialTimeout time.Duration) (*ProxyServer, *httptest.Server) {
+	p := NewProxyServer("", 1, nil)
+	p.BackendManager = &staticBackendManager{DefaultBackendManager: NewDefaultBackendManager(), backend: backend}
+	p.DialTimeout = dialTimeout
+	return p, httptest.NewServer(&Tunnel{Server: p})
+}
+
+// answerDial waits for the DIAL_REQ sent to the backend and answers it with
+// resp.
+func answerDial(t *testing.T, p *ProxyServer, backend *chanBackend, resp *client.DialResponse) chan *client.Packet {
+	pkt := <-backend.sent
+	if pkt.Type != client.PacketType_DIAL_REQ {
+		t.Errorf("expected DIAL_REQ, got %v", pkt.Type)
+		return nil
+	}
+	resp.Random = pkt.GetDialRequest().Random
+	recvCh := make(chan *client.Packet, 10)
+	recvCh <- &client.Packet{
+		Type:    client.PacketType_DIAL_RSP,
+		Payload: &client.Packet_DialResponse{DialResponse: resp},
+	}
+	go p.serveRecvBackend(backend, nil, "agent1", recvCh)
+	return recvCh
+}
+
+func TestTunnelDialSuccess(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p, ts := newTunnelTestServer(backend, time.Second)
+	defer ts.Close()
+
+	go func() {
+		recvCh := answerDial(t, p, backend, &client.DialResponse{ConnectID: 1})
+		if recvCh == nil {
+			return
+		}
+		// The agent sends data right after the DIAL_RSP.
+		recvCh <- &client.Packet{
+			Type:    client.PacketType_DATA,
+			Payload: &client.Packet_Data{Data: &client.Data{ConnectID: 1, Data: []byte("hello")}},
+		}
+	}()
+
+	conn, br, res := connectThroughTunnel(t, ts.Listener.Addr().String())
+	defer conn.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected hello, got %q", buf)
+	}
+}
+
+func TestTunnelDialErrors(t *testing.T) {
+	testcases := []struct {
+		name        string
+		noBackend   bool
+		dialErr     string
+		noResponse  bool
+		status      int
+		bodyContent string
+	}{
+		{
+			name:        "dial failure",
+			dialErr:     "connection refused",
+			status:      http.StatusBadGateway,
+			bodyContent: "connection refused",
+		},
+		{
+			name:      "no backend",
+			noBackend: true,
+			status:    http.StatusServiceUnavailable,
+		},
+		{
+			name:       "dial timeout",
+			noResponse: true,
+			status:     http.StatusGatewayTimeout,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+			var b Backend = backend
+			if tc.noBackend {
+				b = nil
+			}
+			p, ts := newTunnelTestServer(b, 200*time.Millisecond)
+			defer ts.Close()
+
+			if tc.dialErr != "" {
+				go answerDial(t, p, backend, &client.DialResponse{Error: tc.dialErr})
+			}
+
+			conn, _, res := connectThroughTunnel(t, ts.Listener.Addr().String())
+			defer conn.Close()
+			if res.StatusCode != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, res.StatusCode)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if !strings.Contains(string(body), tc.bodyContent) {
+				t.Errorf("expected the body to contain %q, got %q", tc.bodyContent, body)
+			}
+			if n := p.PendingDial.Len(); n != 0 {
+				t.Errorf("expected no pending dial left, got %d", n)
+			}
+		})
+	}
+}
+
+func TestTunnelLateDialResponse(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p, ts := newTunnelTestServer(backend, 100*time.Millisecond)
+	defer ts.Close()
+
+	conn, _, res := connectThroughTunnel(t, ts.Listener.Addr().String())
+	defer conn.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", res.StatusCode)
+	}
+
+	// The agent dials after the frontend gave up, the connection must be
+	// closed on the agent.
+	answerDial(t, p, backend, &client.DialResponse{ConnectID: 7})
+	select {
+	case pkt := <-backend.sent:
+		if pkt.Type != client.PacketType_CLOSE_REQ || pkt.GetCloseRequest().ConnectID != 7 {
+			t.Errorf("expected CLOSE_REQ for connection 7, got %v", pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a CLOSE_REQ to the agent")
+	}
+}
+
+func TestTunnelHTTP2(t *testing.T) {
+	backend := &chanBackend{ctx: context.Background(), sent: make(chan *client.Packet, 10)}
+	p := NewProxyServer("", 1, nil)
+	p.BackendManager = &staticBackendManager{DefaultBackendManager: NewDefaultBackendManager(), backend: backend}
+	p.DialTimeout = 5 * time.Second
+
+	ts := httptest.NewUnstartedServer(&Tunnel{Server: p})
+	var conns int32
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	if err := http2.ConfigureServer(ts.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer tr.CloseIdleConnections()
+
+	type stream struct {
+		connID int64
+		body   *io.PipeWriter
+		res    *http.Response
+		cancel context.CancelFunc
+		recvCh chan *client.Packet
+	}
+	open := func(connID int64) *stream {
+		ctx, cancel := context.WithCancel(context.Background())
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodConnect, ts.URL, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(ctx)
+		req.Host = "127.0.0.1:80"
+
+		recvChs := make(chan chan *client.Packet, 1)
+		go func() {
+			recvChs <- answerDial(t, p, backend, &client.DialResponse{ConnectID: connID})
+		}()
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+			t.Fatalf("expected a 200 HTTP/2 response, got %d %s", res.StatusCode, res.Proto)
+		}
+		return &stream{connID: connID, body: pw, res: res, cancel: cancel, recvCh: <-recvChs}
+	}
+	expectPacket := func(pktType client.PacketType, connID int64) *client.Packet {
+		select {
+		case pkt := <-backend.sent:
+			if pkt.Type != pktType {
+				t.Fatalf("expected %v, got %v", pktType, pkt)
+			}
+			if id := pkt.GetData().GetConnectID() + pkt.GetCloseRequest().GetConnectID(); id != connID {
+				t.Fatalf("expected %v for connection %d, got %v", pktType, connID, pkt)
+			}
+			return pkt
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v for connection %d", pktType, connID)
+		}
+		return nil
+	}
+	exchange := func(s *stream, data string) {
+		s.recvCh <- &client.Packet{
+			Type:    client.PacketType_DATA,
+			Payload: &client.Packet_Data{Data: &client.Data{ConnectID: s.connID, Data: []byte(data)}},
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(s.res.Body, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data {
+			t.Errorf("expected %q, got %q", data, buf)
+		}
+		if _, err := s.body.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if pkt := expectPacket(client.PacketType_DATA, s.connID); string(pkt.GetData().Data) != data {
+			t.Errorf("expected %q to the agent, got %q", data, pkt.GetData().Data)
+		}
+	}
+
+	s1 := open(1)
+	s2 := open(2)
+	exchange(s1, "hello 1")
+	exchange(s2, "hello 2")
+
+	// Resetting a stream closes the connection on the agent only.
+	s1.cancel()
+	expectPacket(client.PacketType_CLOSE_REQ, 1)
+	exchange(s2, "still open")
+
+	// The agent closing the connection ends the stream.
+	s2.recvCh <- &client.Packet{
+		Type:    client.PacketType_CLOSE_RSP,
+		Payload: &client.Packet_CloseResponse{CloseResponse: &client.CloseResponse{ConnectID: 2}},
+	}
+	if _, err := ioutil.ReadAll(s2.res.Body); err != nil {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+	s2.cancel()
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected the tunnels to share 1 connection, got %d", n)
+	}
+}
+
+func TestTunnelForwardProxyRequests(t *testing.T) {
+	testcases := []struct {
+		name         string
+		forwardProxy bool
+		url          string
+		status       int
+	}{
+		{name: "disabled", url: "http://127.0.0.1:80/", status: http.StatusMethodNotAllowed},
+		{name: "relative URI", forwardProxy: true, url: "/", status: http.StatusMethodNotAllowed},
+		{name: "https", forwardProxy: true, url: "https://127.0.0.1:443/", status: http.StatusBadRequest},
+		{name: "no backend", forwardProxy: true, url: "http://127.0.0.1:80/", status: http.StatusServiceUnavailable},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tunnel := &Tunnel{Server: NewProxyServer("", 1, nil), ForwardProxy: tc.forwardProxy}
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			w := httptest.NewRecorder()
+			tunnel.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("expected %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestTunnelForwardProxyPools(t *testing.T) {
+	tunnel := &Tunnel{Server: NewProxyServer("", 1, nil), ForwardProxy: true}
+	forward := func(remoteAddr, commonName string) {
+		req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:80/", nil)
+		req.RemoteAddr = remoteAddr
+		if commonName != "" {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}},
+			}
+		}
+		tunnel.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	pools := func() int {
+		tunnel.forwardMu.Lock()
+		defer tunnel.forwardMu.Unlock()
+		return len(tunnel.forwardPools)
+	}
+
+	// The unauthenticated clients share a pool, whatever their address.
+	for i := 0; i < 10; i++ {
+		forward(fmt.Sprintf("192.0.2.1:%d", 1000+i), "")
+	}
+	if got := pools(); got != 1 {
+		t.Errorf("expected the unauthenticated clients to share 1 pool, got %d", got)
+	}
+
+	// An authenticated client gets its own pool.
+	forward("192.0.2.2:1000", "alice")
+	forward("192.0.2.2:1001", "alice")
+	if got := pools(); got != 2 {
+		t.Errorf("expected 2 pools, got %d", got)
+	}
+
+	// The pools left unused are evicted.
+	tunnel.forwardMu.Lock()
+	tunnel.forwardPools["alice"].lastUsed = time.Now().Add(-forwardIdleConnTimeout)
+	tunnel.forwardMu.Unlock()
+	forward("192.0.2.1:2000", "")
+	if got := pools(); got != 1 {
+		t.Errorf("expected the unused pool to be evicted, got %d pools", got)
+	}
+}
@@ -19,48 +19,269 @@ package util
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
 )
 
-// getCACertPool loads CA certificates to pool
-func getCACertPool(caFile string) (*x509.CertPool, error) {
-	certPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile(caFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CA cert %s: %v", caFile, err)
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most. The check happens on a handshake.
+var certCheckInterval = 10 * time.Second
+
+// CertExpiryObserver is notified of the expiry of the certificates loaded
+// from file. For a CA bundle, notAfter is the earliest expiry.
+type CertExpiryObserver func(file string, notAfter time.Time)
+
+// earliestExpiry returns the earliest expiry of the PEM certificates.
+func earliestExpiry(pemCerts []byte) (time.Time, error) {
+	var notAfter time.Time
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
 	}
-	ok := certPool.AppendCertsFromPEM(caCert)
-	if !ok {
-		return nil, fmt.Errorf("failed to append CA cert to the cert pool")
+	if notAfter.IsZero() {
+		return time.Time{}, errors.New("no certificate found")
 	}
-	return certPool, nil
+	return notAfter, nil
 }
 
-// GetClientTLSConfig returns tlsConfig based on x509 certs
-func GetClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
-	certPool, err := getCACertPool(caFile)
+// certReloader holds a key pair and a CA pool loaded from files, and loads
+// them again once the files change. A failed reload, e.g. when only one
+// file of the key pair was replaced yet, keeps the previous material.
+type certReloader struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	observe  CertExpiryObserver
+
+	mu       sync.Mutex // protects the following
+	checked  time.Time
+	modified map[string]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newCertReloader(caFile, certFile, keyFile string, observe CertExpiryObserver) (*certReloader, error) {
+	r := &certReloader{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+		observe:  observe,
+		modified: make(map[string]time.Time),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.loadLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the configured files.
+func (r *certReloader) files() []string {
+	var files []string
+	for _, f := range []string{r.caFile, r.certFile, r.keyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// loadLocked loads the key pair and the CA pool.
+func (r *certReloader) loadLocked() error {
+	modified := make(map[string]time.Time)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modified[f] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	var certExpiry time.Time
+	if r.certFile != "" || r.keyFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load X509 key pair %s and %s: %v", r.certFile, r.keyFile, err)
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse cert %s: %v", r.certFile, err)
+		}
+		pair.Leaf = leaf
+		cert = &pair
+		certExpiry = leaf.NotAfter
+	}
+
+	var pool *x509.CertPool
+	var caExpiry time.Time
+	if r.caFile != "" {
+		caCert, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA cert %s: %v", r.caFile, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("failed to append CA cert %s to the cert pool", r.caFile)
+		}
+		if caExpiry, err = earliestExpiry(caCert); err != nil {
+			return fmt.Errorf("failed to parse CA cert %s: %v", r.caFile, err)
+		}
+	}
+
+	r.cert = cert
+	r.pool = pool
+	r.modified = modified
+	r.checked = time.Now()
+	if r.observe != nil {
+		if cert != nil {
+			r.observe(r.certFile, certExpiry)
+		}
+		if pool != nil {
+			r.observe(r.caFile, caExpiry)
+		}
+	}
+	return nil
+}
+
+// changedLocked returns if one of the files changed since it was loaded.
+func (r *certReloader) changedLocked() bool {
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			// The file is being replaced, try again on the next check.
+			return false
+		}
+		if !info.ModTime().Equal(r.modified[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the key pair and the CA pool, loaded again if the files
+// changed.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if r.changedLocked() {
+			if err := r.loadLocked(); err != nil {
+				klog.ErrorS(err, "Failed to reload certificates, keeping the previous ones", "files", r.files())
+			} else {
+				klog.V(1).InfoS("Reloaded certificates", "files", r.files())
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+// verifyPeer verifies the chain presented by the peer against the current
+// CA pool. dnsName is checked when non-empty.
+func (r *certReloader) verifyPeer(rawCerts [][]byte, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificate presented by the peer")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	_, pool := r.current()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// GetClientTLSConfig returns tlsConfig based on x509 certs. The certs and the
+// CA bundle are reloaded when the files change, the new material is used by
+// the following handshakes. observe, if not nil, is notified of the expiry of
+// the certs on every load.
+func GetClientTLSConfig(caFile, certFile, keyFile, serverName string, observe CertExpiryObserver) (*tls.Config, error) {
+	r, err := newCertReloader(caFile, certFile, keyFile, observe)
 	if err != nil {
 		return nil, err
 	}
 
+	// The server certificate is verified by VerifyPeerCertificate against
+	// the current CA pool instead of a fixed RootCAs.
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return r.verifyPeer(rawCerts, serverName, x509.ExtKeyUsageServerAuth)
+		},
+	}
 	if certFile == "" && keyFile == "" {
 		// return TLS config based on CA only
-		tlsConfig := &tls.Config{
-			RootCAs: certPool,
-		}
 		return tlsConfig, nil
 	}
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	tlsConfig.ServerName = serverName
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, _ := r.current()
+		return cert, nil
+	}
+	return tlsConfig, nil
+}
+
+// GetServerTLSConfig returns the tlsConfig of a server presenting the key
+// pair. If caFile is non-empty, the clients must present a certificate
+// signed by one of its CAs. As for GetClientTLSConfig, the files are
+// reloaded when they change.
+func GetServerTLSConfig(caFile, certFile, keyFile string, observe CertExpiryObserver) (*tls.Config, error) {
+	r, err := newCertReloader(caFile, certFile, keyFile, observe)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load X509 key pair %s and %s: %v", certFile, keyFile, err)
+		return nil, err
 	}
 
 	tlsConfig := &tls.Config{
-		ServerName:   serverName,
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      certPool,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	// The client certificate is verified by VerifyPeerCertificate against
+	// the current CA pool instead of a fixed ClientCAs.
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return r.verifyPeer(rawCerts, "", x509.ExtKeyUsageClientAuth)
 	}
 	return tlsConfig, nil
 }
@@ -0,0 +1,283 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string, notAfter time.Time) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns the PEM cert and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+type testPKI struct {
+	dir string
+}
+
+func (p *testPKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+func (p *testPKI) write(t *testing.T, name string, content []byte) {
+	if err := ioutil.WriteFile(p.path(name), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make the change visible regardless of the mtime granularity.
+	modTime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(p.path(name), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rotate writes a new CA and the server and client key pairs it signs.
+func (p *testPKI) rotate(t *testing.T, name string, notAfter time.Time) {
+	ca := newTestCA(t, name, notAfter)
+	p.write(t, "ca.crt", ca.pem)
+	cert, key := ca.issue(t, "proxy-server", x509.ExtKeyUsageServerAuth, notAfter)
+	p.write(t, "server.crt", cert)
+	p.write(t, "server.key", key)
+	cert, key = ca.issue(t, "proxy-agent", x509.ExtKeyUsageClientAuth, notAfter)
+	p.write(t, "agent.crt", cert)
+	p.write(t, "agent.key", key)
+}
+
+// handshake runs a TLS handshake over a loopback connection and returns
+// both ends.
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (*tls.Conn, *tls.Conn, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	type result struct {
+		conn *tls.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		s := tls.Server(conn, serverConfig)
+		accepted <- result{s, s.Handshake()}
+	}()
+	c, err := tls.Dial("tcp", lis.Addr().String(), clientConfig)
+	if err != nil {
+		if r := <-accepted; r.conn != nil {
+			r.conn.Close()
+		}
+		return nil, nil, err
+	}
+	r := <-accepted
+	if r.err != nil {
+		c.Close()
+		r.conn.Close()
+		return nil, nil, r.err
+	}
+	return r.conn, c, nil
+}
+
+func TestTLSConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(interval time.Duration) {
+		certCheckInterval = interval
+	}(certCheckInterval)
+	certCheckInterval = 0
+
+	pki := &testPKI{dir: dir}
+	firstExpiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	pki.rotate(t, "ca1", firstExpiry)
+
+	expiries := make(map[string]time.Time)
+	observe := func(file string, notAfter time.Time) {
+		expiries[file] = notAfter
+	}
+	serverConfig, err := GetServerTLSConfig(pki.path("ca.crt"), pki.path("server.crt"), pki.path("server.key"), observe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := GetClientTLSConfig(pki.path("ca.crt"), pki.path("agent.crt"), pki.path("agent.key"), "proxy-server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"ca.crt", "server.crt"} {
+		if !expiries[pki.path(f)].Equal(firstExpiry) {
+			t.Errorf("expected expiry %v of %s, got %v", firstExpiry, f, expiries[pki.path(f)])
+		}
+	}
+
+	s, c, err := handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer c.Close()
+
+	// The server is verified against its name.
+	caOnly, err := GetClientTLSConfig(pki.path("ca.crt"), "", "", "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverNoClientAuth, err := GetServerTLSConfig("", pki.path("server.crt"), pki.path("server.key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := handshake(t, serverNoClientAuth, caOnly); err == nil {
+		t.Error("expected the handshake to fail on a server name mismatch")
+	}
+
+	// New handshakes use the rotated material.
+	secondExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	pki.rotate(t, "ca2", secondExpiry)
+	s2, c2, err := handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	defer c2.Close()
+	if issuer := c2.ConnectionState().PeerCertificates[0].Issuer.CommonName; issuer != "ca2" {
+		t.Errorf("expected the new server certificate, issued by %s", issuer)
+	}
+	if !expiries[pki.path("server.crt")].Equal(secondExpiry) {
+		t.Errorf("expected expiry %v, got %v", secondExpiry, expiries[pki.path("server.crt")])
+	}
+
+	// The established connection is untouched.
+	go s.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := c.Read(buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected the established connection to work, got %q, %v", buf, err)
+	}
+
+	// A half written key pair keeps the previous material.
+	pki.write(t, "server.key", []byte("invalid"))
+	s3, c3, err := handshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatalf("expected the previous certificates to be kept, got %v", err)
+	}
+	s3.Close()
+	c3.Close()
+}
+
+func TestTLSConfigRejectsUnknownCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(time.Hour)
+	serverPKI := &testPKI{dir: filepath.Join(dir, "server")}
+	clientPKI := &testPKI{dir: filepath.Join(dir, "client")}
+	for _, p := range []*testPKI{serverPKI, clientPKI} {
+		if err := os.Mkdir(p.dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serverPKI.rotate(t, "ca1", notAfter)
+	clientPKI.rotate(t, "ca2", notAfter)
+
+	serverConfig, err := GetServerTLSConfig(serverPKI.path("ca.crt"), serverPKI.path("server.crt"), serverPKI.path("server.key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client trusts the server, but presents a certificate of another CA.
+	clientConfig, err := GetClientTLSConfig(serverPKI.path("ca.crt"), clientPKI.path("agent.crt"), clientPKI.path("agent.key"), "proxy-server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := handshake(t, serverConfig, clientConfig); err == nil {
+		t.Error("expected the client certificate to be rejected")
+	}
+}
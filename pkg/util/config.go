@@ -0,0 +1,255 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigAPIVersion is the version of the format of the configuration files.
+const ConfigAPIVersion = "apiserver-network-proxy.sigs.k8s.io/v1alpha1"
+
+// ConfigFile sets the flags of a command from a YAML configuration file:
+//
+//	apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+//	kind: ProxyServerConfiguration
+//	mode: http-connect
+//	frontend-dial-qps: 10
+//	proxy-auth-audiences: [system:konnectivity-server]
+//
+// Every key besides apiVersion and kind is the name of a flag. The flags set
+// on the command line override the values of the file.
+type ConfigFile struct {
+	path  string
+	kind  string
+	flags *pflag.FlagSet
+
+	// commandLine holds the flags set on the command line.
+	commandLine map[string]bool
+	// values holds the values last set from the file.
+	values map[string]string
+}
+
+// NewConfigFile returns the configuration file at path, of the given kind,
+// setting flags. It must be called once the command line is parsed.
+func NewConfigFile(path, kind string, flags *pflag.FlagSet) *ConfigFile {
+	commandLine := make(map[string]bool)
+	flags.Visit(func(f *pflag.Flag) {
+		commandLine[f.Name] = true
+	})
+	return &ConfigFile{
+		path:        path,
+		kind:        kind,
+		flags:       flags,
+		commandLine: commandLine,
+		values:      make(map[string]string),
+	}
+}
+
+// read parses the file into flag values.
+func (c *ConfigFile) read() (map[string]string, error) {
+	content, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", c.path, err)
+	}
+	if v := doc["apiVersion"]; v != ConfigAPIVersion {
+		return nil, fmt.Errorf("config file %s: unsupported apiVersion %v, expected %s", c.path, v, ConfigAPIVersion)
+	}
+	if k := doc["kind"]; k != c.kind {
+		return nil, fmt.Errorf("config file %s: unexpected kind %v, expected %s", c.path, k, c.kind)
+	}
+	values := make(map[string]string)
+	for key, value := range doc {
+		if key == "apiVersion" || key == "kind" {
+			continue
+		}
+		if key == "config" || c.flags.Lookup(key) == nil {
+			return nil, fmt.Errorf("config file %s: unknown option %q", c.path, key)
+		}
+		s, err := flagValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: option %q: %v", c.path, key, err)
+		}
+		values[key] = s
+	}
+	return values, nil
+}
+
+// flagValue formats a YAML value as a flag value. Lists are joined with
+// commas, as expected by the slice flags.
+func flagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// set sets the flags of values, except the ones set on the command line.
+func (c *ConfigFile) set(values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if c.commandLine[key] {
+			klog.V(1).InfoS("Config file option overridden by the command line", "option", key)
+			continue
+		}
+		if err := c.setFlag(key, values[key]); err != nil {
+			return fmt.Errorf("config file %s: invalid value %q for option %q: %v", c.path, values[key], key, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets the flag to value. The value of a slice flag is replaced
+// instead of appended to.
+func (c *ConfigFile) setFlag(name, value string) error {
+	f := c.flags.Lookup(name)
+	sv, ok := f.Value.(pflag.SliceValue)
+	if !ok {
+		return c.flags.Set(name, value)
+	}
+	var items []string
+	if value != "" {
+		items = strings.Split(value, ",")
+	}
+	if err := sv.Replace(items); err != nil {
+		return err
+	}
+	f.Changed = true
+	return nil
+}
+
+// flagString returns the current value of the flag, as in the file.
+func flagString(f *pflag.Flag) string {
+	if sv, ok := f.Value.(pflag.SliceValue); ok {
+		return strings.Join(sv.GetSlice(), ",")
+	}
+	return f.Value.String()
+}
+
+// Load sets the flags from the file.
+func (c *ConfigFile) Load() error {
+	values, err := c.read()
+	if err != nil {
+		return err
+	}
+	if err := c.set(values); err != nil {
+		return err
+	}
+	c.values = values
+	return nil
+}
+
+// Reload reads the file again and applies the changed values of the
+// reloadable options. The changes of other options are ignored until the
+// next restart. If validate fails, the previous values are restored. Reload
+// returns the names of the options whose value changed.
+func (c *ConfigFile) Reload(reloadable map[string]bool, validate func() error) ([]string, error) {
+	values, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]string)
+	previous := make(map[string]string)
+	for key := range union(values, c.values) {
+		value, ok := values[key]
+		if old, wasSet := c.values[key]; ok == wasSet && value == old {
+			continue
+		}
+		if c.commandLine[key] {
+			continue
+		}
+		if !reloadable[key] {
+			klog.InfoS("Change of option requires a restart", "option", key)
+			continue
+		}
+		f := c.flags.Lookup(key)
+		if !ok {
+			// Back to the default value.
+			value = f.DefValue
+			if _, ok := f.Value.(pflag.SliceValue); ok {
+				value = strings.Trim(value, "[]")
+			}
+		}
+		changed[key] = value
+		previous[key] = flagString(f)
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if err := c.set(changed); err != nil {
+		c.set(previous)
+		return nil, err
+	}
+	if err := validate(); err != nil {
+		c.set(previous)
+		return nil, err
+	}
+	var names []string
+	for key := range changed {
+		if value, ok := values[key]; ok {
+			c.values[key] = value
+		} else {
+			delete(c.values, key)
+		}
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func union(a, b map[string]string) map[string]bool {
+	ret := make(map[string]bool, len(a)+len(b))
+	for key := range a {
+		ret[key] = true
+	}
+	for key := range b {
+		ret[key] = true
+	}
+	return ret
+}
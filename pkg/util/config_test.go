@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+type testOptions struct {
+	mode  string
+	qps   float32
+	rules []string
+}
+
+func newTestFlags(o *testOptions, args ...string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVar(&o.mode, "mode", "grpc", "")
+	flags.Float32Var(&o.qps, "qps", 0, "")
+	flags.StringSliceVar(&o.rules, "rules", nil, "")
+	if err := flags.Parse(args); err != nil {
+		panic(err)
+	}
+	return flags
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	testcases := []struct {
+		desc    string
+		args    []string
+		content string
+		want    testOptions
+		wantErr bool
+	}{
+		{
+			desc: "values from the file",
+			content: `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+mode: http-connect
+qps: 2.5
+rules: [direct=.local, proxy=*]
+`,
+			want: testOptions{mode: "http-connect", qps: 2.5, rules: []string{"direct=.local", "proxy=*"}},
+		},
+		{
+			desc: "command line overrides the file",
+			args: []string{"--mode=grpc"},
+			content: `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+mode: http-connect
+qps: 1
+`,
+			want: testOptions{mode: "grpc", qps: 1},
+		},
+		{
+			desc: "unsupported apiVersion",
+			content: `apiVersion: v1
+kind: Test
+`,
+			wantErr: true,
+		},
+		{
+			desc: "unexpected kind",
+			content: `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Other
+`,
+			wantErr: true,
+		},
+		{
+			desc: "unknown option",
+			content: `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+unknown: true
+`,
+			wantErr: true,
+		},
+		{
+			desc: "invalid value",
+			content: `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+qps: fast
+`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.desc, func(t *testing.T) {
+			writeConfig(t, path, tc.content)
+			var o testOptions
+			c := NewConfigFile(path, "Test", newTestFlags(&o, tc.args...))
+			err := c.Load()
+			if tc.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(o, tc.want) {
+				t.Errorf("expected %+v, got %+v", tc.want, o)
+			}
+		})
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+mode: http-connect
+qps: 1
+rules: [direct=.local]
+`)
+	var o testOptions
+	c := NewConfigFile(path, "Test", newTestFlags(&o))
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	reloadable := map[string]bool{"qps": true, "rules": true}
+	validate := func() error { return nil }
+
+	// mode needs a restart, rules is reset to its default.
+	writeConfig(t, path, `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+mode: grpc
+qps: 5
+`)
+	changed, err := c.Reload(reloadable, validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"qps", "rules"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("expected changed %v, got %v", want, changed)
+	}
+	if want := (testOptions{mode: "http-connect", qps: 5}); !reflect.DeepEqual(o, want) {
+		t.Errorf("expected %+v, got %+v", want, o)
+	}
+
+	// A failed validation restores the previous values.
+	writeConfig(t, path, `apiVersion: apiserver-network-proxy.sigs.k8s.io/v1alpha1
+kind: Test
+qps: 10
+rules: [proxy=*]
+`)
+	if _, err := c.Reload(reloadable, func() error { return errors.New("invalid") }); err == nil {
+		t.Error("expected the reload to fail")
+	}
+	if want := (testOptions{mode: "http-connect", qps: 5}); !reflect.DeepEqual(o, want) {
+		t.Errorf("expected %+v, got %+v", want, o)
+	}
+
+	changed, err = c.Reload(reloadable, validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"qps", "rules"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("expected changed %v, got %v", want, changed)
+	}
+	if want := (testOptions{mode: "http-connect", qps: 10, rules: []string{"proxy=*"}}); !reflect.DeepEqual(o, want) {
+		t.Errorf("expected %+v, got %+v", want, o)
+	}
+}
@@ -30,4 +30,8 @@ const (
 
 	// UserAgent is used to provide the client information in a proxy request
 	UserAgent = "user-agent"
+
+	// MaxConnections is used by the agent to announce the maximum number of
+	// concurrent connections it accepts. It is omitted when unlimited.
+	MaxConnections = "maxConnections"
 )
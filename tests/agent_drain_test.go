@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+)
+
+func TestAgent_Drain(t *testing.T) {
+	ts := httptest.NewServer(newEchoServer("hello"))
+	defer ts.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	proxy, proxyServer, cleanup, err := runGRPCProxyServerWithServerCount(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	cs := runAgent(proxy.agent, stopCh)
+
+	// Wait for agent to register on proxy server
+	time.Sleep(time.Second)
+
+	tunnel, err := client.CreateSingleUseGrpcTunnel(proxy.front, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tunnel.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- cs.Drain(ctx)
+	}()
+
+	// The agent is not ready anymore, and the proxy server stops routing
+	// new connections to it.
+	lister := proxyServer.BackendManager.(interface{ Agents() []server.AgentInfo })
+	goingAway := func() bool {
+		agents := lister.Agents()
+		return len(agents) == 1 && agents[0].GoingAway
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if ready, _ := cs.Ready(); !ready && goingAway() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the agent to leave the proxy server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The established connection is still served.
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", ts.Listener.Addr())
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expect %d; got %d", http.StatusOK, res.StatusCode)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected drain to wait for the connection, returned %v", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected drain to complete, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected drain to complete once the connection is closed")
+	}
+	if n := cs.ClientsCount(); n != 0 {
+		t.Errorf("expected the streams to be closed, got %d clients", n)
+	}
+}
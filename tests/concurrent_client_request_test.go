@@ -60,7 +60,7 @@ type singleTimeManager struct {
 	used     map[string]struct{}
 }
 
-func (s *singleTimeManager) AddBackend(agentID string, conn agent.AgentService_ConnectServer) server.Backend {
+func (s *singleTimeManager) AddBackend(agentID string, conn agent.AgentService_ConnectServer, _ int) server.Backend {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.backends[agentID] = conn
@@ -126,6 +126,9 @@ func TestConcurrentClientRequest(t *testing.T) {
 	runAgent(proxy.agent, stopCh)
 	runAgent(proxy.agent, stopCh)
 
+	// Wait for agents to register on proxy server
+	time.Sleep(time.Second)
+
 	client1 := getTestClient(proxy.front, t)
 	client2 := getTestClient(proxy.front, t)
 	var wg sync.WaitGroup
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	agentproto "sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func runHTTPForwardProxyServer() (proxy, func(), error) {
+	var p proxy
+	s := server.NewProxyServer(uuid.New().String(), 0, &server.AgentTokenAuthenticationOptions{})
+	agentServer := grpc.NewServer()
+
+	agentproto.RegisterAgentServiceServer(agentServer, s)
+	lis, err := net.Listen("tcp", "")
+	if err != nil {
+		return p, func() {}, err
+	}
+	go agentServer.Serve(lis)
+	p.agent = localAddr(lis.Addr())
+
+	httpServer := &http.Server{
+		Handler: &server.Tunnel{
+			Server:       s,
+			ForwardProxy: true,
+		},
+	}
+	lis2, err := net.Listen("tcp", "")
+	if err != nil {
+		return p, func() {}, err
+	}
+	p.front = localAddr(lis2.Addr())
+	go httpServer.Serve(lis2)
+
+	cleanup := func() {
+		lis.Close()
+		lis2.Close()
+		httpServer.Shutdown(context.Background())
+		agentServer.Stop()
+	}
+	p.server = s
+
+	return p, cleanup, nil
+}
+
+func TestForwardProxy_HTTP(t *testing.T) {
+	var headers http.Header
+	var conns int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "response")
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p, cleanup, err := runHTTPForwardProxyServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	runAgent(p.agent, stopCh)
+
+	// Wait for agent to register on proxy server
+	time.Sleep(time.Second)
+
+	proxyURL, _ := url.Parse("http://" + p.front)
+	c := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+	for _, path := range []string{"/a", "/b"} {
+		req, _ := http.NewRequest(http.MethodGet, backend.URL+path, nil)
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "request")
+		req.Header.Set("X-End-To-End", "kept")
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello "+path {
+			t.Errorf("expect %q; got %q", "hello "+path, data)
+		}
+		if res.Header.Get("X-Hop") != "" {
+			t.Errorf("expected the hop-by-hop response header to be stripped, got %v", res.Header)
+		}
+		if headers.Get("X-Hop") != "" || headers.Get("X-End-To-End") != "kept" {
+			t.Errorf("expected only the hop-by-hop request header to be stripped, got %v", headers)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected the requests to share 1 connection to the destination, got %d", n)
+	}
+
+	// Errors to dial the destination are reported as such.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	res, err := c.Get("http://" + closedAddr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("expect %d; got %d", http.StatusBadGateway, res.StatusCode)
+	}
+}
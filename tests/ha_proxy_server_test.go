@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"log"
@@ -14,6 +15,7 @@ import (
 
 	"google.golang.org/grpc"
 	"sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
 )
 
 type tcpLB struct {
@@ -42,6 +44,10 @@ func (lb *tcpLB) serve(stopCh chan struct{}) {
 	if err != nil {
 		log.Fatalf("failed to bind: %s", err)
 	}
+	lb.serveListener(ln, stopCh)
+}
+
+func (lb *tcpLB) serveListener(ln net.Listener, stopCh chan struct{}) {
 	for {
 		select {
 		case <-stopCh:
@@ -51,6 +57,11 @@ func (lb *tcpLB) serve(stopCh chan struct{}) {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Printf("failed to accept: %s", err)
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
 			continue
 		}
 		// go lb.handleConnection(conn, lb.randomBackend())
@@ -182,6 +193,83 @@ func TestBasicHAProxyServer_GRPC(t *testing.T) {
 	testProxyServer(t, proxy4.front, server.URL)
 }
 
+// waitForClients waits for the agent to be connected to want healthy proxy
+// servers, with no other client.
+func waitForClients(t *testing.T, clientset *agent.ClientSet, want int) {
+	t.Helper()
+	var hc, cc int
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		hc, cc = clientset.HealthyClientsCount(), clientset.ClientsCount()
+		if hc == want && cc == want {
+			return
+		}
+	}
+	t.Fatalf("expected to get %d clients, got %d clients, %d healthy clients", want, cc, hc)
+}
+
+func TestHAProxyServerScaleDown_GRPC(t *testing.T) {
+	server := httptest.NewServer(newEchoServer("hello"))
+	defer server.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	proxy, cleanups := setupHAProxyServer(t)
+	defer func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lb := tcpLB{
+		backends: []string{
+			proxy[0].agent,
+			proxy[1].agent,
+			proxy[2].agent,
+		},
+		t: t,
+	}
+	go lb.serveListener(ln, stopCh)
+
+	clientset := runAgent(ln.Addr().String(), stopCh)
+	waitForClients(t, clientset, 3)
+
+	// Replace a proxy server with one of a smaller deployment: the agent
+	// learns the new count and leaves one of the remaining servers.
+	lb.removeBackend(proxy[0].agent)
+	cleanups[0]()
+	proxy3, server3, cleanup3, err := runGRPCProxyServerWithServerCount(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanups[0] = cleanup3
+	lb.addBackend(proxy3.agent)
+
+	for i := 0; ; i++ {
+		if _, err := server3.BackendManager.Backend(context.Background()); err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal("expected the agent to connect to the new proxy server")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	waitForClients(t, clientset, 2)
+	testProxyServer(t, proxy3.front, server.URL)
+
+	// Stable at the new count.
+	time.Sleep(time.Second)
+	if hc, cc := clientset.HealthyClientsCount(), clientset.ClientsCount(); hc != 2 || cc != 2 {
+		t.Errorf("expected to keep 2 clients, got %d clients, %d healthy clients", cc, hc)
+	}
+}
+
 func testProxyServer(t *testing.T, front string, target string) {
 	tunnel, err := client.CreateSingleUseGrpcTunnel(front, grpc.WithInsecure())
 	if err != nil {
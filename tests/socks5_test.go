@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	socks "golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/server"
+	agentproto "sigs.k8s.io/apiserver-network-proxy/proto/agent"
+)
+
+func runSOCKS5ProxyServer(credentials map[string]string) (proxy, func(), error) {
+	var p proxy
+	s := server.NewProxyServer(uuid.New().String(), 0, &server.AgentTokenAuthenticationOptions{})
+	agentServer := grpc.NewServer()
+
+	agentproto.RegisterAgentServiceServer(agentServer, s)
+	lis, err := net.Listen("tcp", "")
+	if err != nil {
+		return p, func() {}, err
+	}
+	go agentServer.Serve(lis)
+	p.agent = localAddr(lis.Addr())
+
+	socksServer := &server.SOCKS5{
+		Server:      s,
+		Credentials: credentials,
+	}
+	lis2, err := net.Listen("tcp", "")
+	if err != nil {
+		return p, func() {}, err
+	}
+	p.front = localAddr(lis2.Addr())
+	go socksServer.Serve(lis2)
+
+	cleanup := func() {
+		lis.Close()
+		lis2.Close()
+		agentServer.Stop()
+	}
+	p.server = s
+
+	return p, cleanup, nil
+}
+
+func createSOCKS5Client(proxyAddr string, auth *socks.Auth) (*http.Client, error) {
+	dialer, err := socks.SOCKS5("tcp", proxyAddr, auth, socks.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: dialer.Dial,
+		},
+		Timeout: 5 * time.Second,
+	}, nil
+}
+
+func TestBasicProxy_SOCKS5(t *testing.T) {
+	server := httptest.NewServer(newEchoServer("hello"))
+	defer server.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p, cleanup, err := runSOCKS5ProxyServer(map[string]string{"kube-apiserver": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	runAgent(p.agent, stopCh)
+
+	// Wait for agent to register on proxy server
+	time.Sleep(time.Second)
+
+	c, err := createSOCKS5Client(p.front, &socks.Auth{User: "kube-apiserver", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		data, err := clientRequest(c, server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Errorf("expect %v; got %v", "hello", string(data))
+		}
+	}
+}
+
+func TestProxy_SOCKS5_Errors(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p, cleanup, err := runSOCKS5ProxyServer(map[string]string{"kube-apiserver": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// No agent is connected yet.
+	c, err := createSOCKS5Client(p.front, &socks.Auth{User: "kube-apiserver", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientRequest(c, "http://127.0.0.1:1/"); err == nil {
+		t.Error("expected an error without agents")
+	}
+
+	runAgent(p.agent, stopCh)
+	time.Sleep(time.Second)
+
+	// Wrong credentials.
+	c, err = createSOCKS5Client(p.front, &socks.Auth{User: "kube-apiserver", Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientRequest(c, "http://127.0.0.1:1/"); err == nil {
+		t.Error("expected an authentication error")
+	}
+
+	// The agent fails to dial the destination.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	dialer, err := socks.SOCKS5("tcp", p.front, &socks.Auth{User: "kube-apiserver", Password: "secret"}, socks.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial("tcp", closedAddr); err == nil {
+		t.Error("expected a dial error")
+	}
+	if n := p.server.PendingDial.Len(); n != 0 {
+		t.Errorf("expected no pending dial left, got %d", n)
+	}
+}
+
+func TestProxy_SOCKS5_NoAuth(t *testing.T) {
+	server := httptest.NewServer(newEchoServer("hello"))
+	defer server.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	p, cleanup, err := runSOCKS5ProxyServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	runAgent(p.agent, stopCh)
+	time.Sleep(time.Second)
+
+	c, err := createSOCKS5Client(p.front, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("expect %v; got %v", "hello", string(data))
+	}
+}